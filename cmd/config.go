@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+)
+
+// loadConfig sets flags from a YAML file mapping flag names to values, e.g.
+//
+//	cidr:
+//	- 192.168.0.0/16
+//	- 10.38.0.0/20
+//	source-precedence:
+//	  subnets: 30
+//	  cidr: 10
+//
+// Flags given on the command line are left alone.
+func loadConfig(flags *pflag.FlagSet, path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read config: %v", err)
+	}
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return fmt.Errorf("unable to parse config %s: %v", path, err)
+	}
+
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		flag := flags.Lookup(name)
+		if flag == nil || name == "config" {
+			return fmt.Errorf("config %s: unknown setting %q", path, name)
+		}
+		if flag.Changed {
+			continue
+		}
+		if err := setFlag(flag, config[name]); err != nil {
+			return fmt.Errorf("config %s: invalid %s: %v", path, name, err)
+		}
+	}
+	return nil
+}
+
+// setFlag sets flag from a decoded YAML value. Lists replace the default of
+// slice flags, and maps are passed to map flags as key=value pairs.
+func setFlag(flag *pflag.Flag, value interface{}) error {
+	switch value := value.(type) {
+	case []interface{}:
+		items := make([]string, 0, len(value))
+		for _, item := range value {
+			items = append(items, configString(item))
+		}
+		if slice, ok := flag.Value.(pflag.SliceValue); ok {
+			return slice.Replace(items)
+		}
+		return fmt.Errorf("expected a single value, not a list")
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, 0, len(value))
+		for _, key := range keys {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", key, configString(value[key])))
+		}
+		return flag.Value.Set(strings.Join(pairs, ","))
+	default:
+		return flag.Value.Set(configString(value))
+	}
+}
+
+func configString(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return fmt.Sprint(value)
+	}
+}
@@ -4,38 +4,387 @@ Copyright © 2024 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
 	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/dnsmasq/controller"
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 var (
-	additionalCIDR string
+	additionalCIDR []string
+	configFile     string
 	privateKeyPath string
-	dnsServer	  string
+	dnsServer      string
+	maxIPv6Range   uint64
+	maxCIDRAddrs   uint64
+	nameTemplate   string
+	precedence     map[string]int
+	output         string
+	synthDomain    string
+	synthPrefix    string
+	includes       []string
+	excludes       []string
+	skipNetBcast   bool
+	reserve        map[string]string
+	classless      bool
+	publish        map[string]string
+	dhcp           bool
+	dhcpTag        string
+	dhcpLeaseTime  time.Duration
+	leaseTemplate  string
+	sources        []string
+	selectors      []string
+	networkNS      string
+	configMapNS    string
+	recordFiles    []string
+	secretKeys     []string
+	targets        []string
+	bindZoneDir    string
+	bindIPv4Bits   int
+	bindIPv6Bits   int
+	bindTTL        time.Duration
+	bindPrimaryNS  string
+	bindHostmaster string
+	bindNS         []string
+	bindRefresh    time.Duration
+	bindRetry      time.Duration
+	bindExpire     time.Duration
+	bindMinimum    time.Duration
+	bindSerials    string
+	unboundZone    string
+	unboundReload  string
 )
 
 // monitorCmd represents the monitor command
 var monitorCmd = &cobra.Command{
 	Use:   "monitor",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
-	Run: func(cmd *cobra.Command, args []string) {
+	Short: "Publish the DNS records of the vSphere CI networks",
+	Long: `Watches the test-credentials/vsphere-config secret, the VCM networks and
+leases and the other record sources, and publishes the reverse and forward
+records they define to every DNS server on each change.
+
+` + targetHelp,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if configFile != "" {
+			if err := loadConfig(cmd.Flags(), configFile); err != nil {
+				return err
+			}
+		}
+		namer, err := controller.NewNamer(nameTemplate)
+		if err != nil {
+			return err
+		}
+		serials, err := serialState()
+		if err != nil {
+			return err
+		}
+		dnsTargets, err := buildTargets(rendererOptions(serials))
+		if err != nil {
+			return err
+		}
+		if !slices.ContainsFunc(dnsTargets, func(target controller.Target) bool {
+			return target.Format() == controller.OutputBind
+		}) {
+			serials = nil
+		}
+		if synthDomain != "" {
+			if err := requireFormat("--synth-domain", dnsTargets, controller.OutputDnsmasq, controller.OutputBind); err != nil {
+				return err
+			}
+			for _, cidr := range additionalCIDR {
+				if _, err := controller.NewSynthDomain(synthDomain, cidr, synthPrefix); err != nil {
+					return err
+				}
+			}
+		}
+		if classless {
+			if err := requireFormat("--classless", dnsTargets, controller.OutputDnsmasq, controller.OutputBind); err != nil {
+				return err
+			}
+		}
+		var dhcpOpts *controller.DHCPOptions
+		if dhcp {
+			if err := requireFormat("--dhcp", dnsTargets, controller.OutputDnsmasq); err != nil {
+				return err
+			}
+			tagger, err := controller.NewNamer(dhcpTag)
+			if err != nil {
+				return fmt.Errorf("invalid --dhcp-tag: %v", err)
+			}
+			dhcpOpts = &controller.DHCPOptions{Tagger: tagger, LeaseTime: dhcpLeaseTime}
+		}
+		var leaseNamer *controller.Namer
+		if leaseTemplate != "" {
+			if leaseNamer, err = controller.NewNamer(leaseTemplate); err != nil {
+				return fmt.Errorf("invalid --lease-name-template: %v", err)
+			}
+		}
+		filters, err := controller.ParseFilters(includes, excludes)
+		if err != nil {
+			return err
+		}
+		reservations, err := controller.ParseReservations(reserve)
+		if err != nil {
+			return err
+		}
+		publishModes, err := controller.ParsePublishModes(publish)
+		if err != nil {
+			return err
+		}
+		if _, ok := publishModes[record.SourceExternalDNS]; !ok {
+			// external-dns hands over names to resolve
+			publishModes[record.SourceExternalDNS] = record.PublishBoth
+		}
+		recordSources, err := buildSources(dhcpOpts, leaseNamer)
+		if err != nil {
+			return err
+		}
 		controller.StartManager(controller.SecretReconciler{
-			AdditionalCIDR: additionalCIDR,
-			PrivateKeyPath: privateKeyPath,
-			DnsServer: dnsServer,
+			Sources:              recordSources,
+			Targets:              dnsTargets,
+			PrivateKeyPath:       privateKeyPath,
+			MaxIPv6Range:         maxIPv6Range,
+			MaxCIDRAddresses:     maxCIDRAddrs,
+			Namer:                namer,
+			Precedence:           sourcePrecedence(),
+			Filters:              filters,
+			Reservations:         reservations,
+			SkipNetworkBroadcast: skipNetBcast,
+			Classless:            classless,
+			Publish:              publishModes,
+			Serials:              serials,
 		})
+		return nil
 	},
 }
 
+// rendererOptions returns the options of the renderers given by the --bind-*
+// and --unbound-* flags.
+func rendererOptions(serials *controller.SerialState) controller.RendererOptions {
+	opts := controller.DefaultRendererOptions()
+	opts.Bind = controller.BindOptions{
+		ZoneDir:     bindZoneDir,
+		IPv4Bits:    bindIPv4Bits,
+		IPv6Bits:    bindIPv6Bits,
+		TTL:         bindTTL,
+		PrimaryNS:   bindPrimaryNS,
+		Hostmaster:  bindHostmaster,
+		NameServers: bindNS,
+		Refresh:     bindRefresh,
+		Retry:       bindRetry,
+		Expire:      bindExpire,
+		Minimum:     bindMinimum,
+		Serials:     serials,
+	}
+	opts.Unbound.ZoneType = unboundZone
+	opts.Unbound.Reload = controller.UnboundReload(unboundReload)
+	return opts
+}
+
+// serialState returns the zone serials shared by the BIND targets, persisted
+// in the ConfigMap given by --bind-serial-configmap.
+func serialState() (*controller.SerialState, error) {
+	serials := &controller.SerialState{}
+	if bindSerials == "" {
+		return serials, nil
+	}
+	namespace, name, ok := strings.Cut(bindSerials, "/")
+	if !ok || namespace == "" || name == "" {
+		return nil, fmt.Errorf("invalid --bind-serial-configmap %q: expected namespace/name", bindSerials)
+	}
+	serials.ConfigMap.Namespace, serials.ConfigMap.Name = namespace, name
+	return serials, nil
+}
+
+// buildTargets returns the targets given by --target, or the single target
+// given by --dns-server and --output.
+func buildTargets(opts controller.RendererOptions) ([]controller.Target, error) {
+	if len(targets) == 0 {
+		format, err := controller.ParseOutputFormat(output)
+		if err != nil {
+			return nil, err
+		}
+		target, err := controller.NewTarget(dnsServer, format, "", opts)
+		if err != nil {
+			return nil, err
+		}
+		return []controller.Target{target}, nil
+	}
+	var result []controller.Target
+	for _, value := range targets {
+		target, err := controller.ParseTarget(value, opts)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, target)
+	}
+	return result, nil
+}
+
+// requireFormat returns an error naming flag unless every target is in one
+// of formats.
+func requireFormat(flag string, dnsTargets []controller.Target, formats ...controller.OutputFormat) error {
+	for _, target := range dnsTargets {
+		if !slices.Contains(formats, target.Format()) {
+			return fmt.Errorf("%s is not supported by target %s; it requires the %v output", flag, target, formats)
+		}
+	}
+	return nil
+}
+
+// buildSources returns the record sources enabled by --sources, in the order
+// given.
+func buildSources(dhcpOpts *controller.DHCPOptions, leaseNamer *controller.Namer) ([]controller.RecordSource, error) {
+	sourceSelectors := map[record.SourceKind]labels.Selector{}
+	for _, value := range selectors {
+		kind, expr, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid --source-selector %q: expected kind=selector", value)
+		}
+		selector, err := labels.Parse(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --source-selector %q: %v", value, err)
+		}
+		sourceSelectors[record.SourceKind(kind)] = selector
+	}
+
+	var result []controller.RecordSource
+	for _, name := range sources {
+		kind := record.SourceKind(name)
+		switch kind {
+		case record.SourceSubnets:
+			result = append(result, &controller.SubnetsSource{DHCP: dhcpOpts, Keys: secretKeys})
+		case record.SourceCIDR:
+			result = append(result, &controller.CIDRSource{CIDRs: additionalCIDR, SynthDomain: synthDomain, SynthPrefix: synthPrefix})
+		case record.SourceNetwork:
+			result = append(result, &controller.NetworkSource{Namespace: networkNS, Selector: sourceSelectors[kind], LeaseNamer: leaseNamer})
+		case record.SourceConfigMap:
+			selector, ok := sourceSelectors[kind]
+			if !ok {
+				// the default selector is known to be valid
+				selector, _ = labels.Parse(controller.DefaultConfigMapSelector)
+			}
+			result = append(result, &controller.ConfigMapSource{Namespace: configMapNS, Selector: selector})
+		case record.SourceFile:
+			result = append(result, &controller.FileSource{Paths: recordFiles})
+		case record.SourceExternalDNS:
+			endpoints, err := endpointsConfigMap()
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, &controller.EndpointsSource{ConfigMap: endpoints})
+		default:
+			return nil, fmt.Errorf("unknown record source %q", name)
+		}
+		delete(sourceSelectors, kind)
+	}
+	for kind := range sourceSelectors {
+		return nil, fmt.Errorf("--source-selector set for %s, which is not a selectable source", kind)
+	}
+	return result, nil
+}
+
+// sourcePrecedence overlays the --source-precedence flag on the default
+// precedence of each record source.
+func sourcePrecedence() record.Precedence {
+	result := record.Precedence{}
+	for kind, value := range record.DefaultPrecedence {
+		result[kind] = value
+	}
+	for kind, value := range precedence {
+		result[record.SourceKind(kind)] = value
+	}
+	return result
+}
+
 func init() {
 	rootCmd.AddCommand(monitorCmd)
-	monitorCmd.PersistentFlags().StringVar(&additionalCIDR, "cidr", "192.168.0.0/16", "additional CIDR for which to generate reverse DNS records")
-	monitorCmd.PersistentFlags().StringVar(&privateKeyPath, "private-key", "/ssh-config/private-key", "path to a private key for SSH access to the DNS server")
-	monitorCmd.PersistentFlags().StringVar(&dnsServer, "dns-server", "10.176.158.144", "additional CIDR for which to generate reverse DNS records")
+	addTargetFlags(monitorCmd.PersistentFlags(), "vsphere-infra-helpers/ptr-record-operator-serials")
+	monitorCmd.PersistentFlags().StringVar(&configFile, "config", "", "YAML file setting any of these flags by name; flags given on the command line take precedence")
+	monitorCmd.PersistentFlags().StringSliceVar(&additionalCIDR, "cidr", []string{"192.168.0.0/16"}, "additional CIDR for which to generate reverse DNS records; may be repeated, overlapping CIDRs are only expanded once")
+	monitorCmd.PersistentFlags().StringVar(&dnsServer, "dns-server", "10.176.158.144", "DNS server the records are pushed to in the --output format, unless --target is given")
+	monitorCmd.PersistentFlags().Uint64Var(&maxIPv6Range, "max-ipv6-range", controller.DefaultMaxIPv6Range, "maximum number of addresses to generate reverse DNS records for in a single IPv6 range")
+	monitorCmd.PersistentFlags().Uint64Var(&maxCIDRAddrs, "max-cidr-addresses", controller.DefaultMaxCIDRAddresses, "maximum number of addresses to generate reverse DNS records for in a single CIDR; larger CIDRs fail the reconcile, while larger networks of NetBox and phpIPAM exports are skipped. Also bounds the records held in memory by bind, unbound local_datas, coredns, rfc2136, powerdns and infoblox targets")
+	monitorCmd.PersistentFlags().StringToIntVar(&precedence, "source-precedence", nil, "precedence of each record source when sources disagree on the name of an address, e.g. 'subnets=30,network=20,cidr=10', where lease ranks the networks named after their Lease and external-dns the endpoints of the webhook command; higher wins")
+	monitorCmd.PersistentFlags().StringVar(&output, "output", string(controller.OutputHosts), "format of the file pushed to the DNS server: 'hosts' for a dnsmasq addn-hosts file, 'dnsmasq' for a dnsmasq conf-file, 'bind' for an archive of BIND zone files or 'unbound' for an unbound include file")
+	monitorCmd.PersistentFlags().StringVar(&synthDomain, "synth-domain", "", "name the additional CIDRs with dnsmasq synth-domain directives in this domain instead of one record per address; requires dnsmasq or bind targets")
+	monitorCmd.PersistentFlags().StringVar(&synthPrefix, "synth-prefix", "ip-", "prefix of the names synthesized for the additional CIDRs")
+	monitorCmd.PersistentFlags().StringArrayVar(&includes, "include", nil, "only generate records for a source within this prefix, e.g. 'cidr=192.168.10.0/24'; may be repeated")
+	monitorCmd.PersistentFlags().StringArrayVar(&excludes, "exclude", nil, "never generate records for a source within this prefix, e.g. 'network=10.93.0.0/24'; may be repeated")
+	monitorCmd.PersistentFlags().BoolVar(&skipNetBcast, "skip-network-broadcast", false, "do not generate records for the network and broadcast addresses of IPv4 subnets and CIDRs")
+	monitorCmd.PersistentFlags().StringToStringVar(&reserve, "reserve", controller.DefaultReservations, "hostname template for the gateway, vif and dhcp addresses of subnets.json entries, also used for the gateway of VCM networks without a primaryRouterHostname; an empty template publishes no record for them. Named addresses are published both forward and reverse")
+	monitorCmd.PersistentFlags().BoolVar(&classless, "classless", false, "place the PTR records of IPv4 subnets and CIDRs smaller than a /24 in RFC 2317 child zones such as 128-25.74.177.10.in-addr.arpa, with a CNAME from the parent /24; requires dnsmasq or bind targets")
+	monitorCmd.PersistentFlags().StringToStringVar(&publish, "publish", nil, "records published for each source: 'reverse' for PTR records, 'forward' for A/AAAA records or 'both', e.g. 'subnets=both,network=both'; defaults to both for external-dns and reverse for the others. The hosts output always answers both")
+	monitorCmd.PersistentFlags().BoolVar(&dhcp, "dhcp", false, "render dnsmasq dhcp-range, router and dns-server options for every subnets.json entry with a DHCP pool; requires dnsmasq targets")
+	monitorCmd.PersistentFlags().StringVar(&dhcpTag, "dhcp-tag", controller.DefaultDHCPTagTemplate, "Go template for the dnsmasq tag of each VLAN's DHCP configuration")
+	monitorCmd.PersistentFlags().DurationVar(&dhcpLeaseTime, "dhcp-lease-time", 0, "DHCP lease time; zero leaves it to dnsmasq")
+	monitorCmd.PersistentFlags().StringVar(&leaseTemplate, "lease-name-template", controller.DefaultLeaseNameTemplate, "Go template for the hostname of addresses of VCM networks held by a lease, with .Lease, .LeaseNamespace and .Index; empty names them like any other network")
+	monitorCmd.PersistentFlags().StringSliceVar(&sources, "sources", []string{"subnets", "cidr", "network"}, "record sources to enable: subnets for subnets.json, cidr for --cidr, network for VCM networks, configmap for labelled ConfigMaps, file for --records-file and external-dns for the endpoints kept by the webhook command in --endpoints-configmap")
+	monitorCmd.PersistentFlags().StringVar(&webhookEndpoints, "endpoints-configmap", defaultEndpointsConfigMap, "ConfigMap, as namespace/name, of the endpoints read by the external-dns source")
+	monitorCmd.PersistentFlags().StringArrayVar(&selectors, "source-selector", nil, "label selector limiting the objects read by the network or configmap source, e.g. 'network=team=ci'; may be repeated")
+	monitorCmd.PersistentFlags().StringVar(&networkNS, "network-namespace", "vsphere-infra-helpers", "namespace of the VCM networks and leases read by the network source")
+	monitorCmd.PersistentFlags().StringVar(&configMapNS, "configmap-namespace", "vsphere-infra-helpers", "namespace of the ConfigMaps read by the configmap source, which defaults to those labelled "+controller.DefaultConfigMapSelector)
+	monitorCmd.PersistentFlags().StringArrayVar(&recordFiles, "records-file", nil, "file read by the file source; may be repeated. Files named *.netbox.json hold NetBox prefixes and ip_addresses exports, *.phpipam.json phpIPAM sections, subnets, addresses and vlans exports, other *.json subnets.json, and anything else a hosts file. ConfigMap keys are read the same way")
+	monitorCmd.PersistentFlags().StringArrayVar(&secretKeys, "secret-key", nil, "further key of the vsphere-config secret read by the subnets source, named as for --records-file; may be repeated")
+	monitorCmd.PersistentFlags().StringVar(&nameTemplate, "name-template", controller.DefaultNameTemplate, "Go template for the hostname reverse DNS records point at, e.g. 'ip-{{.Dashed}}.vlan{{.Vlan}}.{{.Datacenter}}.ci.example.'")
+}
+
+// targetHelp describes the --target values.
+var targetHelp = `Targets reached over SSH are given as server=format[+reload][:path]:
+
+  10.0.0.53=dnsmasq:/etc/dnsmasq.d/ci.conf
+  10.0.0.54=unbound+local_datas
+
+The path defaults to ` + controller.DefaultTargetPath + `,
+` + controller.DefaultBindZoneDir + `.tar for bind or ` + controller.DefaultUnboundPath + ` for unbound.
+Other targets are given as URLs:
+
+  coredns://namespace/configmap?format=hosts|file[&dir=mount][&shards=8]
+      writes CoreDNS hosts or file plugin zones, and the server blocks serving
+      them, into the ConfigMap, sharded into configmap-1... past 1 MB. CoreDNS
+      only reads the shards its Deployment mounts, so dir must be a projected
+      volume listing the ConfigMap and every shard as optional.
+  rfc2136://server[:port]?secret=namespace/name[&zone=zone...][&state=namespace/name]
+      sends RFC 2136 updates signed with the TSIG key of the secret to the
+      given zones, or to the reverse zones of the records, which the state
+      ConfigMap remembers so that their PTR records are deleted after a
+      restart too. Forward names get a "` + controller.RFC2136Owner + `"
+      TXT record, and only the A and AAAA records of those are deleted.
+  powerdns://host[:port]?secret=namespace/name[&server=id][&tls=true][&zone=zone...]
+      does the same through the PowerDNS API with the api-key of the secret,
+      creating missing zones and only changing the RRsets it owns. Without
+      zone=, every zone of the server is checked for RRsets it owns.
+  infoblox://host[:port]?secret=namespace/name[&view=default][&attribute=Owner][&host=true][&zone=zone...][&network=prefix...]
+      manages WAPI record:ptr, and with host=true record:host, objects tagged
+      with the extensible attribute using the username and password of the
+      secret, within the given zones and networks. Host records serve the PTR
+      records of their addresses, which then get no record:ptr.`
+
+// addTargetFlags adds the flags selecting the targets and configuring their
+// renderers to flags, with serials as the default --bind-serial-configmap.
+func addTargetFlags(flags *pflag.FlagSet, serials string) {
+	flags.StringVar(&privateKeyPath, "private-key", "/ssh-config/private-key", "path to a private key for SSH access to the DNS server")
+	flags.StringArrayVar(&targets, "target", nil, "DNS server the records are pushed to, as server=format[+reload][:path] or a coredns, rfc2136, powerdns or infoblox URL described above; may be repeated, and replaces --dns-server and --output")
+	bind := controller.DefaultBindOptions()
+	flags.StringVar(&bindZoneDir, "bind-zone-dir", bind.ZoneDir, "directory of the zone files on bind targets; the archive is extracted there and named.conf should include its zones.conf")
+	flags.IntVar(&bindIPv4Bits, "bind-ipv4-zone-bits", bind.IPv4Bits, "prefix length of the IPv4 reverse zones written for bind and coredns targets, and updated on rfc2136 and powerdns targets without zone=: 8, 16 or 24")
+	flags.IntVar(&bindIPv6Bits, "bind-ipv6-zone-bits", bind.IPv6Bits, "prefix length of the IPv6 reverse zones written for bind and coredns targets, and updated on rfc2136 and powerdns targets without zone=, a multiple of 4")
+	flags.DurationVar(&bindTTL, "bind-ttl", bind.TTL, "default TTL of the zones written for bind and coredns format=file targets, and TTL of the records sent to rfc2136 and powerdns targets")
+	flags.StringVar(&bindPrimaryNS, "bind-primary-ns", bind.PrimaryNS, "primary name server in the SOA of the zones written for bind and coredns format=file targets, also the NS record of the zones created on powerdns targets unless --bind-ns is given")
+	flags.StringVar(&bindHostmaster, "bind-hostmaster", bind.Hostmaster, "mailbox in the SOA of the zones written for bind and coredns format=file targets, as a domain name")
+	flags.StringSliceVar(&bindNS, "bind-ns", nil, "NS records of the zones written for bind and coredns format=file targets and of the zones created on powerdns targets; defaults to --bind-primary-ns")
+	flags.DurationVar(&bindRefresh, "bind-refresh", bind.Refresh, "SOA refresh of the zones written for bind and coredns format=file targets")
+	flags.DurationVar(&bindRetry, "bind-retry", bind.Retry, "SOA retry of the zones written for bind and coredns format=file targets")
+	flags.DurationVar(&bindExpire, "bind-expire", bind.Expire, "SOA expire of the zones written for bind and coredns format=file targets")
+	flags.DurationVar(&bindMinimum, "bind-minimum", bind.Minimum, "SOA minimum, the negative caching TTL, of the zones written for bind and coredns format=file targets")
+	flags.StringVar(&bindSerials, "bind-serial-configmap", serials, "ConfigMap, as namespace/name, keeping the SOA serial of each zone written for bind and coredns format=file targets across restarts; empty keeps them in memory")
+	unbound := controller.DefaultUnboundOptions()
+	flags.StringVar(&unboundZone, "unbound-zone-type", unbound.ZoneType, "local-zone type of the reverse zones written for unbound targets: 'static' answers NXDOMAIN for addresses without a record, 'transparent' resolves them as usual")
+	flags.StringVar(&unboundReload, "unbound-reload", string(unbound.Reload), "how unbound targets load their file unless given after the format: 'reload' runs unbound-control reload, 'local_datas' loads only the changes with unbound-control local_datas and friends")
 }
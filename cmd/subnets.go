@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/openshift-splat-team/vsphere-ci-dns/data"
+	"github.com/spf13/cobra"
+)
+
+// subnetsCmd groups the commands working on subnets.json
+var subnetsCmd = &cobra.Command{
+	Use:   "subnets",
+	Short: "Work with the subnets.json key of the vsphere-config secret",
+}
+
+var subnetsSchemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Print the JSON Schema of the current subnets.json version",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		_, err := cmd.OutOrStdout().Write(data.SubnetsSchema)
+		return err
+	},
+}
+
+var subnetsMigrateCmd = &cobra.Command{
+	Use:   "migrate [file]",
+	Short: "Rewrite subnets.json in the current schema version",
+	Long: `Reads subnets.json in any schema version from file, or from standard input
+if file is - or missing, and prints it in the current version. Fields which
+are not part of the schema are dropped and listed on standard error.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		in := cmd.InOrStdin()
+		if len(args) == 1 && args[0] != "-" {
+			file, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			in = file
+		}
+		content, err := io.ReadAll(in)
+		if err != nil {
+			return err
+		}
+		migrated, err := data.MigrateSubnets(content)
+		if err != nil {
+			return err
+		}
+		if doc, _ := data.DecodeSubnets(content); len(doc.Unknown) > 0 {
+			fmt.Fprintf(cmd.ErrOrStderr(), "dropped %v\n", doc.Unknown)
+		}
+		_, err = fmt.Fprintln(cmd.OutOrStdout(), string(migrated))
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(subnetsCmd)
+	subnetsCmd.AddCommand(subnetsSchemaCmd)
+	subnetsCmd.AddCommand(subnetsMigrateCmd)
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/dnsmasq/controller"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+var (
+	webhookAddress   string
+	webhookDomains   []string
+	webhookEndpoints string
+)
+
+// webhookCmd serves the external-dns webhook provider protocol
+var webhookCmd = &cobra.Command{
+	Use:   "webhook",
+	Short: "Keep external-dns endpoints for the monitor command as a webhook provider",
+	Long: `Serves the external-dns webhook provider protocol, to run as a sidecar of
+external-dns started with --provider=webhook. The endpoints of Services and
+Ingresses are kept in the --endpoints-configmap, which the monitor command
+reads as its external-dns source, so that they are published to its targets
+along with every other record. A and AAAA endpoints are published; TXT
+endpoints are kept for the external-dns TXT registry but not published, and
+other record types are dropped.
+
+The external-dns source is not one of the default --sources of the monitor
+command, which must list it, e.g. --sources=subnets,cidr,network,external-dns,
+and read the same --endpoints-configmap.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		endpoints, err := endpointsConfigMap()
+		if err != nil {
+			return err
+		}
+
+		ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+		scheme := runtime.NewScheme()
+		if err := corev1.AddToScheme(scheme); err != nil {
+			return err
+		}
+		c, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+		if err != nil {
+			return err
+		}
+		provider := &controller.WebhookProvider{
+			Client:    c,
+			Domains:   webhookDomains,
+			ConfigMap: endpoints,
+		}
+		ctx := ctrl.LoggerInto(ctrl.SetupSignalHandler(), ctrl.Log.WithName("webhook"))
+		return provider.Serve(ctx, webhookAddress)
+	},
+}
+
+// endpointsConfigMap returns the ConfigMap given by --endpoints-configmap.
+func endpointsConfigMap() (types.NamespacedName, error) {
+	namespace, name, ok := strings.Cut(webhookEndpoints, "/")
+	if !ok || namespace == "" || name == "" {
+		return types.NamespacedName{}, fmt.Errorf("invalid --endpoints-configmap %q: expected namespace/name", webhookEndpoints)
+	}
+	return types.NamespacedName{Namespace: namespace, Name: name}, nil
+}
+
+// defaultEndpointsConfigMap is shared by the webhook command keeping the
+// endpoints and the monitor command publishing them.
+const defaultEndpointsConfigMap = "vsphere-infra-helpers/ptr-record-operator-endpoints"
+
+func init() {
+	rootCmd.AddCommand(webhookCmd)
+	webhookCmd.Flags().StringVar(&webhookAddress, "address", controller.DefaultWebhookAddress, "address the webhook provider listens on; external-dns expects localhost:8888")
+	webhookCmd.Flags().StringSliceVar(&webhookDomains, "domain-filter", nil, "domain external-dns may publish names in, returned to it on negotiation; may be repeated, and defaults to any")
+	webhookCmd.Flags().StringVar(&webhookEndpoints, "endpoints-configmap", defaultEndpointsConfigMap, "ConfigMap, as namespace/name, keeping the endpoints for the external-dns source of the monitor command")
+}
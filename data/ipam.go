@@ -0,0 +1,225 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// importedSubnet collects an entry while an IPAM export is imported.
+type importedSubnet struct {
+	subnet Subnet
+	errs   []error
+}
+
+// importer builds Subnets out of the prefixes and addresses of an IPAM export.
+type importer struct {
+	entries map[string]map[string]*importedSubnet
+	errs    SubnetErrors
+	// prefixes are the imported prefixes, to find the entry of an address.
+	prefixes []importedPrefix
+}
+
+type importedPrefix struct {
+	prefix           netip.Prefix
+	datacenter, vlan string
+}
+
+func newImporter() *importer {
+	return &importer{entries: map[string]map[string]*importedSubnet{}}
+}
+
+func (i *importer) entry(datacenter, vlan string) *importedSubnet {
+	if i.entries[datacenter] == nil {
+		i.entries[datacenter] = map[string]*importedSubnet{}
+	}
+	entry, ok := i.entries[datacenter][vlan]
+	if !ok {
+		entry = &importedSubnet{}
+		i.entries[datacenter][vlan] = entry
+	}
+	return entry
+}
+
+// addPrefix adds prefix to the entry of datacenter and vlan, as its IPv4
+// network or its IPv6 prefix. Unlike in subnets.json, IpAddresses only lists
+// the named and gateway addresses of the network, as the prefixes of an IPAM
+// can be much larger than a VLAN.
+func (i *importer) addPrefix(datacenter, vlan string, prefix netip.Prefix) {
+	entry := i.entry(datacenter, vlan)
+	prefix = prefix.Masked()
+	if prefix.Addr().Is4() {
+		if entry.subnet.Network != "" {
+			entry.errs = append(entry.errs, fmt.Errorf("prefix %s: already has IPv4 prefix %s/%d", prefix, entry.subnet.Network, entry.subnet.CIDR))
+			return
+		}
+		entry.subnet.Network = prefix.Addr().String()
+		entry.subnet.CIDR = int64(prefix.Bits())
+		entry.subnet.Mask = prefixMask(prefix)
+	} else {
+		if entry.subnet.Ipv6prefix != "" {
+			entry.errs = append(entry.errs, fmt.Errorf("prefix %s: already has IPv6 prefix %s", prefix, entry.subnet.Ipv6prefix))
+			return
+		}
+		entry.subnet.Ipv6prefix = prefix.String()
+		entry.subnet.CidrIPv6 = int64(prefix.Bits())
+	}
+	i.prefixes = append(i.prefixes, importedPrefix{prefix: prefix, datacenter: datacenter, vlan: vlan})
+}
+
+// addAddress names addr in the entry of the longest imported prefix holding
+// it, and makes it the gateway of the entry if gateway is true. Addresses
+// outside every imported prefix are ignored.
+func (i *importer) addAddress(addr netip.Addr, hostname string, gateway bool) {
+	addr = addr.Unmap()
+	best := -1
+	for j, p := range i.prefixes {
+		if p.prefix.Contains(addr) && (best < 0 || p.prefix.Bits() > i.prefixes[best].prefix.Bits()) {
+			best = j
+		}
+	}
+	if best < 0 {
+		return
+	}
+	entry := i.entry(i.prefixes[best].datacenter, i.prefixes[best].vlan)
+	if hostname != "" {
+		if entry.subnet.Hostnames == nil {
+			entry.subnet.Hostnames = map[string]string{}
+		}
+		entry.subnet.Hostnames[addr.String()] = hostname
+	}
+	if gateway && addr.Is4() {
+		entry.subnet.Gateway = addr.String()
+	}
+	if addr.Is4() && (hostname != "" || gateway) && !slices.Contains(entry.subnet.IpAddresses, addr.String()) {
+		entry.subnet.IpAddresses = append(entry.subnet.IpAddresses, addr.String())
+	}
+}
+
+// fail reports an error against an entry, which is left out of the result,
+// or against an address, which is ignored.
+func (i *importer) fail(datacenter, vlan string, err error) {
+	i.errs = append(i.errs, &SubnetError{Datacenter: datacenter, Vlan: vlan, Err: err})
+}
+
+// subnets validates every entry as ParseSubnets does. Entries with an IPv6
+// prefix but no IPv4 prefix are refused, as a subnets.json entry is an IPv4
+// network first.
+func (i *importer) subnets() (Subnets, error) {
+	subnets := Subnets{}
+	errs := i.errs
+	for datacenter, vlans := range i.entries {
+		for vlan, entry := range vlans {
+			problems := entry.errs
+			if len(problems) == 0 && entry.subnet.Network == "" {
+				problems = []error{fmt.Errorf("IPv6 prefix %s has no IPv4 prefix in the same VLAN", entry.subnet.Ipv6prefix)}
+			}
+			if len(problems) == 0 {
+				problems = entry.subnet.Validate()
+			}
+			if len(problems) > 0 {
+				for _, problem := range problems {
+					errs = append(errs, &SubnetError{Datacenter: datacenter, Vlan: vlan, Err: problem})
+				}
+				continue
+			}
+			if subnets[datacenter] == nil {
+				subnets[datacenter] = map[string]Subnet{}
+			}
+			subnets[datacenter][vlan] = entry.subnet
+		}
+	}
+	if len(errs) > 0 {
+		sort.SliceStable(errs, func(i, j int) bool {
+			return errs[i].Path() < errs[j].Path()
+		})
+		return subnets, errs
+	}
+	return subnets, nil
+}
+
+// prefixMask returns the dotted-quad netmask of an IPv4 prefix.
+func prefixMask(prefix netip.Prefix) string {
+	mask := ^uint32(0) << (32 - prefix.Bits())
+	if prefix.Bits() == 0 {
+		mask = 0
+	}
+	return netip.AddrFrom4([4]byte{byte(mask >> 24), byte(mask >> 16), byte(mask >> 8), byte(mask)}).String()
+}
+
+// flexString decodes a JSON string or number, as IPAMs are inconsistent in
+// how they encode identifiers.
+type flexString string
+
+func (s *flexString) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*s = ""
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(b, &str); err == nil {
+		*s = flexString(str)
+		return nil
+	}
+	var number json.Number
+	if err := json.Unmarshal(b, &number); err != nil {
+		return fmt.Errorf("expected a string or a number, got %s", b)
+	}
+	*s = flexString(number.String())
+	return nil
+}
+
+// flexBool decodes a JSON boolean, or a string or number such as "1".
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	var s flexString
+	if err := s.UnmarshalJSON(data); err == nil {
+		value := strings.ToLower(string(s))
+		*b = flexBool(value != "" && value != "0" && value != "false")
+		return nil
+	}
+	var value bool
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("expected a boolean, got %s", data)
+	}
+	*b = flexBool(value)
+	return nil
+}
+
+// decodeList decodes a list of objects, either bare or wrapped in an API
+// response under key.
+func decodeList[T any](raw json.RawMessage, key string) ([]T, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var items []T
+	if err := json.Unmarshal(raw, &items); err == nil {
+		return items, nil
+	}
+	var response map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &response); err != nil {
+		return nil, err
+	}
+	wrapped, ok := response[key]
+	if !ok {
+		return nil, fmt.Errorf("expected a list or an API response with %q", key)
+	}
+	if err := json.Unmarshal(wrapped, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// parseVlan returns the VLAN ID of an IPAM VLAN number.
+func parseVlan(number string) (string, error) {
+	vid, err := strconv.ParseUint(number, 10, 16)
+	if err != nil || vid == 0 || vid > 4094 {
+		return "", fmt.Errorf("invalid VLAN %q", number)
+	}
+	return strconv.FormatUint(vid, 10), nil
+}
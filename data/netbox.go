@@ -0,0 +1,104 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+)
+
+// NetBoxExport is a NetBox export, holding the output of the ipam/prefixes
+// and ipam/ip-addresses endpoints. Each may be the bare list of objects or
+// the API response, with the objects under "results".
+type NetBoxExport struct {
+	Prefixes    json.RawMessage `json:"prefixes"`
+	IPAddresses json.RawMessage `json:"ip_addresses"`
+}
+
+type netBoxRef struct {
+	Slug string     `json:"slug"`
+	Name string     `json:"name"`
+	Vid  flexString `json:"vid"`
+}
+
+type netBoxPrefix struct {
+	Prefix string     `json:"prefix"`
+	Site   *netBoxRef `json:"site"`
+	// Scope replaces Site as of NetBox 4.2.
+	Scope *netBoxRef `json:"scope"`
+	Vlan  *netBoxRef `json:"vlan"`
+}
+
+type netBoxAddress struct {
+	Address string      `json:"address"`
+	DnsName string      `json:"dns_name"`
+	Tags    []netBoxRef `json:"tags"`
+}
+
+// NetBoxGatewayTag is the slug of the NetBox tag marking the gateway of a
+// prefix.
+const NetBoxGatewayTag = "gateway"
+
+// ParseNetBox imports a NetBox export as subnets.json entries. Each prefix is
+// an entry of the datacenter named by the slug of its site, or of its scope,
+// and of its VLAN ID; an entry takes one IPv4 and one IPv6 prefix. The
+// dns_name of each IP address names the address in the entry of its longest
+// prefix, and the address tagged NetBoxGatewayTag is the gateway. Prefixes
+// without a site or VLAN, addresses which fail to parse, and entries which
+// fail to validate, are reported as SubnetErrors alongside the valid entries,
+// as by ParseSubnets.
+func ParseNetBox(content []byte) (Subnets, error) {
+	var export NetBoxExport
+	if err := json.Unmarshal(content, &export); err != nil {
+		return nil, fmt.Errorf("unable to decode NetBox export: %w", err)
+	}
+	prefixes, err := decodeList[netBoxPrefix](export.Prefixes, "results")
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode NetBox prefixes: %w", err)
+	}
+	addresses, err := decodeList[netBoxAddress](export.IPAddresses, "results")
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode NetBox IP addresses: %w", err)
+	}
+
+	imp := newImporter()
+	for _, p := range prefixes {
+		datacenter := ""
+		if p.Site != nil {
+			datacenter = p.Site.Slug
+		} else if p.Scope != nil {
+			datacenter = p.Scope.Slug
+		}
+		vlan := ""
+		if p.Vlan != nil {
+			vlan = string(p.Vlan.Vid)
+		}
+		if datacenter == "" || vlan == "" {
+			imp.fail(p.Prefix, "*", fmt.Errorf("prefix has no site or VLAN"))
+			continue
+		}
+		if vlan, err = parseVlan(vlan); err != nil {
+			imp.fail(datacenter, string(p.Vlan.Vid), err)
+			continue
+		}
+		prefix, err := netip.ParsePrefix(p.Prefix)
+		if err != nil {
+			imp.fail(datacenter, vlan, err)
+			continue
+		}
+		imp.addPrefix(datacenter, vlan, prefix)
+	}
+	for _, a := range addresses {
+		// NetBox addresses carry the length of their prefix
+		prefix, err := netip.ParsePrefix(a.Address)
+		if err != nil {
+			imp.fail(a.Address, "*", err)
+			continue
+		}
+		gateway := false
+		for _, tag := range a.Tags {
+			gateway = gateway || tag.Slug == NetBoxGatewayTag
+		}
+		imp.addAddress(prefix.Addr(), a.DnsName, gateway)
+	}
+	return imp.subnets()
+}
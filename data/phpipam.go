@@ -0,0 +1,121 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+)
+
+// PHPIPAMExport is a phpIPAM export, holding the output of the sections,
+// subnets, addresses and vlans controllers of its API. Each may be the bare
+// list of objects or the API response, with the objects under "data".
+// Sections and vlans are optional.
+type PHPIPAMExport struct {
+	Sections  json.RawMessage `json:"sections"`
+	Subnets   json.RawMessage `json:"subnets"`
+	Addresses json.RawMessage `json:"addresses"`
+	Vlans     json.RawMessage `json:"vlans"`
+}
+
+type phpIPAMSection struct {
+	ID   flexString `json:"id"`
+	Name string     `json:"name"`
+}
+
+type phpIPAMSubnet struct {
+	ID        flexString `json:"id"`
+	Subnet    string     `json:"subnet"`
+	Mask      flexString `json:"mask"`
+	SectionID flexString `json:"sectionId"`
+	VlanID    flexString `json:"vlanId"`
+	IsFolder  flexBool   `json:"isFolder"`
+}
+
+type phpIPAMAddress struct {
+	IP        string   `json:"ip"`
+	Hostname  string   `json:"hostname"`
+	IsGateway flexBool `json:"is_gateway"`
+}
+
+type phpIPAMVlan struct {
+	VlanID flexString `json:"vlanId"`
+	Number flexString `json:"number"`
+}
+
+// ParsePHPIPAM imports a phpIPAM export as subnets.json entries. Each subnet
+// is an entry of the datacenter named after its section, or its section ID
+// without sections, and of the number of its VLAN; an entry takes one IPv4
+// and one IPv6 subnet. The hostname of each address names it, and the
+// address flagged as gateway is the gateway. Subnets without a VLAN,
+// addresses which fail to parse, and entries which fail to validate, are
+// reported as SubnetErrors alongside the valid entries, as by ParseSubnets.
+func ParsePHPIPAM(content []byte) (Subnets, error) {
+	var export PHPIPAMExport
+	if err := json.Unmarshal(content, &export); err != nil {
+		return nil, fmt.Errorf("unable to decode phpIPAM export: %w", err)
+	}
+	sections, err := decodeList[phpIPAMSection](export.Sections, "data")
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode phpIPAM sections: %w", err)
+	}
+	subnets, err := decodeList[phpIPAMSubnet](export.Subnets, "data")
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode phpIPAM subnets: %w", err)
+	}
+	addresses, err := decodeList[phpIPAMAddress](export.Addresses, "data")
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode phpIPAM addresses: %w", err)
+	}
+	vlans, err := decodeList[phpIPAMVlan](export.Vlans, "data")
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode phpIPAM vlans: %w", err)
+	}
+
+	sectionNames := map[flexString]string{}
+	for _, section := range sections {
+		sectionNames[section.ID] = section.Name
+	}
+	vlanNumbers := map[flexString]string{}
+	for _, vlan := range vlans {
+		vlanNumbers[vlan.VlanID] = string(vlan.Number)
+	}
+
+	imp := newImporter()
+	for _, s := range subnets {
+		if s.IsFolder {
+			continue
+		}
+		datacenter, ok := sectionNames[s.SectionID]
+		if !ok {
+			datacenter = string(s.SectionID)
+		}
+		number, ok := vlanNumbers[s.VlanID]
+		if !ok && len(vlans) == 0 {
+			number = string(s.VlanID)
+		}
+		if s.VlanID == "" || s.VlanID == "0" || number == "" {
+			imp.fail(datacenter, "*", fmt.Errorf("subnet %s/%s has no VLAN", s.Subnet, s.Mask))
+			continue
+		}
+		vlan, err := parseVlan(number)
+		if err != nil {
+			imp.fail(datacenter, number, err)
+			continue
+		}
+		prefix, err := netip.ParsePrefix(fmt.Sprintf("%s/%s", s.Subnet, s.Mask))
+		if err != nil {
+			imp.fail(datacenter, vlan, err)
+			continue
+		}
+		imp.addPrefix(datacenter, vlan, prefix)
+	}
+	for _, a := range addresses {
+		addr, err := netip.ParseAddr(a.IP)
+		if err != nil {
+			imp.fail(a.IP, "*", err)
+			continue
+		}
+		imp.addAddress(addr, a.Hostname, bool(a.IsGateway))
+	}
+	return imp.subnets()
+}
@@ -0,0 +1,259 @@
+package data
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// SubnetsSchemaVersion is the current version of the subnets.json schema.
+//
+// Version 1 is the legacy, unversioned document: datacenters at the top level
+// and field names matched regardless of case. Version 2 wraps the
+// datacenters as {"version": 2, "subnets": {...}} and requires the field
+// names of the schema. Version 1 entries may be wrapped the same way, as
+// {"version": 1, "subnets": {...}}, and are migrated as if unversioned.
+const SubnetsSchemaVersion = 2
+
+// SubnetsSchema is the JSON Schema of the current version of subnets.json.
+//
+//go:embed subnets.schema.json
+var SubnetsSchema []byte
+
+// SubnetsDocument is the current shape of subnets.json.
+type SubnetsDocument struct {
+	// Schema optionally points at SubnetsSchema.
+	Schema string `json:"$schema,omitempty"`
+	// Version is the schema version the document was written in. Decoded
+	// documents are migrated to the current version whatever their Version.
+	Version int     `json:"version"`
+	Subnets Subnets `json:"subnets"`
+	// Unknown lists the fields of the document which are not part of the
+	// schema, and were ignored.
+	Unknown UnknownFields `json:"-"`
+}
+
+// UnknownField is a field of an entry which is not part of the schema.
+type UnknownField struct {
+	Datacenter string
+	Vlan       string
+	Field      string
+}
+
+func (f UnknownField) String() string {
+	return fmt.Sprintf("%s/%s: %s", f.Datacenter, f.Vlan, f.Field)
+}
+
+// UnknownFields reports the fields ignored while decoding subnets.json.
+type UnknownFields []UnknownField
+
+func (u UnknownFields) Error() string {
+	fields := make([]string, 0, len(u))
+	for _, field := range u {
+		fields = append(fields, field.String())
+	}
+	return fmt.Sprintf("%d unknown subnet fields: %s", len(u), strings.Join(fields, "; "))
+}
+
+// subnetFields are the JSON names of the fields of Subnet.
+var subnetFields = func() map[string]bool {
+	fields := map[string]bool{}
+	t := reflect.TypeOf(Subnet{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		fields[name] = true
+	}
+	return fields
+}()
+
+// canonicalField returns the name of the schema field matching name. Legacy
+// documents match field names regardless of case.
+func canonicalField(name string, version int) (string, bool) {
+	if subnetFields[name] {
+		return name, true
+	}
+	if version > 1 {
+		return "", false
+	}
+	for field := range subnetFields {
+		if strings.EqualFold(field, name) {
+			return field, true
+		}
+	}
+	return "", false
+}
+
+// DecodeSubnets decodes subnets.json in any schema version, migrates it to
+// the current version and validates it. Entries which fail to decode or
+// validate are left out of the result and returned as SubnetErrors alongside
+// the valid entries. Any other error means the document itself is unusable.
+// Fields which are not part of the schema are ignored and listed in Unknown.
+func DecodeSubnets(content []byte) (SubnetsDocument, error) {
+	doc, errs, err := decodeSubnets(content)
+	if err != nil {
+		return doc, err
+	}
+	for datacenter, vlans := range doc.Subnets {
+		for vlan, subnet := range vlans {
+			if problems := subnet.Validate(); len(problems) > 0 {
+				for _, problem := range problems {
+					errs = append(errs, &SubnetError{Datacenter: datacenter, Vlan: vlan, Err: problem})
+				}
+				delete(vlans, vlan)
+			}
+		}
+		if len(vlans) == 0 {
+			delete(doc.Subnets, datacenter)
+		}
+	}
+	if len(errs) > 0 {
+		sort.SliceStable(errs, func(i, j int) bool {
+			return errs[i].Path() < errs[j].Path()
+		})
+		return doc, errs
+	}
+	return doc, nil
+}
+
+// MigrateSubnets rewrites subnets.json in the current schema version. Entries
+// are migrated whether or not they are valid, but the document must decode
+// without errors, and fields which are not part of the schema are dropped.
+func MigrateSubnets(content []byte) ([]byte, error) {
+	doc, errs, err := decodeSubnets(content)
+	if err == nil && len(errs) > 0 {
+		err = errs
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc.Version = SubnetsSchemaVersion
+	return json.MarshalIndent(doc, "", "    ")
+}
+
+// decodeSubnets decodes and migrates subnets.json without validating it.
+func decodeSubnets(content []byte) (SubnetsDocument, SubnetErrors, error) {
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(content, &top); err != nil {
+		return SubnetsDocument{}, nil, fmt.Errorf("unable to decode subnets: %w", err)
+	}
+
+	version := 1
+	datacenters := top
+	doc := SubnetsDocument{Subnets: Subnets{}}
+	if raw, ok := top["version"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return SubnetsDocument{}, nil, fmt.Errorf("version: %w", err)
+		}
+		if version < 1 || version > SubnetsSchemaVersion {
+			return SubnetsDocument{}, nil, fmt.Errorf("unsupported subnets.json version %d; this build supports 1 to %d", version, SubnetsSchemaVersion)
+		}
+		if raw, ok := top["$schema"]; ok {
+			if err := json.Unmarshal(raw, &doc.Schema); err != nil {
+				return SubnetsDocument{}, nil, fmt.Errorf("$schema: %w", err)
+			}
+		}
+		datacenters = nil
+		if err := json.Unmarshal(top["subnets"], &datacenters); err != nil {
+			return SubnetsDocument{}, nil, fmt.Errorf("subnets: %w", err)
+		}
+		for key := range top {
+			if key != "version" && key != "$schema" && key != "subnets" {
+				doc.Unknown = append(doc.Unknown, UnknownField{Datacenter: "*", Vlan: "*", Field: key})
+			}
+		}
+	}
+
+	doc.Version = version
+	var errs SubnetErrors
+	for datacenter, raw := range datacenters {
+		var vlans map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &vlans); err != nil {
+			errs = append(errs, &SubnetError{Datacenter: datacenter, Vlan: "*", Err: err})
+			continue
+		}
+		for vlan, raw := range vlans {
+			subnet, unknown, err := decodeSubnet(raw, version)
+			for _, field := range unknown {
+				doc.Unknown = append(doc.Unknown, UnknownField{Datacenter: datacenter, Vlan: vlan, Field: field})
+			}
+			if err != nil {
+				errs = append(errs, &SubnetError{Datacenter: datacenter, Vlan: vlan, Err: err})
+				continue
+			}
+			if doc.Subnets[datacenter] == nil {
+				doc.Subnets[datacenter] = map[string]Subnet{}
+			}
+			doc.Subnets[datacenter][vlan] = subnet
+		}
+	}
+	sort.SliceStable(doc.Unknown, func(i, j int) bool {
+		return doc.Unknown[i].String() < doc.Unknown[j].String()
+	})
+	return doc, errs, nil
+}
+
+// decodeSubnet decodes a single entry written in version, and migrates it to
+// the current version. It returns the fields which are not part of the
+// schema.
+func decodeSubnet(raw json.RawMessage, version int) (Subnet, []string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return Subnet{}, nil, err
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonical := map[string]json.RawMessage{}
+	spelling := map[string]string{}
+	var unknown []string
+	for _, name := range names {
+		field, ok := canonicalField(name, version)
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		if other, ok := spelling[field]; ok {
+			return Subnet{}, unknown, fmt.Errorf("%s is set as both %s and %s", field, other, name)
+		}
+		spelling[field] = name
+		canonical[field] = fields[name]
+	}
+	content, err := json.Marshal(canonical)
+	if err != nil {
+		return Subnet{}, unknown, err
+	}
+	var subnet Subnet
+	if err := json.Unmarshal(content, &subnet); err != nil {
+		return Subnet{}, unknown, err
+	}
+	if version == 1 {
+		subnet.migrateLegacy()
+	}
+	return subnet, unknown, nil
+}
+
+// migrateLegacy fills the IPv4 network of legacy entries which only give
+// machineNetworkCidr.
+func (s *Subnet) migrateLegacy() {
+	if s.Network != "" || s.MachineNetworkCidr == "" {
+		return
+	}
+	prefix, err := netip.ParsePrefix(s.MachineNetworkCidr)
+	if err != nil || !prefix.Addr().Is4() {
+		// reported by Validate
+		return
+	}
+	prefix = prefix.Masked()
+	s.Network = prefix.Addr().String()
+	s.CIDR = int64(prefix.Bits())
+	if s.Mask == "" {
+		s.Mask = prefixMask(prefix)
+	}
+}
@@ -1,5 +1,12 @@
 package data
 
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
 type Subnet struct {
 	CIDR             int64    `json:"cidr"`
 	CidrIPv6         int64    `json:"cidrIPv6"`
@@ -7,7 +14,7 @@ type Subnet struct {
 	Gateway          string   `json:"gateway"`
 	Mask             string   `json:"mask"`
 	Network          string   `json:"network"`
-	IpAddresses      []string `json:"ipAddresses"`
+	IpAddresses      []string `json:"ipAddresses,omitempty"`
 	Virtualcenter    string   `json:"virtualcenter"`
 	Ipv6prefix       string   `json:"ipv6prefix"`
 	StartIPv6Address string   `json:"startIPv6Address"`
@@ -17,4 +24,264 @@ type Subnet struct {
 	VifIPv6Address   string   `json:"vifIPv6Address"`
 	DhcpEndLocation  int      `json:"dhcpEndLocation"`
 	Priority         int      `json:"priority"`
+	// MachineNetworkCidr is the IPv4 network of the subnet in CIDR notation,
+	// which must agree with Network and CIDR.
+	MachineNetworkCidr string `json:"machineNetworkCidr"`
+	GatewayIPv6        string `json:"gatewayipv6"`
+	// Hostnames names addresses of the subnet, keyed by address, in place of
+	// the name template. They are set by IPAM imports.
+	Hostnames map[string]string `json:"hostnames,omitempty"`
+}
+
+// Subnets is the content of subnets.json, keyed by datacenter and then by VLAN.
+type Subnets map[string]map[string]Subnet
+
+// SubnetError reports a problem with a single datacenter/VLAN entry.
+type SubnetError struct {
+	Datacenter string
+	Vlan       string
+	Err        error
+}
+
+func (e *SubnetError) Path() string {
+	return fmt.Sprintf("%s/%s", e.Datacenter, e.Vlan)
+}
+
+func (e *SubnetError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path(), e.Err)
+}
+
+func (e *SubnetError) Unwrap() error {
+	return e.Err
+}
+
+// SubnetErrors collects every problem found while parsing subnets.json.
+type SubnetErrors []*SubnetError
+
+func (e SubnetErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%d invalid subnet entries: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// ParseSubnets decodes, migrates and validates subnets.json, as
+// DecodeSubnets, leaving out the fields it does not know.
+func ParseSubnets(content []byte) (Subnets, error) {
+	doc, err := DecodeSubnets(content)
+	return doc.Subnets, err
+}
+
+// Walk calls fn for every entry, ordered by datacenter and then by VLAN.
+func (s Subnets) Walk(fn func(datacenter, vlan string, subnet Subnet)) {
+	for _, datacenter := range sortedKeys(s) {
+		vlans := s[datacenter]
+		for _, vlan := range sortedKeys(vlans) {
+			fn(datacenter, vlan, vlans[vlan])
+		}
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Prefix returns the IPv4 network described by Network and CIDR.
+func (s Subnet) Prefix() (netip.Prefix, error) {
+	network, err := netip.ParseAddr(s.Network)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("network: %w", err)
+	}
+	if !network.Is4() {
+		return netip.Prefix{}, fmt.Errorf("network: %s is not an IPv4 address", s.Network)
+	}
+	if s.CIDR < 0 || s.CIDR > 32 {
+		return netip.Prefix{}, fmt.Errorf("cidr: %d is not a valid IPv4 prefix length", s.CIDR)
+	}
+	return netip.PrefixFrom(network, int(s.CIDR)), nil
+}
+
+// Validate checks that the IPv4 fields of the subnet are consistent with each
+// other, that the IPv6 range lies within ipv6prefix, and returns every problem
+// found.
+func (s Subnet) Validate() []error {
+	prefix, err := s.Prefix()
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	if s.Mask != "" {
+		if bits, err := maskBits(s.Mask); err != nil {
+			errs = append(errs, fmt.Errorf("mask: %w", err))
+		} else if bits != prefix.Bits() {
+			errs = append(errs, fmt.Errorf("mask: %s is a /%d but cidr is %d", s.Mask, bits, s.CIDR))
+		}
+	}
+	if masked := prefix.Masked(); masked.Addr() != prefix.Addr() {
+		errs = append(errs, fmt.Errorf("network: %s is not the network address of %s", s.Network, masked))
+	}
+	prefix = prefix.Masked()
+
+	for i, ip := range s.IpAddresses {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("ipAddresses[%d]: %w", i, err))
+			continue
+		}
+		if !prefix.Contains(addr) {
+			errs = append(errs, fmt.Errorf("ipAddresses[%d]: %s is outside %s", i, ip, prefix))
+		}
+	}
+
+	if s.MachineNetworkCidr != "" {
+		if machineNetwork, err := netip.ParsePrefix(s.MachineNetworkCidr); err != nil {
+			errs = append(errs, fmt.Errorf("machineNetworkCidr: %w", err))
+		} else if machineNetwork.Masked() != prefix {
+			errs = append(errs, fmt.Errorf("machineNetworkCidr: %s is not %s", s.MachineNetworkCidr, prefix))
+		}
+	}
+
+	if _, _, _, err := s.IPv6Range(); err != nil {
+		errs = append(errs, err)
+	}
+	if s.GatewayIPv6 != "" {
+		if gateway, err := parseIPv6("gatewayipv6", s.GatewayIPv6); err != nil {
+			errs = append(errs, err)
+		} else if prefix6, err := netip.ParsePrefix(s.Ipv6prefix); err == nil && !prefix6.Contains(gateway) {
+			errs = append(errs, fmt.Errorf("gatewayipv6: %s is outside %s", s.GatewayIPv6, prefix6.Masked()))
+		}
+	}
+	for _, ip := range sortedKeys(s.Hostnames) {
+		if _, err := s.hostnameAddr(prefix, ip); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// hostnameAddr parses an address of Hostnames, which must be within the
+// IPv4 network or ipv6prefix of the subnet.
+func (s Subnet) hostnameAddr(prefix netip.Prefix, ip string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("hostnames: %w", err)
+	}
+	if addr.Is4() && !prefix.Contains(addr) {
+		return netip.Addr{}, fmt.Errorf("hostnames: %s is outside %s", ip, prefix)
+	}
+	if addr.Is6() && s.Ipv6prefix != "" {
+		if prefix6, err := netip.ParsePrefix(s.Ipv6prefix); err == nil && !prefix6.Contains(addr) {
+			return netip.Addr{}, fmt.Errorf("hostnames: %s is outside %s", ip, prefix6.Masked())
+		}
+	}
+	return addr, nil
+}
+
+// HostnameAddrs returns the addresses of Hostnames in order. The subnet must
+// have been validated.
+func (s Subnet) HostnameAddrs() []netip.Addr {
+	addrs := make([]netip.Addr, 0, len(s.Hostnames))
+	for ip := range s.Hostnames {
+		addrs = append(addrs, netip.MustParseAddr(ip))
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i].Less(addrs[j])
+	})
+	return addrs
+}
+
+// IPv6Range returns the StartIPv6Address and StopIPv6Address of the subnet.
+// ok is false when the subnet has no IPv6 range configured.
+func (s Subnet) IPv6Range() (start, stop netip.Addr, ok bool, err error) {
+	if s.StartIPv6Address == "" && s.StopIPv6Address == "" {
+		return netip.Addr{}, netip.Addr{}, false, nil
+	}
+	if start, err = parseIPv6("startIPv6Address", s.StartIPv6Address); err != nil {
+		return netip.Addr{}, netip.Addr{}, false, err
+	}
+	if stop, err = parseIPv6("stopIPv6Address", s.StopIPv6Address); err != nil {
+		return netip.Addr{}, netip.Addr{}, false, err
+	}
+	if stop.Less(start) {
+		return netip.Addr{}, netip.Addr{}, false, fmt.Errorf("stopIPv6Address: %s is before %s", stop, start)
+	}
+	if s.Ipv6prefix != "" {
+		prefix, err := netip.ParsePrefix(s.Ipv6prefix)
+		if err != nil || !prefix.Addr().Is6() {
+			return netip.Addr{}, netip.Addr{}, false, fmt.Errorf("ipv6prefix: %s is not an IPv6 prefix", s.Ipv6prefix)
+		}
+		if !prefix.Contains(start) || !prefix.Contains(stop) {
+			return netip.Addr{}, netip.Addr{}, false, fmt.Errorf("ipv6 range %s-%s is outside %s", start, stop, prefix.Masked())
+		}
+	}
+	return start, stop, true, nil
+}
+
+// DhcpRange returns the first and last address of the DHCP pool. The pool ends
+// at IpAddresses[DhcpEndLocation] and starts at the address following the
+// gateway, or at the first host address when the gateway is not in
+// IpAddresses. ok is false when the subnet has no DHCP pool.
+func (s Subnet) DhcpRange() (start, end netip.Addr, ok bool) {
+	if s.DhcpEndLocation <= 0 || s.DhcpEndLocation >= len(s.IpAddresses) {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+	first := 1
+	for i, ip := range s.IpAddresses[:s.DhcpEndLocation] {
+		if ip == s.Gateway {
+			first = i + 1
+			break
+		}
+	}
+	if first > s.DhcpEndLocation {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+	start, err := netip.ParseAddr(s.IpAddresses[first])
+	if err != nil {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+	end, err = netip.ParseAddr(s.IpAddresses[s.DhcpEndLocation])
+	if err != nil || end.Less(start) {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+	return start, end, true
+}
+
+func parseIPv6(field, value string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("%s: %w", field, err)
+	}
+	if !addr.Is6() || addr.Is4In6() {
+		return netip.Addr{}, fmt.Errorf("%s: %s is not an IPv6 address", field, value)
+	}
+	return addr, nil
+}
+
+// maskBits returns the prefix length of a dotted-quad netmask.
+func maskBits(mask string) (int, error) {
+	addr, err := netip.ParseAddr(mask)
+	if err != nil {
+		return 0, err
+	}
+	if !addr.Is4() {
+		return 0, fmt.Errorf("%s is not an IPv4 netmask", mask)
+	}
+	b := addr.As4()
+	value := uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	bits := 0
+	for value&(1<<31) != 0 {
+		bits++
+		value <<= 1
+	}
+	if value != 0 {
+		return 0, fmt.Errorf("%s is not a contiguous netmask", mask)
+	}
+	return bits, nil
 }
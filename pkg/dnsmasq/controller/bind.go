@@ -0,0 +1,334 @@
+package controller
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+)
+
+const (
+	// DefaultBindZoneDir is the directory BIND zone files are extracted to on
+	// the server.
+	DefaultBindZoneDir = "/var/named/ci-dns"
+	// bindIncludeFile declares every zone, for named.conf to include.
+	bindIncludeFile = "zones.conf"
+)
+
+// BindOptions controls the zones written by the BIND renderer.
+type BindOptions struct {
+	// ZoneDir is where the zone files are extracted on the server, and is
+	// referred to by the zone statements of zones.conf.
+	ZoneDir string
+	// IPv4Bits and IPv6Bits are the prefix lengths of the reverse zones,
+	// multiples of 8 and 4 respectively. Classless child zones are written
+	// in addition to them.
+	IPv4Bits int
+	IPv6Bits int
+	TTL      time.Duration
+	// PrimaryNS and Hostmaster are the MNAME and RNAME of the SOA records.
+	PrimaryNS  string
+	Hostmaster string
+	// NameServers are the NS records of each zone, PrimaryNS when empty.
+	NameServers []string
+	Refresh     time.Duration
+	Retry       time.Duration
+	Expire      time.Duration
+	Minimum     time.Duration
+	// Serials tracks the serial of each zone. Each renderer keeps its own
+	// when nil.
+	Serials *SerialState
+}
+
+// DefaultBindOptions returns the defaults of every option.
+func DefaultBindOptions() BindOptions {
+	return BindOptions{
+		ZoneDir:    DefaultBindZoneDir,
+		IPv4Bits:   24,
+		IPv6Bits:   64,
+		TTL:        time.Hour,
+		PrimaryNS:  "localhost.",
+		Hostmaster: "hostmaster.localhost.",
+		Refresh:    time.Hour,
+		Retry:      15 * time.Minute,
+		Expire:     7 * 24 * time.Hour,
+		Minimum:    5 * time.Minute,
+	}
+}
+
+// Validate checks the zone boundaries and names of the options.
+func (o BindOptions) Validate() error {
+	if err := validateZoneBits(o.IPv4Bits, o.IPv6Bits); err != nil {
+		return err
+	}
+	for _, name := range append([]string{o.PrimaryNS, o.Hostmaster}, o.NameServers...) {
+		if err := ValidateHostname(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateZoneBits checks that reverse zones of the prefix lengths fall on
+// label boundaries.
+func validateZoneBits(ipv4Bits, ipv6Bits int) error {
+	if ipv4Bits <= 0 || ipv4Bits > 24 || ipv4Bits%8 != 0 {
+		return fmt.Errorf("IPv4 reverse zones must be /8, /16 or /24, not /%d", ipv4Bits)
+	}
+	if ipv6Bits <= 0 || ipv6Bits > 124 || ipv6Bits%4 != 0 {
+		return fmt.Errorf("IPv6 reverse zones must be on a nibble boundary, not /%d", ipv6Bits)
+	}
+	return nil
+}
+
+// bindRenderer writes a tar archive of one RFC 1035 zone file per reverse
+// zone, named <zone>.zone, along with zones.conf, which declares them.
+// Forward records and the dnsmasq configuration are not rendered, except for
+// synth-domains, which become $GENERATE directives.
+//
+// Zones are built in memory, as the records of a parent zone and of its
+// classless child zones are interleaved in address order.
+type bindRenderer struct {
+	opts BindOptions
+}
+
+func newBindRenderer(opts BindOptions) *bindRenderer {
+	if opts.Serials == nil {
+		opts.Serials = &SerialState{}
+	}
+	return &bindRenderer{opts: opts}
+}
+
+func (r *bindRenderer) Format() OutputFormat {
+	return OutputBind
+}
+
+// defaultPath and reloadCommand make targets extract the archive into
+// ZoneDir and reload BIND.
+func (r *bindRenderer) defaultPath() string {
+	return r.opts.ZoneDir + ".tar"
+}
+
+func (r *bindRenderer) reloadCommand(path string) string {
+	return fmt.Sprintf("sudo mkdir -p %[1]s && sudo tar -xf %[2]s -C %[1]s && sudo rndc reload", r.opts.ZoneDir, path)
+}
+
+// bindZone is a reverse zone being built.
+type bindZone struct {
+	origin string
+	// children are the classless child zones delegated from the zone,
+	// relative to its origin.
+	children []string
+	body     bytes.Buffer
+}
+
+func (z *bindZone) addChild(child string) {
+	for _, existing := range z.children {
+		if existing == child {
+			return
+		}
+	}
+	z.children = append(z.children, child)
+}
+
+func (r *bindRenderer) Render(w io.Writer, in RenderInput) error {
+	zones, err := r.zones(in)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	var include bytes.Buffer
+	if err := writeHeader(&include, OutputBind, "//"); err != nil {
+		return err
+	}
+	for _, zone := range zones {
+		serial := r.opts.Serials.serial(zone.origin, r.digest(zone))
+		var content bytes.Buffer
+		if err := r.writeZone(&content, zone, serial); err != nil {
+			return err
+		}
+		file := strings.TrimSuffix(zone.origin, ".") + ".zone"
+		if err := writeTarFile(tw, file, content.Bytes()); err != nil {
+			return err
+		}
+		fmt.Fprintf(&include, "zone \"%s\" IN { type master; file \"%s/%s\"; };\n", strings.TrimSuffix(zone.origin, "."), r.opts.ZoneDir, file)
+	}
+	if err := writeTarFile(tw, bindIncludeFile, include.Bytes()); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeTarFile adds a file to the archive. Its metadata is fixed so that the
+// archive only changes with its content.
+func writeTarFile(tw *tar.Writer, name string, content []byte) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o644,
+		Size:     int64(len(content)),
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatPAX,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(content)
+	return err
+}
+
+// zones sorts the records and synth-domains into reverse zones, ordered by
+// origin.
+func (r *bindRenderer) zones(in RenderInput) ([]*bindZone, error) {
+	zones := map[string]*bindZone{}
+	zone := func(origin string) *bindZone {
+		z, ok := zones[origin]
+		if !ok {
+			z = &bindZone{origin: origin}
+			zones[origin] = z
+		}
+		return z
+	}
+
+	synths := sortedSynths(in.Dnsmasq.Synths)
+	for _, synth := range synths {
+		if err := r.generate(synth, zone); err != nil {
+			return nil, err
+		}
+	}
+
+	it := in.buffered()
+	for rec, ok := it.Next(); ok; rec, ok = it.Next() {
+		if !rec.Publish.Reverse() || covered(rec, synths) {
+			continue
+		}
+		parent := zone(r.origin(rec))
+		name := fqdn(rec.Name())
+		if rec.Delegation == "" {
+			fmt.Fprintf(&parent.body, "%s\tIN\tPTR\t%s\n", relative(rec.Reverse, parent.origin), name)
+			continue
+		}
+		child := zone(rec.Delegation)
+		parent.addChild(relative(rec.Delegation, parent.origin))
+		fmt.Fprintf(&parent.body, "%s\tIN\tCNAME\t%s\n", relative(rec.Reverse, parent.origin), rec.Owner())
+		fmt.Fprintf(&child.body, "%s\tIN\tPTR\t%s\n", relative(rec.Owner(), child.origin), name)
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]*bindZone, 0, len(zones))
+	for _, z := range zones {
+		result = append(result, z)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].origin < result[j].origin
+	})
+	return result, nil
+}
+
+// origin returns the reverse zone of rec, ignoring its delegation.
+func (r *bindRenderer) origin(rec record.Record) string {
+	return reverseZone(rec, r.opts.IPv4Bits, r.opts.IPv6Bits)
+}
+
+// reverseZone returns the reverse zone of rec, of ipv4Bits or ipv6Bits
+// depending on its family, ignoring its delegation.
+func reverseZone(rec record.Record, ipv4Bits, ipv6Bits int) string {
+	labels := strings.Split(strings.TrimSuffix(rec.Reverse, "."), ".")
+	// the address labels are followed by in-addr.arpa or ip6.arpa
+	keep := ipv4Bits / 8
+	if rec.Family == record.IPv6 {
+		keep = ipv6Bits / 4
+	}
+	hostLabels := len(labels) - 2 - keep
+	return strings.Join(labels[hostLabels:], ".") + "."
+}
+
+// generate adds a $GENERATE directive for every /24 of a synth-domain,
+// naming the addresses as dnsmasq would.
+func (r *bindRenderer) generate(synth SynthDomain, zone func(string) *bindZone) error {
+	rng := record.RangeOf(synth.Prefix)
+	for block := rng.From; ; {
+		octets := block.As4()
+		last := netip.AddrFrom4([4]byte{octets[0], octets[1], octets[2], 255})
+		if rng.To.Less(last) {
+			last = rng.To
+		}
+		first, err := record.New(block, record.Source{})
+		if err != nil {
+			return err
+		}
+		// the owner is the last octet, followed by the octets between the
+		// /24 and the origin of its zone
+		z := zone(r.origin(first))
+		_, parent, _ := strings.Cut(first.Reverse, ".")
+		owner := "$"
+		if parent != z.origin {
+			owner += "." + relative(parent, z.origin)
+		}
+		fmt.Fprintf(&z.body, "$GENERATE %d-%d %s\tIN\tPTR\t%s%d-%d-%d-$.%s.\n",
+			octets[3], last.As4()[3], owner, synth.NamePrefix, octets[0], octets[1], octets[2], synth.Domain)
+		if last == rng.To {
+			return nil
+		}
+		block = last.Next()
+	}
+}
+
+// writeZone writes the zone file of z with serial.
+func (r *bindRenderer) writeZone(w io.Writer, z *bindZone, serial uint32) error {
+	if err := writeHeader(w, OutputBind, ";"); err != nil {
+		return err
+	}
+	nameServers := r.opts.NameServers
+	if len(nameServers) == 0 {
+		nameServers = []string{r.opts.PrimaryNS}
+	}
+	fmt.Fprintf(w, "$ORIGIN %s\n$TTL %d\n", z.origin, seconds(r.opts.TTL))
+	fmt.Fprintf(w, "@\tIN\tSOA\t%s %s (%d %d %d %d %d)\n", fqdn(r.opts.PrimaryNS), fqdn(r.opts.Hostmaster),
+		serial, seconds(r.opts.Refresh), seconds(r.opts.Retry), seconds(r.opts.Expire), seconds(r.opts.Minimum))
+	for _, owner := range append([]string{"@"}, z.children...) {
+		for _, ns := range nameServers {
+			fmt.Fprintf(w, "%s\tIN\tNS\t%s\n", owner, fqdn(ns))
+		}
+	}
+	_, err := w.Write(z.body.Bytes())
+	return err
+}
+
+// digest identifies the content of z, leaving out its serial.
+func (r *bindRenderer) digest(z *bindZone) string {
+	hash := sha256.New()
+	_ = r.writeZone(hash, z, 0)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func seconds(d time.Duration) int64 {
+	return int64(d / time.Second)
+}
+
+// fqdn returns name with a trailing dot, as names without one are relative
+// to the origin of a zone file.
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// relative returns name relative to origin, or @ for the origin itself.
+func relative(name, origin string) string {
+	if name == origin {
+		return "@"
+	}
+	return strings.TrimSuffix(name, "."+origin)
+}
@@ -0,0 +1,235 @@
+package controller
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// extractBind returns the files of a bind archive, concatenated in archive
+// order under a line naming each. Zone files must parse.
+func extractBind(t *testing.T, archive []byte) string {
+	var out strings.Builder
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return out.String()
+		}
+		if err != nil {
+			t.Fatalf("Error reading archive: %v", err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("Error reading %s: %v", header.Name, err)
+		}
+		if strings.HasSuffix(header.Name, ".zone") {
+			zp := dns.NewZoneParser(bytes.NewReader(content), "", header.Name)
+			for _, ok := zp.Next(); ok; _, ok = zp.Next() {
+			}
+			if err := zp.Err(); err != nil {
+				t.Errorf("Invalid zone file %s: %v", header.Name, err)
+			}
+		}
+		fmt.Fprintf(&out, "==> %s <==\n%s", header.Name, content)
+	}
+}
+
+func TestBindRenderer(t *testing.T) {
+	day := time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+	opts := DefaultRendererOptions()
+	opts.Bind.PrimaryNS = "ns1.ci.example."
+	opts.Bind.NameServers = []string{"ns1.ci.example.", "ns2.ci.example."}
+	opts.Bind.Serials = &SerialState{Now: func() time.Time { return day }}
+	renderer, err := NewRenderer(OutputBind, opts)
+	if err != nil {
+		t.Fatalf("Error creating renderer: %v", err)
+	}
+	in := goldenInput(t)
+	var first, second bytes.Buffer
+	if err := renderer.Render(&first, in); err != nil {
+		t.Fatalf("Error rendering: %v", err)
+	}
+	in.Dnsmasq.Synths[0], in.Dnsmasq.Synths[1] = in.Dnsmasq.Synths[1], in.Dnsmasq.Synths[0]
+	if err := renderer.Render(&second, in); err != nil {
+		t.Fatalf("Error rendering: %v", err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Errorf("Expected the same archive for the same records")
+	}
+
+	files := extractBind(t, first.Bytes())
+	golden := filepath.Join("testdata", "golden.bind")
+	if *update {
+		if err := os.WriteFile(golden, []byte(files), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("Error reading golden file, rerun with -update to create it: %v", err)
+	}
+	if files != string(expected) {
+		t.Errorf("Output differs from %s, rerun with -update to accept it:\n%s", golden, files)
+	}
+	in.MaxRecords = 1
+	if err := renderer.Render(&bytes.Buffer{}, in); err == nil {
+		t.Errorf("Expected more records than MaxRecords to fail the render")
+	}
+
+	if _, err := NewRenderer(OutputBind, RendererOptions{Bind: BindOptions{IPv4Bits: 25, IPv6Bits: 64}}); err == nil {
+		t.Errorf("Expected IPv4 zones off an octet boundary to be refused")
+	}
+}
+
+func TestSerialState(t *testing.T) {
+	now := time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+	serials := &SerialState{Now: func() time.Time { return now }}
+	for _, step := range []struct {
+		digest   string
+		expected uint32
+	}{
+		{"a", 2024030500},
+		{"a", 2024030500},
+		{"b", 2024030501},
+		{"b", 2024030501},
+		{"a", 2024030502},
+	} {
+		if serial := serials.serial("10.in-addr.arpa.", step.digest); serial != step.expected {
+			t.Errorf("Expected serial %d for %s, got %d", step.expected, step.digest, serial)
+		}
+	}
+	now = now.AddDate(0, 0, 1)
+	if serial := serials.serial("10.in-addr.arpa.", "a"); serial != 2024030502 {
+		t.Errorf("Expected an unchanged zone to keep its serial, got %d", serial)
+	}
+	if serial := serials.serial("10.in-addr.arpa.", "c"); serial != 2024030600 {
+		t.Errorf("Expected the first serial of the day, got %d", serial)
+	}
+}
+
+// objectClient keeps objects in memory. Lists are only supported for
+// ConfigMaps. Updates of an object at another resourceVersion conflict.
+type objectClient struct {
+	client.Client
+	objects  map[string]client.Object
+	versions int
+}
+
+func newObjectClient() *objectClient {
+	return &objectClient{objects: map[string]client.Object{}}
+}
+
+func objectKey(obj client.Object, key client.ObjectKey) string {
+	return fmt.Sprintf("%T/%s", obj, key)
+}
+
+func notFound(key client.ObjectKey) error {
+	return apierrors.NewNotFound(schema.GroupResource{}, key.Name)
+}
+
+func (c *objectClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	stored, ok := c.objects[objectKey(obj, key)]
+	if !ok {
+		return notFound(key)
+	}
+	reflect.ValueOf(obj).Elem().Set(reflect.ValueOf(stored.DeepCopyObject()).Elem())
+	return nil
+}
+
+func (c *objectClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	key := objectKey(obj, client.ObjectKeyFromObject(obj))
+	if _, ok := c.objects[key]; ok {
+		return apierrors.NewAlreadyExists(schema.GroupResource{}, obj.GetName())
+	}
+	c.versions++
+	obj.SetResourceVersion(strconv.Itoa(c.versions))
+	c.objects[key] = obj.DeepCopyObject().(client.Object)
+	return nil
+}
+
+func (c *objectClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	key := objectKey(obj, client.ObjectKeyFromObject(obj))
+	stored, ok := c.objects[key]
+	if !ok {
+		return notFound(client.ObjectKeyFromObject(obj))
+	}
+	if obj.GetResourceVersion() != "" && obj.GetResourceVersion() != stored.GetResourceVersion() {
+		return apierrors.NewConflict(schema.GroupResource{}, obj.GetName(), fmt.Errorf("the object has been modified"))
+	}
+	c.versions++
+	obj.SetResourceVersion(strconv.Itoa(c.versions))
+	c.objects[key] = obj.DeepCopyObject().(client.Object)
+	return nil
+}
+
+func (c *objectClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	delete(c.objects, objectKey(obj, client.ObjectKeyFromObject(obj)))
+	return nil
+}
+
+func (c *objectClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOpts := &client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	configMaps := list.(*corev1.ConfigMapList)
+	for _, configMap := range c.configMaps() {
+		if configMap.Namespace == listOpts.Namespace && (listOpts.LabelSelector == nil || listOpts.LabelSelector.Matches(labels.Set(configMap.Labels))) {
+			configMaps.Items = append(configMaps.Items, *configMap.DeepCopy())
+		}
+	}
+	return nil
+}
+
+// configMaps returns the stored ConfigMaps by name.
+func (c *objectClient) configMaps() map[types.NamespacedName]*corev1.ConfigMap {
+	configMaps := map[types.NamespacedName]*corev1.ConfigMap{}
+	for _, obj := range c.objects {
+		if configMap, ok := obj.(*corev1.ConfigMap); ok {
+			configMaps[client.ObjectKeyFromObject(configMap)] = configMap
+		}
+	}
+	return configMaps
+}
+
+func TestSerialStatePersistence(t *testing.T) {
+	c := newObjectClient()
+	now := func() time.Time { return time.Date(2024, time.March, 5, 0, 0, 0, 0, time.UTC) }
+	key := types.NamespacedName{Namespace: "dns", Name: "serials"}
+	serials := &SerialState{ConfigMap: key, Now: now}
+	serials.serial("10.in-addr.arpa.", "a")
+	serials.serial("10.in-addr.arpa.", "b")
+	if err := serials.Save(context.Background(), c); err != nil {
+		t.Fatalf("Error saving serials: %v", err)
+	}
+	if value := c.configMaps()[key].Data["10.in-addr.arpa"]; value != "2024030501 b" {
+		t.Errorf("Expected the serial and digest to be saved, got %q", value)
+	}
+
+	restarted := &SerialState{ConfigMap: key, Now: now}
+	if err := restarted.Load(context.Background(), c); err != nil {
+		t.Fatalf("Error loading serials: %v", err)
+	}
+	if serial := restarted.serial("10.in-addr.arpa.", "b"); serial != 2024030501 {
+		t.Errorf("Expected the saved serial to be kept, got %d", serial)
+	}
+	if serial := restarted.serial("10.in-addr.arpa.", "c"); serial != 2024030502 {
+		t.Errorf("Expected the serial to keep increasing after a restart, got %d", serial)
+	}
+}
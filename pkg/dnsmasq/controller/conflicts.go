@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	"github.com/openshift-splat-team/vsphere-ci-dns/data"
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+type conflictKey struct {
+	kept, dropped record.Source
+}
+
+type conflictGroup struct {
+	count int
+	first record.Conflict
+}
+
+// conflictReport aggregates conflicts by the pair of sources involved, so that
+// its size does not depend on how many addresses conflict.
+type conflictReport struct {
+	logr   logr.Logger
+	order  []conflictKey
+	groups map[conflictKey]*conflictGroup
+}
+
+func newConflictReport(ctx context.Context) *conflictReport {
+	return &conflictReport{
+		logr:   log.FromContext(ctx),
+		groups: map[conflictKey]*conflictGroup{},
+	}
+}
+
+func (c *conflictReport) add(conflict record.Conflict) {
+	// the held records of a failed source only fill in for its current ones
+	if conflict.Dropped.Priority == heldPriority {
+		return
+	}
+	c.logr.V(1).Info("conflicting records", "address", conflict.Kept.Addr.String(),
+		"kept", conflict.Kept.Name(), "keptSource", conflict.Kept.Source.String(),
+		"dropped", conflict.Dropped.Name(), "droppedSource", conflict.Dropped.Source.String())
+	key := conflictKey{kept: conflict.Kept.Source, dropped: conflict.Dropped.Source}
+	group, exists := c.groups[key]
+	if !exists {
+		group = &conflictGroup{first: conflict}
+		c.groups[key] = group
+		c.order = append(c.order, key)
+	}
+	group.count++
+}
+
+// reportConflicts logs and emits one Event on secret for each pair of sources
+// which disagree.
+func (r *SecretReconciler) reportConflicts(ctx context.Context, secret *corev1.Secret, report *conflictReport) {
+	logr := log.FromContext(ctx)
+	for _, key := range report.order {
+		group := report.groups[key]
+		logr.Info("conflicting records", "count", group.count,
+			"keptSource", key.kept.String(), "droppedSource", key.dropped.String(), "first", group.first.String())
+		if r.Recorder != nil {
+			r.Recorder.Eventf(secret, corev1.EventTypeWarning, "RecordConflict",
+				"%d addresses from %s conflict with %s, which was kept; first: %s",
+				group.count, key.dropped, key.kept, group.first)
+		}
+	}
+}
+
+// reportSourceError logs err against source and emits a Warning Event on the
+// secret. Invalid subnets.json entries are only logged, one by one, and
+// joined errors are reported one by one. Unknown subnets.json fields get
+// their own Event, for the producer of the file to notice. It returns true
+// unless err only warns of unknown fields, as the records of the source are
+// then incomplete.
+func (r *SecretReconciler) reportSourceError(ctx context.Context, secret *corev1.Secret, source RecordSource, err error) bool {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		incomplete := false
+		for _, err := range joined.Unwrap() {
+			if r.reportSourceError(ctx, secret, source, err) {
+				incomplete = true
+			}
+		}
+		return incomplete
+	}
+	logr := log.FromContext(ctx)
+	var subnetErrs data.SubnetErrors
+	if errors.As(err, &subnetErrs) {
+		for _, subnetErr := range subnetErrs {
+			logr.Error(subnetErr.Err, "skipping invalid subnet", "subnet", subnetErr.Path())
+		}
+		return true
+	}
+	var unknown data.UnknownFields
+	if errors.As(err, &unknown) {
+		logr.Info("ignoring unknown subnets.json fields", "fields", unknown.Error())
+		if r.Recorder != nil {
+			r.Recorder.Eventf(secret, corev1.EventTypeWarning, "UnknownSubnetFields", "%v", unknown)
+		}
+		return false
+	}
+	logr.Error(err, "record source failed", "source", source.Kind())
+	if r.Recorder != nil {
+		r.Recorder.Eventf(secret, corev1.EventTypeWarning, "SourceFailed", "%s: %v", source.Kind(), err)
+	}
+	return true
+}
@@ -0,0 +1,288 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// DefaultCoreDNSDir is where CoreDNS mounts the ConfigMaps of a coredns
+	// target, all shards into the same directory.
+	DefaultCoreDNSDir = "/etc/coredns/ci-dns"
+	// DefaultConfigMapShardBytes bounds the data of each ConfigMap, leaving
+	// room under the 1 MiB object limit for its metadata.
+	DefaultConfigMapShardBytes = 1000 * 1000
+	// DefaultCoreDNSShards is the number of ConfigMaps a coredns target may
+	// spread its files over, unless set with shards=.
+	DefaultCoreDNSShards = 8
+	// ShardOfLabel marks the ConfigMaps of a coredns target with the name
+	// of the first, so that shards no longer needed are deleted.
+	ShardOfLabel = "ptr-record-operator.splat.io/shard-of"
+
+	coreDNSServerKey = "ci-dns.server"
+)
+
+// coreDNSPublisher writes the records into ConfigMaps mounted by CoreDNS, as
+// a file per zone and a server block serving each, imported at the top level
+// of the Corefile. CoreDNS picks changes up with the reload plugin.
+//
+// The hosts format writes a hosts plugin file per reverse zone, and per
+// parent domain of the names, each holding the records in the zone; names
+// of the zone missing from the records answer NXDOMAIN. The file format
+// writes a file plugin zone per reverse zone, as for bind targets.
+//
+// Keys are spread over the ConfigMap and, once it is full, over shards named
+// after it with a -1, -2... suffix, up to maxShards ConfigMaps in all. CoreDNS
+// only reads the shards its Deployment mounts, so dir must be a projected
+// volume listing the ConfigMap and every shard, as optional.
+type coreDNSPublisher struct {
+	configMap types.NamespacedName
+	// zones renders the zone files, or is nil for hosts files.
+	zones *bindRenderer
+	dir   string
+	// ipv4Bits and ipv6Bits are the prefix lengths of the reverse zones of
+	// hosts files.
+	ipv4Bits int
+	ipv6Bits int
+	// shardBytes bounds the data of each ConfigMap.
+	shardBytes int
+	// maxShards bounds the number of ConfigMaps.
+	maxShards int
+}
+
+// newCoreDNSPublisher returns the publisher of
+// coredns://namespace/name?format=hosts|file&dir=mount&shards=count.
+func newCoreDNSPublisher(u *url.URL, opts RendererOptions) (Publisher, error) {
+	name := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("expected coredns://namespace/name")
+	}
+	if err := validateZoneBits(opts.Bind.IPv4Bits, opts.Bind.IPv6Bits); err != nil {
+		return nil, err
+	}
+	p := &coreDNSPublisher{
+		configMap:  types.NamespacedName{Namespace: u.Host, Name: name},
+		dir:        DefaultCoreDNSDir,
+		ipv4Bits:   opts.Bind.IPv4Bits,
+		ipv6Bits:   opts.Bind.IPv6Bits,
+		shardBytes: DefaultConfigMapShardBytes,
+		maxShards:  DefaultCoreDNSShards,
+	}
+	query := u.Query()
+	if dir := query.Get("dir"); dir != "" {
+		p.dir = strings.TrimSuffix(dir, "/")
+	}
+	if value := query.Get("shards"); value != "" {
+		shards, err := strconv.Atoi(value)
+		if err != nil || shards < 1 {
+			return nil, fmt.Errorf("invalid shards %q: expected a positive count", value)
+		}
+		p.maxShards = shards
+	}
+	switch format := query.Get("format"); format {
+	case "", "hosts":
+	case "file":
+		if err := opts.Bind.Validate(); err != nil {
+			return nil, err
+		}
+		p.zones = newBindRenderer(opts.Bind)
+	default:
+		return nil, fmt.Errorf("unknown coredns format %q, expected hosts or file", format)
+	}
+	return p, nil
+}
+
+// Format returns OutputBind for zone files, which take the same flags.
+func (p *coreDNSPublisher) Format() OutputFormat {
+	if p.zones != nil {
+		return OutputBind
+	}
+	return OutputHosts
+}
+
+func (p *coreDNSPublisher) String() string {
+	format := "hosts"
+	if p.zones != nil {
+		format = "file"
+	}
+	return fmt.Sprintf("coredns://%s?format=%s", p.configMap, format)
+}
+
+// configFile is a key of the ConfigMaps.
+type configFile struct {
+	key     string
+	content []byte
+}
+
+// files renders the keys of the ConfigMaps, in order.
+func (p *coreDNSPublisher) files(in RenderInput) ([]configFile, error) {
+	if p.zones == nil {
+		return p.hostsFiles(in)
+	}
+
+	zones, err := p.zones.zones(in)
+	if err != nil {
+		return nil, err
+	}
+	var server bytes.Buffer
+	if err := writeHeader(&server, OutputBind, "#"); err != nil {
+		return nil, err
+	}
+	files := []configFile{}
+	for _, zone := range zones {
+		serial := p.zones.opts.Serials.serial(zone.origin, p.zones.digest(zone))
+		var content bytes.Buffer
+		if err := p.zones.writeZone(&content, zone, serial); err != nil {
+			return nil, err
+		}
+		key := strings.TrimSuffix(zone.origin, ".") + ".zone"
+		files = append(files, configFile{key: key, content: content.Bytes()})
+		fmt.Fprintf(&server, "%s {\n\tfile %s/%s\n}\n", zone.origin, p.dir, key)
+	}
+	return append([]configFile{{key: coreDNSServerKey, content: server.Bytes()}}, files...), nil
+}
+
+// hostsFiles renders a hosts file per zone, ordered by zone, after the server
+// block serving them. Every record is published both forward and reverse, as
+// the hosts plugin answers both from the same line.
+func (p *coreDNSPublisher) hostsFiles(in RenderInput) ([]configFile, error) {
+	zones := map[string]*bytes.Buffer{}
+	it := in.buffered()
+	for rec, ok := it.Next(); ok; rec, ok = it.Next() {
+		line := fmt.Sprintf("%s %s\n", rec.Addr, strings.Join(rec.Names, " "))
+		owners := []string{reverseZone(rec, p.ipv4Bits, p.ipv6Bits)}
+		for _, name := range rec.Names {
+			// single-label names would make a server block for the root
+			if _, parent, ok := strings.Cut(fqdn(name), "."); ok && parent != "" && !slices.Contains(owners, parent) {
+				owners = append(owners, parent)
+			}
+		}
+		for _, zone := range owners {
+			if zones[zone] == nil {
+				zones[zone] = &bytes.Buffer{}
+			}
+			zones[zone].WriteString(line)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	var server bytes.Buffer
+	if err := writeHeader(&server, OutputHosts, "#"); err != nil {
+		return nil, err
+	}
+	files := []configFile{}
+	for _, zone := range sortedKeys(zones) {
+		key := strings.TrimSuffix(zone, ".") + ".hosts"
+		files = append(files, configFile{key: key, content: zones[zone].Bytes()})
+		fmt.Fprintf(&server, "%s {\n\thosts %s/%s\n}\n", zone, p.dir, key)
+	}
+	return append([]configFile{{key: coreDNSServerKey, content: server.Bytes()}}, files...), nil
+}
+
+// shards spreads files over as few ConfigMaps as their order allows.
+func (p *coreDNSPublisher) shards(files []configFile) ([]map[string]string, error) {
+	var shards []map[string]string
+	size := 0
+	for _, file := range files {
+		fileSize := len(file.key) + len(file.content)
+		if fileSize > p.shardBytes {
+			return nil, fmt.Errorf("%s is %d bytes, more than a ConfigMap holds", file.key, fileSize)
+		}
+		if len(shards) == 0 || size+fileSize > p.shardBytes {
+			shards = append(shards, map[string]string{})
+			size = 0
+		}
+		shards[len(shards)-1][file.key] = string(file.content)
+		size += fileSize
+	}
+	return shards, nil
+}
+
+func (p *coreDNSPublisher) shardName(i int) string {
+	if i == 0 {
+		return p.configMap.Name
+	}
+	return p.configMap.Name + "-" + strconv.Itoa(i)
+}
+
+// Publish writes the shards, then deletes those left over from a larger
+// record set.
+func (p *coreDNSPublisher) Publish(ctx context.Context, c client.Client, in RenderInput) error {
+	logr := log.FromContext(ctx)
+	files, err := p.files(in)
+	if err != nil {
+		return err
+	}
+	shards, err := p.shards(files)
+	if err != nil {
+		return err
+	}
+	if len(shards) > p.maxShards {
+		return fmt.Errorf("the records need %d ConfigMaps, more than the %d shards of %s", len(shards), p.maxShards, p.configMap)
+	}
+	written := map[string]bool{}
+	for i, data := range shards {
+		name := p.shardName(i)
+		written[name] = true
+		if err := p.apply(ctx, c, name, data); err != nil {
+			return err
+		}
+	}
+	logr.Info("published CoreDNS ConfigMaps", "target", p.String(), "files", len(files), "shards", len(shards))
+
+	existing := &corev1.ConfigMapList{}
+	if err := c.List(ctx, existing, client.InNamespace(p.configMap.Namespace), client.MatchingLabels{ShardOfLabel: p.configMap.Name}); err != nil {
+		return fmt.Errorf("unable to list shards of %s: %v", p.configMap, err)
+	}
+	for i := range existing.Items {
+		if stale := &existing.Items[i]; !written[stale.Name] {
+			if err := c.Delete(ctx, stale); err != nil && !apierrors.IsNotFound(err) {
+				return fmt.Errorf("unable to delete shard %s/%s: %v", stale.Namespace, stale.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// apply creates the ConfigMap name with data, or updates it if its data
+// differs.
+func (p *coreDNSPublisher) apply(ctx context.Context, c client.Client, name string, data map[string]string) error {
+	configMap := &corev1.ConfigMap{}
+	key := types.NamespacedName{Namespace: p.configMap.Namespace, Name: name}
+	err := c.Get(ctx, key, configMap)
+	switch {
+	case apierrors.IsNotFound(err):
+		configMap.Namespace, configMap.Name = key.Namespace, key.Name
+		configMap.Labels = map[string]string{ShardOfLabel: p.configMap.Name}
+		configMap.Data = data
+		err = c.Create(ctx, configMap)
+	case err == nil:
+		if maps.Equal(configMap.Data, data) && configMap.Labels[ShardOfLabel] == p.configMap.Name {
+			return nil
+		}
+		if configMap.Labels == nil {
+			configMap.Labels = map[string]string{}
+		}
+		configMap.Labels[ShardOfLabel] = p.configMap.Name
+		configMap.Data = data
+		err = c.Update(ctx, configMap)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write ConfigMap %s: %v", key, err)
+	}
+	return nil
+}
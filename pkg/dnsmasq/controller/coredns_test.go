@@ -0,0 +1,169 @@
+package controller
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestCoreDNSPublisher(t *testing.T) {
+	opts := DefaultRendererOptions()
+	opts.Bind.Serials = &SerialState{Now: func() time.Time { return time.Date(2024, time.March, 5, 0, 0, 0, 0, time.UTC) }}
+	target, err := ParseTarget("coredns://dns/ci-dns?format=file", opts)
+	if err != nil {
+		t.Fatalf("Error parsing target: %v", err)
+	}
+	if target.Format() != OutputBind || target.String() != "coredns://dns/ci-dns?format=file" {
+		t.Errorf("Unexpected target %s in %s format", target, target.Format())
+	}
+	publisher := target.Publisher.(*coreDNSPublisher)
+	// a shard holds the server block and a zone or two
+	publisher.shardBytes = 1200
+
+	c := newObjectClient()
+	stale := &corev1.ConfigMap{}
+	stale.Namespace, stale.Name, stale.Labels = "dns", "ci-dns-9", map[string]string{ShardOfLabel: "ci-dns"}
+	if err := c.Create(context.Background(), stale); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateDNSHost(context.Background(), c, "", target, goldenInput(t)); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+
+	keys := map[string]string{}
+	for key, configMap := range c.configMaps() {
+		if configMap.Labels[ShardOfLabel] != "ci-dns" {
+			t.Errorf("Expected %s to be labelled as a shard of ci-dns", key)
+		}
+		size := 0
+		for name, content := range configMap.Data {
+			keys[name] = key.Name
+			size += len(name) + len(content)
+		}
+		if size > publisher.shardBytes {
+			t.Errorf("Expected %s to hold at most %d bytes, got %d", key, publisher.shardBytes, size)
+		}
+	}
+	if _, ok := c.configMaps()[types.NamespacedName{Namespace: "dns", Name: "ci-dns-9"}]; ok {
+		t.Errorf("Expected the stale shard to be deleted")
+	}
+	if len(c.configMaps()) < 2 || keys[coreDNSServerKey] != "ci-dns" {
+		t.Errorf("Expected the server block in ci-dns and the zones sharded, got %v", keys)
+	}
+	server := c.configMaps()[types.NamespacedName{Namespace: "dns", Name: "ci-dns"}].Data[coreDNSServerKey]
+	if !strings.Contains(server, "74.177.10.in-addr.arpa. {\n\tfile /etc/coredns/ci-dns/74.177.10.in-addr.arpa.zone\n}\n") {
+		t.Errorf("Expected a server block serving each zone, got\n%s", server)
+	}
+	if _, ok := keys["128-29.74.177.10.in-addr.arpa.zone"]; !ok {
+		t.Errorf("Expected a zone file per reverse zone, got %v", keys)
+	}
+
+	publisher.shardBytes = 100
+	if err := publisher.Publish(context.Background(), c, goldenInput(t)); err == nil {
+		t.Errorf("Expected a zone larger than a ConfigMap to be refused")
+	}
+
+	for _, value := range []string{"coredns://dns", "coredns://dns/a/b", "coredns://dns/ci?format=json", "coredns://dns/ci?shards=0", "route53://zone"} {
+		if _, err := ParseTarget(value, opts); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+// coreDNSData returns the keys of the ConfigMap name and its shards.
+func coreDNSData(c *objectClient, name string) map[string]string {
+	data := map[string]string{}
+	for _, configMap := range c.configMaps() {
+		if configMap.Labels[ShardOfLabel] == name {
+			for key, content := range configMap.Data {
+				data[key] = content
+			}
+		}
+	}
+	return data
+}
+
+func TestCoreDNSHosts(t *testing.T) {
+	// the default additional CIDR is about 2.6 MB of hosts lines
+	prefix := netip.MustParsePrefix("192.168.0.0/16")
+	in := RenderInput{Records: func() record.Iterator {
+		return record.Expand(prefix, func(addr netip.Addr) (record.Record, error) {
+			return formatRecord(addr, NameData{}, nil, record.Source{Kind: record.SourceCIDR})
+		})
+	}}
+	target, err := ParseTarget("coredns://dns/ci-hosts", DefaultRendererOptions())
+	if err != nil {
+		t.Fatalf("Error parsing target: %v", err)
+	}
+	if target.Format() != OutputHosts || target.String() != "coredns://dns/ci-hosts?format=hosts" {
+		t.Errorf("Unexpected target %s in %s format", target, target.Format())
+	}
+	c := newObjectClient()
+	if err := UpdateDNSHost(context.Background(), c, "", target, in); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+	if len(c.configMaps()) < 3 {
+		t.Errorf("Expected the hosts files to be sharded, got %d ConfigMaps", len(c.configMaps()))
+	}
+	for key, configMap := range c.configMaps() {
+		size := 0
+		for name, content := range configMap.Data {
+			size += len(name) + len(content)
+		}
+		if size > DefaultConfigMapShardBytes {
+			t.Errorf("Expected %s to hold at most %d bytes, got %d", key, DefaultConfigMapShardBytes, size)
+		}
+	}
+
+	data := coreDNSData(c, "ci-hosts")
+	server := data[coreDNSServerKey]
+	if !strings.Contains(server, "0.168.192.in-addr.arpa. {\n\thosts /etc/coredns/ci-dns/0.168.192.in-addr.arpa.hosts\n}\n") {
+		t.Errorf("Expected a server block serving each zone, got\n%s", server[:min(len(server), 500)])
+	}
+	// the default names are the reverse names, in the reverse zone
+	if strings.Count(server, "hosts /etc/coredns") != 256 || len(data) != 257 {
+		t.Errorf("Expected 256 zones, got %d keys", len(data))
+	}
+	lines := 0
+	for key, content := range data {
+		if key != coreDNSServerKey {
+			lines += strings.Count(content, "\n")
+		}
+	}
+	if lines != 1<<16 {
+		t.Errorf("Expected a line per address, got %d", lines)
+	}
+	if !strings.HasPrefix(data["255.168.192.in-addr.arpa.hosts"], "192.168.255.0 0.255.168.192.in-addr.arpa.\n") {
+		t.Errorf("Unexpected hosts file\n%s", data["255.168.192.in-addr.arpa.hosts"][:100])
+	}
+
+	capped, err := ParseTarget("coredns://dns/ci-hosts?shards=2", DefaultRendererOptions())
+	if err != nil {
+		t.Fatalf("Error parsing target: %v", err)
+	}
+	if err := UpdateDNSHost(context.Background(), c, "", capped, in); err == nil {
+		t.Errorf("Expected more shards than mounted to be refused")
+	}
+
+	// forward names are served from the zone of their parent domain
+	golden, err := ParseTarget("coredns://dns/ci-golden", DefaultRendererOptions())
+	if err != nil {
+		t.Fatalf("Error parsing target: %v", err)
+	}
+	if err := UpdateDNSHost(context.Background(), c, "", golden, goldenInput(t)); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+	data = coreDNSData(c, "ci-golden")
+	if hosts := data["ci.example.hosts"]; !strings.Contains(hosts, "192.168.10.5 api.ci.example. api-int.ci.example.\n") {
+		t.Errorf("Expected the forward records in ci.example, got\n%s", hosts)
+	}
+	if hosts := data["0.0.10.in-addr.arpa.hosts"]; hosts != "10.0.0.130 ip-10-0-0-130.ci.example.\n" {
+		t.Errorf("Expected the reverse records in 0.0.10.in-addr.arpa, got\n%s", hosts)
+	}
+}
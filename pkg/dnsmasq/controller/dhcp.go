@@ -0,0 +1,131 @@
+package controller
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"time"
+
+	"github.com/openshift-splat-team/vsphere-ci-dns/data"
+	"github.com/pkg/errors"
+)
+
+// DefaultDHCPTagTemplate tags the DHCP configuration of a VLAN with its VLAN
+// and datacenter, e.g. vlan1153.bcr01a.dal10.
+const DefaultDHCPTagTemplate = "vlan{{.Vlan}}.{{.Datacenter}}"
+
+// DHCPRange is the dnsmasq DHCP configuration of a single VLAN.
+type DHCPRange struct {
+	// Tag is set on clients of the range and selects its options.
+	Tag       string
+	Start     netip.Addr
+	End       netip.Addr
+	Netmask   netip.Addr
+	Router    netip.Addr
+	DnsServer netip.Addr
+	// LeaseTime is left to dnsmasq when zero.
+	LeaseTime time.Duration
+}
+
+// DHCPOptions controls how DHCP ranges are generated.
+type DHCPOptions struct {
+	// Tagger renders the tag of each VLAN from its NameData.
+	Tagger    *Namer
+	LeaseTime time.Duration
+}
+
+// subnetDHCPRanges returns the DHCP range of every subnets.json entry with a
+// DHCP pool, in datacenter and VLAN order, given the error subnets were
+// parsed with. Invalid entries are skipped and reported as data.SubnetErrors,
+// as by parseSubnets.
+func subnetDHCPRanges(subnets data.Subnets, err error, opts DHCPOptions) ([]DHCPRange, error) {
+	var subnetErrs data.SubnetErrors
+	if err != nil && !errors.As(err, &subnetErrs) {
+		return nil, errors.Wrapf(err, "unable to parse")
+	}
+
+	tagger := opts.Tagger
+	if tagger == nil {
+		if tagger, err = NewNamer(DefaultDHCPTagTemplate); err != nil {
+			return nil, err
+		}
+	}
+
+	var ranges []DHCPRange
+	var tagErr error
+	subnets.Walk(func(datacenter, vlan string, subnet data.Subnet) {
+		start, end, ok := subnet.DhcpRange()
+		if !ok || !start.Is4() || tagErr != nil {
+			return
+		}
+		tag, err := tagger.Name(NameData{
+			Datacenter:    datacenter,
+			Vlan:          vlan,
+			Virtualcenter: subnet.Virtualcenter,
+		})
+		if err != nil {
+			tagErr = errors.Wrapf(err, "%s/%s", datacenter, vlan)
+			return
+		}
+		dhcpRange := DHCPRange{Tag: tag, Start: start, End: end, LeaseTime: opts.LeaseTime}
+		// the mask has been validated by data.ParseSubnets
+		dhcpRange.Netmask, _ = netip.ParseAddr(subnet.Mask)
+		if dhcpRange.Router, err = optionalAddr("gateway", subnet.Gateway); err == nil {
+			dhcpRange.DnsServer, err = optionalAddr("dnsServer", subnet.DnsServer)
+		}
+		if err != nil {
+			subnetErrs = append(subnetErrs, &data.SubnetError{Datacenter: datacenter, Vlan: vlan, Err: err})
+			return
+		}
+		ranges = append(ranges, dhcpRange)
+	})
+	if tagErr != nil {
+		return nil, tagErr
+	}
+	if len(subnetErrs) > 0 {
+		return ranges, subnetErrs
+	}
+	return ranges, nil
+}
+
+// optionalAddr parses value, which may be empty.
+func optionalAddr(field, value string) (netip.Addr, error) {
+	if value == "" {
+		return netip.Addr{}, nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil || !addr.Is4() {
+		return netip.Addr{}, fmt.Errorf("invalid %s %q", field, value)
+	}
+	return addr, nil
+}
+
+// Directives returns the dnsmasq configuration lines of the range.
+func (r DHCPRange) Directives() []string {
+	dhcpRange := fmt.Sprintf("dhcp-range=set:%s,%s,%s", r.Tag, r.Start, r.End)
+	if r.Netmask.IsValid() {
+		dhcpRange += "," + r.Netmask.String()
+	}
+	if r.LeaseTime > 0 {
+		dhcpRange += fmt.Sprintf(",%ds", int64(r.LeaseTime/time.Second))
+	}
+	directives := []string{dhcpRange}
+	if r.Router.IsValid() {
+		directives = append(directives, fmt.Sprintf("dhcp-option=tag:%s,option:router,%s", r.Tag, r.Router))
+	}
+	if r.DnsServer.IsValid() {
+		directives = append(directives, fmt.Sprintf("dhcp-option=tag:%s,option:dns-server,%s", r.Tag, r.DnsServer))
+	}
+	return directives
+}
+
+func writeDHCPRanges(w io.Writer, ranges []DHCPRange) error {
+	for _, dhcpRange := range ranges {
+		for _, directive := range dhcpRange.Directives() {
+			if _, err := fmt.Fprintln(w, directive); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
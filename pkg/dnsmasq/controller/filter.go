@@ -0,0 +1,236 @@
+package controller
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+
+	vcmv1 "github.com/openshift-splat-team/vsphere-capacity-manager/pkg/apis/vspherecapacitymanager.splat.io/v1"
+	"github.com/openshift-splat-team/vsphere-ci-dns/data"
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+)
+
+// AddressFilter limits the addresses a source publishes records for.
+type AddressFilter struct {
+	// Include, when not empty, restricts the source to these prefixes.
+	Include []netip.Prefix
+	// Exclude removes these prefixes from the source, e.g. ranges owned by
+	// other teams.
+	Exclude []netip.Prefix
+}
+
+// Allows returns true if addr passes the filter.
+func (f AddressFilter) Allows(addr netip.Addr) bool {
+	for _, prefix := range f.Exclude {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, prefix := range f.Include {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filters holds the address filter of each source kind.
+type Filters map[record.SourceKind]AddressFilter
+
+// ParseFilters parses include and exclude lists of "<source>=<prefix>" items,
+// e.g. "cidr=192.168.10.0/24".
+func ParseFilters(include, exclude []string) (Filters, error) {
+	filters := Filters{}
+	parse := func(items []string, add func(*AddressFilter, netip.Prefix)) error {
+		for _, item := range items {
+			kind, cidr, found := strings.Cut(item, "=")
+			if !found {
+				return fmt.Errorf("invalid address filter %q: expected <source>=<prefix>", item)
+			}
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return fmt.Errorf("invalid address filter %q: %v", item, err)
+			}
+			filter := filters[record.SourceKind(kind)]
+			add(&filter, prefix.Masked())
+			filters[record.SourceKind(kind)] = filter
+		}
+		return nil
+	}
+	if err := parse(include, func(f *AddressFilter, prefix netip.Prefix) { f.Include = append(f.Include, prefix) }); err != nil {
+		return nil, err
+	}
+	if err := parse(exclude, func(f *AddressFilter, prefix netip.Prefix) { f.Exclude = append(f.Exclude, prefix) }); err != nil {
+		return nil, err
+	}
+	return filters, nil
+}
+
+// Allows returns true if rec passes the filter of its source.
+func (f Filters) Allows(rec record.Record) bool {
+	filter, ok := f[rec.Source.Kind]
+	return !ok || filter.Allows(rec.Addr)
+}
+
+// Apply returns the records which pass the filter of their source.
+func (f Filters) Apply(records []record.Record) []record.Record {
+	if len(f) == 0 {
+		return records
+	}
+	allowed := make([]record.Record, 0, len(records))
+	for _, rec := range records {
+		if f.Allows(rec) {
+			allowed = append(allowed, rec)
+		}
+	}
+	return allowed
+}
+
+// isNetworkOrBroadcast returns true if addr is the network or broadcast
+// address of an IPv4 prefix. /31 and /32 prefixes have neither.
+func isNetworkOrBroadcast(prefix netip.Prefix, addr netip.Addr) bool {
+	if !prefix.Addr().Is4() || prefix.Bits() >= 31 {
+		return false
+	}
+	prefix = prefix.Masked()
+	if addr == prefix.Addr() {
+		return true
+	}
+	network := prefix.Addr().As4()
+	hostMask := ^uint32(0) >> prefix.Bits()
+	broadcast := (uint32(network[0])<<24 | uint32(network[1])<<16 | uint32(network[2])<<8 | uint32(network[3])) | hostMask
+	return addr == netip.AddrFrom4([4]byte{byte(broadcast >> 24), byte(broadcast >> 16), byte(broadcast >> 8), byte(broadcast)})
+}
+
+// ReservedRole identifies an infrastructure address of a subnets.json entry.
+type ReservedRole string
+
+const (
+	// ReservedGateway is the Gateway address of a subnet.
+	ReservedGateway ReservedRole = "gateway"
+	// ReservedVIF is the VifIpAddress and VifIPv6Address of a subnet.
+	ReservedVIF ReservedRole = "vif"
+	// ReservedDHCP is every address of the DHCP pool of a subnet.
+	ReservedDHCP ReservedRole = "dhcp"
+)
+
+// DefaultReservations name the gateway and VIF of every subnet, e.g.
+// gw.vlan1153.bcr01a.dal10., so that they stand out in traceroutes and firewall
+// logs. VLAN IDs are only unique within a datacenter, e.g. bcr01a.dal10 and
+// bcr03a.dal10 both have a VLAN 1225, so the names carry the full datacenter.
+var DefaultReservations = map[string]string{
+	string(ReservedGateway): "gw.vlan{{.Vlan}}.{{.Datacenter}}.",
+	string(ReservedVIF):     "vif.vlan{{.Vlan}}.{{.Datacenter}}.",
+}
+
+// Reservation names the addresses of a ReservedRole. A nil Namer publishes no
+// record for them at all, from any source. Named addresses are published both
+// ways, whatever the publish mode of their source.
+type Reservation struct {
+	Namer *Namer
+}
+
+// Reservations holds the reservation of each role. Addresses of roles without
+// a reservation are treated like any other address of the subnet.
+type Reservations map[ReservedRole]Reservation
+
+// ParseReservations parses a map of role to hostname template. An empty
+// template reserves the addresses without publishing a record for them.
+func ParseReservations(templates map[string]string) (Reservations, error) {
+	reservations := Reservations{}
+	for role, text := range templates {
+		switch ReservedRole(role) {
+		case ReservedGateway, ReservedVIF, ReservedDHCP:
+		default:
+			return nil, fmt.Errorf("unknown reserved address role %q", role)
+		}
+		if text == "" {
+			reservations[ReservedRole(role)] = Reservation{}
+			continue
+		}
+		namer, err := NewNamer(text)
+		if err != nil {
+			return nil, fmt.Errorf("reserved address role %q: %v", role, err)
+		}
+		reservations[ReservedRole(role)] = Reservation{Namer: namer}
+	}
+	return reservations, nil
+}
+
+// reservedRecord returns the record of a reserved address.
+func (r Reservation) reservedRecord(addr netip.Addr, data NameData, source record.Source) (record.Record, error) {
+	if r.Namer == nil {
+		return record.New(addr, source)
+	}
+	rec, err := formatRecord(addr, data, r.Namer, source)
+	rec.Publish = record.PublishBoth
+	return rec, err
+}
+
+// networkGateway returns the record of the gateway of a VCM network, named
+// after its PrimaryRouterHostname or else by the gateway reservation. ok is
+// false if the network has no gateway or neither gives it a name.
+func networkGateway(network *vcmv1.Network, opts RecordOptions) (rec record.Record, ok bool, err error) {
+	if network.Spec.Gateway == nil || *network.Spec.Gateway == "" {
+		return record.Record{}, false, nil
+	}
+	addr, err := netip.ParseAddr(*network.Spec.Gateway)
+	if err != nil {
+		return record.Record{}, false, fmt.Errorf("invalid gateway %q: %v", *network.Spec.Gateway, err)
+	}
+	source := networkSource(network)
+	if hostname := network.Spec.PrimaryRouterHostname; hostname != "" {
+		if err := ValidateHostname(hostname); err != nil {
+			return record.Record{}, false, fmt.Errorf("invalid primary router hostname: %v", err)
+		}
+		rec, err := record.New(addr, source, hostname)
+		rec.Publish = record.PublishBoth
+		return rec, err == nil, err
+	}
+	reservation, ok := opts.Reservations[ReservedGateway]
+	if !ok {
+		return record.Record{}, false, nil
+	}
+	rec, err = reservation.reservedRecord(addr, networkNameData(network), source)
+	return rec, err == nil, err
+}
+
+// subnetAddresses returns the reservation of every reserved address of subnet.
+// The gateway and VIF take precedence over the DHCP pool they may fall in.
+func (r Reservations) subnetAddresses(subnet data.Subnet) map[netip.Addr]Reservation {
+	reserved := map[netip.Addr]Reservation{}
+	if reservation, ok := r[ReservedDHCP]; ok {
+		if start, end, ok := subnet.DhcpRange(); ok {
+			for addr := start; addr.IsValid() && !end.Less(addr); addr = addr.Next() {
+				reserved[addr] = reservation
+			}
+		}
+	}
+	if reservation, ok := r[ReservedVIF]; ok {
+		for _, ip := range []string{subnet.VifIpAddress, subnet.VifIPv6Address} {
+			if addr, err := netip.ParseAddr(ip); err == nil {
+				reserved[addr.Unmap()] = reservation
+			}
+		}
+	}
+	if reservation, ok := r[ReservedGateway]; ok {
+		if addr, err := netip.ParseAddr(subnet.Gateway); err == nil {
+			reserved[addr.Unmap()] = reservation
+		}
+	}
+	return reserved
+}
+
+// sortedAddrs returns the keys of addrs in order.
+func sortedAddrs[V any](addrs map[netip.Addr]V) []netip.Addr {
+	keys := make([]netip.Addr, 0, len(addrs))
+	for addr := range addrs {
+		keys = append(keys, addr)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Less(keys[j]) })
+	return keys
+}
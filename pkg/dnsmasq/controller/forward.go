@@ -0,0 +1,34 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+)
+
+// PublishModes holds the publish mode of each source kind. Sources without
+// one publish reverse records only.
+type PublishModes map[record.SourceKind]record.Publish
+
+// ParsePublishModes parses a map of source kind to publish mode, e.g.
+// subnets=both.
+func ParsePublishModes(modes map[string]string) (PublishModes, error) {
+	result := PublishModes{}
+	for kind, name := range modes {
+		publish, err := record.ParsePublish(name)
+		if err != nil {
+			return nil, fmt.Errorf("source %q: %v", kind, err)
+		}
+		result[record.SourceKind(kind)] = publish
+	}
+	return result, nil
+}
+
+// Apply sets the publish mode of rec from its source, unless rec already has
+// one, as infrastructure addresses do.
+func (m PublishModes) Apply(rec record.Record) record.Record {
+	if publish, ok := m[rec.Source.Kind]; ok && rec.Publish == "" {
+		rec.Publish = publish
+	}
+	return rec
+}
@@ -0,0 +1,547 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// InfobloxUsername, InfobloxPassword and InfobloxCA are the keys of the
+	// Secret holding the WAPI credentials of an infoblox target, and the PEM
+	// certificates it trusts besides the system roots.
+	InfobloxUsername = "username"
+	InfobloxPassword = "password"
+	InfobloxCA       = "ca.crt"
+	// DefaultInfobloxAttribute is the extensible attribute marking the
+	// objects owned by the operator, with the value InfobloxOwner. It must be
+	// defined in the grid.
+	DefaultInfobloxAttribute = "Owner"
+	InfobloxOwner            = "ptr-record-operator"
+	// DefaultWAPIVersion is the WAPI version of infoblox targets.
+	DefaultWAPIVersion = "v2.12"
+
+	// wapiPageSize is the number of objects fetched per request.
+	wapiPageSize = 1000
+)
+
+// infobloxPublisher manages record:ptr objects, and optionally record:host
+// objects, through the Infoblox WAPI. Every object it creates carries the
+// owner extensible attribute and only objects carrying it are read, updated
+// or deleted, so objects managed by hand in the same zones are left alone.
+//
+// PTR records are reconciled by address and host records by name: objects
+// are only created, updated or deleted where they differ from the records.
+// Only the records, and owned objects, within the zones and networks given
+// are managed, every zone and network by default. A host record serves the
+// PTR records of its addresses, so with host records enabled, addresses
+// published forward get no record:ptr.
+type infobloxPublisher struct {
+	zoneSelector
+	// networks are the networks managed, or nil for every address.
+	networks []netip.Prefix
+	// endpoint is the WAPI URL, e.g. https://gm.example/wapi/v2.12.
+	endpoint  string
+	secret    types.NamespacedName
+	view      string
+	attribute string
+	// hosts manages record:host objects for the forward records.
+	hosts   bool
+	timeout time.Duration
+}
+
+// newInfobloxPublisher returns the publisher of
+// infoblox://host[:port]?secret=namespace/name[&version=v2.12][&view=default][&attribute=Owner][&host=true][&zone=zone...][&network=prefix...].
+func newInfobloxPublisher(u *url.URL, opts RendererOptions) (Publisher, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("expected infoblox://host[:port]")
+	}
+	query := u.Query()
+	namespace, name, ok := strings.Cut(query.Get("secret"), "/")
+	if !ok || namespace == "" || name == "" {
+		return nil, fmt.Errorf("expected the WAPI credentials as secret=namespace/name")
+	}
+	version := query.Get("version")
+	if version == "" {
+		version = DefaultWAPIVersion
+	}
+	if !strings.HasPrefix(version, "v") {
+		return nil, fmt.Errorf("invalid WAPI version %q, expected e.g. %s", version, DefaultWAPIVersion)
+	}
+	zones, err := newZoneSelector(query, opts)
+	if err != nil {
+		return nil, err
+	}
+	p := &infobloxPublisher{
+		zoneSelector: zones,
+		endpoint:     fmt.Sprintf("https://%s/wapi/%s", u.Host, version),
+		secret:       types.NamespacedName{Namespace: namespace, Name: name},
+		view:         query.Get("view"),
+		attribute:    query.Get("attribute"),
+		timeout:      30 * time.Second,
+	}
+	if p.view == "" {
+		p.view = "default"
+	}
+	if p.attribute == "" {
+		p.attribute = DefaultInfobloxAttribute
+	}
+	if value := query.Get("host"); value != "" {
+		hosts, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host %q: %v", value, err)
+		}
+		p.hosts = hosts
+	}
+	for _, network := range query["network"] {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %v", network, err)
+		}
+		p.networks = append(p.networks, prefix.Masked())
+	}
+	return p, nil
+}
+
+// inZones reports whether name is within the zones of the target.
+func (p *infobloxPublisher) inZones(name string) bool {
+	if p.zones == nil {
+		return true
+	}
+	_, ok := p.zoneOf(dns.CanonicalName(name))
+	return ok
+}
+
+// inNetworks reports whether addr is within the networks of the target.
+func (p *infobloxPublisher) inNetworks(addr string) bool {
+	if p.networks == nil {
+		return true
+	}
+	parsed, err := netip.ParseAddr(addr)
+	return err == nil && slices.ContainsFunc(p.networks, func(network netip.Prefix) bool {
+		return network.Contains(parsed)
+	})
+}
+
+// managesPTR reports whether the target manages the PTR record of addr.
+func (p *infobloxPublisher) managesPTR(addr string) bool {
+	reverse, err := dns.ReverseAddr(addr)
+	return err == nil && p.inNetworks(addr) && p.inZones(reverse)
+}
+
+// managesHost reports whether the target manages the host record of name
+// with addrs, one of them within its networks.
+func (p *infobloxPublisher) managesHost(name string, addrs []string) bool {
+	return p.inZones(name) && slices.ContainsFunc(addrs, p.inNetworks)
+}
+
+// Format returns OutputHosts, as the records are published without any
+// dnsmasq configuration.
+func (p *infobloxPublisher) Format() OutputFormat {
+	return OutputHosts
+}
+
+func (p *infobloxPublisher) String() string {
+	return "infoblox://" + strings.TrimPrefix(p.endpoint, "https://")
+}
+
+// wapiPTR, wapiHost and wapiHostAddr are the objects of the WAPI.
+type wapiPTR struct {
+	Ref      string              `json:"_ref,omitempty"`
+	PTRDName string              `json:"ptrdname"`
+	IPv4Addr string              `json:"ipv4addr,omitempty"`
+	IPv6Addr string              `json:"ipv6addr,omitempty"`
+	View     string              `json:"view,omitempty"`
+	ExtAttrs map[string]wapiAttr `json:"extattrs,omitempty"`
+}
+
+type wapiHost struct {
+	Ref       string              `json:"_ref,omitempty"`
+	Name      string              `json:"name"`
+	IPv4Addrs []wapiHostAddr      `json:"ipv4addrs"`
+	IPv6Addrs []wapiHostAddr      `json:"ipv6addrs"`
+	View      string              `json:"view,omitempty"`
+	ExtAttrs  map[string]wapiAttr `json:"extattrs,omitempty"`
+}
+
+type wapiHostAddr struct {
+	IPv4Addr string `json:"ipv4addr,omitempty"`
+	IPv6Addr string `json:"ipv6addr,omitempty"`
+}
+
+type wapiAttr struct {
+	Value string `json:"value"`
+}
+
+func (ptr wapiPTR) addr() string {
+	if ptr.IPv6Addr != "" {
+		return canonicalAddr(ptr.IPv6Addr)
+	}
+	return canonicalAddr(ptr.IPv4Addr)
+}
+
+// addrs returns the addresses of the host, sorted.
+func (h wapiHost) addrs() []string {
+	var addrs []string
+	for _, addr := range h.IPv4Addrs {
+		addrs = append(addrs, canonicalAddr(addr.IPv4Addr))
+	}
+	for _, addr := range h.IPv6Addrs {
+		addrs = append(addrs, canonicalAddr(addr.IPv6Addr))
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func canonicalAddr(addr string) string {
+	if parsed, err := netip.ParseAddr(addr); err == nil {
+		return parsed.String()
+	}
+	return addr
+}
+
+// wapiName returns name as WAPI spells it, without the trailing dot.
+func wapiName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// wapiSession is a WAPI connection with the credentials of the Secret.
+type wapiSession struct {
+	p        *infobloxPublisher
+	client   *http.Client
+	username string
+	password string
+}
+
+func (p *infobloxPublisher) session(ctx context.Context, c client.Client) (*wapiSession, error) {
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, p.secret, secret); err != nil {
+		return nil, fmt.Errorf("unable to read WAPI credentials from %s: %v", p.secret, err)
+	}
+	s := &wapiSession{
+		p:        p,
+		client:   &http.Client{Timeout: p.timeout},
+		username: string(secret.Data[InfobloxUsername]),
+		password: strings.TrimSpace(string(secret.Data[InfobloxPassword])),
+	}
+	if s.username == "" || s.password == "" {
+		return nil, fmt.Errorf("%s must hold the %s and %s of the WAPI", p.secret, InfobloxUsername, InfobloxPassword)
+	}
+	if ca := secret.Data[InfobloxCA]; len(ca) > 0 {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("%s of %s holds no PEM certificate", InfobloxCA, p.secret)
+		}
+		s.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}}
+	}
+	return s, nil
+}
+
+// wapiError is a WAPI call answered with an error status.
+type wapiError struct {
+	code    int
+	message string
+}
+
+func (e wapiError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("WAPI answered %d %s", e.code, http.StatusText(e.code))
+	}
+	return fmt.Sprintf("WAPI answered %d: %s", e.code, e.message)
+}
+
+// call sends body as JSON to the WAPI path, with query, and decodes the
+// answer into out, unless it is nil.
+func (s *wapiSession) call(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+	target := s.p.endpoint + "/" + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, payload)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.username, s.password)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		answer := struct {
+			Text string `json:"text"`
+		}{}
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&answer)
+		return wapiError{code: resp.StatusCode, message: answer.Text}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// list decodes every object of objtype owned by the operator in the view
+// into out, a pointer to a slice, page by page.
+func (s *wapiSession) list(ctx context.Context, objtype, fields string, out interface{}) error {
+	var objects []json.RawMessage
+	query := url.Values{
+		"*" + s.p.attribute: {InfobloxOwner},
+		"view":              {s.p.view},
+		"_return_fields":    {fields},
+		"_return_as_object": {"1"},
+		"_paging":           {"1"},
+		"_max_results":      {strconv.Itoa(wapiPageSize)},
+	}
+	for {
+		page := struct {
+			Result     []json.RawMessage `json:"result"`
+			NextPageID string            `json:"next_page_id"`
+		}{}
+		if err := s.call(ctx, http.MethodGet, objtype, query, nil, &page); err != nil {
+			return fmt.Errorf("unable to list %s: %v", objtype, err)
+		}
+		objects = append(objects, page.Result...)
+		if page.NextPageID == "" {
+			break
+		}
+		query = url.Values{"_page_id": {page.NextPageID}}
+	}
+	data, err := json.Marshal(objects)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// wapiChanges counts the objects written by a publish.
+type wapiChanges struct {
+	created, updated, deleted int
+	errs                      []error
+}
+
+func (c *wapiChanges) track(counter *int, err error) {
+	if err != nil {
+		c.errs = append(c.errs, err)
+		return
+	}
+	*counter++
+}
+
+// Publish reconciles the PTR records, and the host records if enabled,
+// carrying on past objects which fail.
+func (p *infobloxPublisher) Publish(ctx context.Context, c client.Client, in RenderInput) error {
+	logr := log.FromContext(ctx)
+	s, err := p.session(ctx, c)
+	if err != nil {
+		return err
+	}
+	ptrs := map[string]string{}
+	var order []string
+	hosts := map[string][]string{}
+	// hosted are the addresses whose PTR records their host records serve
+	hosted := map[string]bool{}
+	skipped := 0
+	it := in.buffered()
+	for rec, ok := it.Next(); ok; rec, ok = it.Next() {
+		addr := rec.Addr.String()
+		if rec.Publish.Reverse() && p.managesPTR(addr) {
+			if _, ok := ptrs[addr]; !ok {
+				order = append(order, addr)
+			}
+			ptrs[addr] = wapiName(rec.Name())
+		} else if rec.Publish.Reverse() {
+			skipped++
+		}
+		if p.hosts && rec.Publish.Forward() {
+			for _, name := range rec.Names {
+				if !p.managesHost(name, []string{addr}) {
+					skipped++
+					continue
+				}
+				hosts[wapiName(name)] = append(hosts[wapiName(name)], addr)
+				hosted[addr] = true
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	order = slices.DeleteFunc(order, func(addr string) bool { return hosted[addr] })
+	if skipped > 0 {
+		logr.Info("records outside the zones and networks of the target are not published", "target", p.String(), "records", skipped)
+	}
+
+	changes := &wapiChanges{}
+	if err := p.reconcilePTRs(ctx, s, order, ptrs, changes); err != nil {
+		return err
+	}
+	if p.hosts {
+		if err := p.reconcileHosts(ctx, s, hosts, changes); err != nil {
+			return err
+		}
+	}
+	logr.Info("reconciled Infoblox objects", "target", p.String(), "created", changes.created, "updated", changes.updated, "deleted", changes.deleted, "failed", len(changes.errs))
+	return errors.Join(changes.errs...)
+}
+
+func (p *infobloxPublisher) extAttrs() map[string]wapiAttr {
+	return map[string]wapiAttr{p.attribute: {Value: InfobloxOwner}}
+}
+
+// reconcilePTRs creates, updates and deletes the owned record:ptr objects
+// so that each address in order has one, pointing at its name in ptrs.
+func (p *infobloxPublisher) reconcilePTRs(ctx context.Context, s *wapiSession, order []string, ptrs map[string]string, changes *wapiChanges) error {
+	var owned []wapiPTR
+	if err := s.list(ctx, "record:ptr", "ptrdname,ipv4addr,ipv6addr,view,extattrs", &owned); err != nil {
+		return err
+	}
+	existing := map[string][]wapiPTR{}
+	for _, ptr := range owned {
+		if p.managesPTR(ptr.addr()) {
+			existing[ptr.addr()] = append(existing[ptr.addr()], ptr)
+		}
+	}
+	for _, addr := range order {
+		name := ptrs[addr]
+		objects := existing[addr]
+		delete(existing, addr)
+		if len(objects) == 0 {
+			ptr := wapiPTR{PTRDName: name, View: p.view, ExtAttrs: p.extAttrs()}
+			if netip.MustParseAddr(addr).Is6() {
+				ptr.IPv6Addr = addr
+			} else {
+				ptr.IPv4Addr = addr
+			}
+			changes.track(&changes.created, wrapWAPI("create PTR record of "+addr, s.call(ctx, http.MethodPost, "record:ptr", nil, ptr, nil)))
+			continue
+		}
+		// keep the object already pointing at name, or update the first
+		keep := slices.IndexFunc(objects, func(ptr wapiPTR) bool { return wapiName(ptr.PTRDName) == name })
+		if keep < 0 {
+			keep = 0
+			changes.track(&changes.updated, wrapWAPI("update PTR record of "+addr, s.call(ctx, http.MethodPut, objects[0].Ref, nil, map[string]string{"ptrdname": name}, nil)))
+		}
+		for i, ptr := range objects {
+			if i != keep {
+				changes.track(&changes.deleted, wrapWAPI("delete duplicate PTR record of "+addr, s.call(ctx, http.MethodDelete, ptr.Ref, nil, nil, nil)))
+			}
+		}
+	}
+	stale := map[string][]string{}
+	for addr, objects := range existing {
+		for _, ptr := range objects {
+			stale[addr] = append(stale[addr], ptr.Ref)
+		}
+	}
+	p.deleteAll(ctx, s, "PTR record of", stale, changes)
+	return nil
+}
+
+// reconcileHosts creates, updates and deletes the owned record:host
+// objects so that each name in hosts has one with its addresses.
+func (p *infobloxPublisher) reconcileHosts(ctx context.Context, s *wapiSession, hosts map[string][]string, changes *wapiChanges) error {
+	var owned []wapiHost
+	if err := s.list(ctx, "record:host", "name,ipv4addrs,ipv6addrs,view,extattrs", &owned); err != nil {
+		return err
+	}
+	existing := map[string][]wapiHost{}
+	for _, host := range owned {
+		if p.managesHost(host.Name, host.addrs()) {
+			existing[wapiName(host.Name)] = append(existing[wapiName(host.Name)], host)
+		}
+	}
+	names := make([]string, 0, len(hosts))
+	for name := range hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		addrs := hosts[name]
+		sort.Strings(addrs)
+		host := wapiHost{Name: name, IPv4Addrs: []wapiHostAddr{}, IPv6Addrs: []wapiHostAddr{}}
+		for _, addr := range addrs {
+			if netip.MustParseAddr(addr).Is6() {
+				host.IPv6Addrs = append(host.IPv6Addrs, wapiHostAddr{IPv6Addr: addr})
+			} else {
+				host.IPv4Addrs = append(host.IPv4Addrs, wapiHostAddr{IPv4Addr: addr})
+			}
+		}
+		objects := existing[name]
+		delete(existing, name)
+		if len(objects) == 0 {
+			host.View, host.ExtAttrs = p.view, p.extAttrs()
+			changes.track(&changes.created, wrapWAPI("create host record "+name, s.call(ctx, http.MethodPost, "record:host", nil, host, nil)))
+			continue
+		}
+		if !slices.Equal(objects[0].addrs(), host.addrs()) {
+			update := map[string][]wapiHostAddr{"ipv4addrs": host.IPv4Addrs, "ipv6addrs": host.IPv6Addrs}
+			changes.track(&changes.updated, wrapWAPI("update host record "+name, s.call(ctx, http.MethodPut, objects[0].Ref, nil, update, nil)))
+		}
+		for _, duplicate := range objects[1:] {
+			changes.track(&changes.deleted, wrapWAPI("delete duplicate host record "+name, s.call(ctx, http.MethodDelete, duplicate.Ref, nil, nil, nil)))
+		}
+	}
+	stale := map[string][]string{}
+	for name, objects := range existing {
+		for _, host := range objects {
+			stale[name] = append(stale[name], host.Ref)
+		}
+	}
+	p.deleteAll(ctx, s, "host record", stale, changes)
+	return nil
+}
+
+// deleteAll deletes the objects of refs, by key, in key order.
+func (p *infobloxPublisher) deleteAll(ctx context.Context, s *wapiSession, kind string, refs map[string][]string, changes *wapiChanges) {
+	keys := make([]string, 0, len(refs))
+	for key := range refs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, ref := range refs[key] {
+			changes.track(&changes.deleted, wrapWAPI("delete "+kind+" "+key, s.call(ctx, http.MethodDelete, ref, nil, nil, nil)))
+		}
+	}
+}
+
+func wrapWAPI(action string, err error) error {
+	if err != nil {
+		return fmt.Errorf("unable to %s: %v", action, err)
+	}
+	return nil
+}
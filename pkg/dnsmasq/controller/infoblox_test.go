@@ -0,0 +1,241 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// testWAPI stands in for the WAPI of an Infoblox grid, holding objects by
+// reference. It answers searches two objects a page.
+type testWAPI struct {
+	mu      sync.Mutex
+	objects map[string]map[string]interface{}
+	next    int
+	writes  int
+	// pages are the searches continued by each page ID.
+	pages map[string]url.Values
+}
+
+func (s *testWAPI) add(objtype string, object map[string]interface{}) {
+	s.next++
+	ref := fmt.Sprintf("%s/ZG5z%d:%v/default", objtype, s.next, object["ptrdname"])
+	object["_ref"] = ref
+	s.objects[ref] = object
+}
+
+func (s *testWAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /wapi/v2.12/{objtype}", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		query := r.URL.Query()
+		offset := 0
+		if page := query.Get("_page_id"); page != "" {
+			search, ok := s.pages[page]
+			if !ok {
+				http.Error(w, `{"text": "invalid page"}`, http.StatusBadRequest)
+				return
+			}
+			_, start, _ := strings.Cut(page, "@")
+			offset, _ = strconv.Atoi(start)
+			query = search
+		}
+		var refs []string
+		for ref, object := range s.objects {
+			attrs, _ := object["extattrs"].(map[string]interface{})
+			owner, _ := attrs["Owner"].(map[string]interface{})
+			if strings.HasPrefix(ref, r.PathValue("objtype")+"/") && query.Get("*Owner") != "" && owner["value"] == query.Get("*Owner") && object["view"] == query.Get("view") {
+				refs = append(refs, ref)
+			}
+		}
+		sort.Strings(refs)
+		page := map[string]interface{}{"result": []interface{}{}}
+		for i := offset; i < len(refs) && i < offset+2; i++ {
+			page["result"] = append(page["result"].([]interface{}), s.objects[refs[i]])
+		}
+		if offset+2 < len(refs) {
+			next := fmt.Sprintf("%s@%d", r.PathValue("objtype"), offset+2)
+			s.pages[next] = query
+			page["next_page_id"] = next
+		}
+		_ = json.NewEncoder(w).Encode(page)
+	})
+	mux.HandleFunc("POST /wapi/v2.12/{objtype}", func(w http.ResponseWriter, r *http.Request) {
+		object := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&object); err != nil {
+			http.Error(w, `{"text": "invalid object"}`, http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.writes++
+		s.add(r.PathValue("objtype"), object)
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(object["_ref"])
+	})
+	mux.HandleFunc("PUT /wapi/v2.12/{ref...}", func(w http.ResponseWriter, r *http.Request) {
+		fields := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+			http.Error(w, `{"text": "invalid object"}`, http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		object, ok := s.objects[r.PathValue("ref")]
+		if !ok {
+			http.Error(w, `{"text": "Reference not found"}`, http.StatusNotFound)
+			return
+		}
+		s.writes++
+		for key, value := range fields {
+			object[key] = value
+		}
+		_ = json.NewEncoder(w).Encode(r.PathValue("ref"))
+	})
+	mux.HandleFunc("DELETE /wapi/v2.12/{ref...}", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.objects[r.PathValue("ref")]; !ok {
+			http.Error(w, `{"text": "Reference not found"}`, http.StatusNotFound)
+			return
+		}
+		s.writes++
+		delete(s.objects, r.PathValue("ref"))
+		_ = json.NewEncoder(w).Encode(r.PathValue("ref"))
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "admin" || password != "infoblox" {
+			http.Error(w, `{"text": "Authorization Required"}`, http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// find returns the objects of objtype whose field is value.
+func (s *testWAPI) find(objtype, field, value string) []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found []map[string]interface{}
+	for ref, object := range s.objects {
+		if strings.HasPrefix(ref, objtype+"/") && object[field] == value {
+			found = append(found, object)
+		}
+	}
+	return found
+}
+
+func TestInfobloxPublisher(t *testing.T) {
+	owned := func() map[string]interface{} {
+		return map[string]interface{}{"Owner": map[string]interface{}{"value": InfobloxOwner}}
+	}
+	api := &testWAPI{objects: map[string]map[string]interface{}{}, pages: map[string]url.Values{}}
+	api.add("record:ptr", map[string]interface{}{"ptrdname": "stale.ci.example", "ipv4addr": "10.177.74.130", "view": "default", "extattrs": owned()})
+	api.add("record:ptr", map[string]interface{}{"ptrdname": "ip-10-177-74-131.vlan1153.ci.example", "ipv4addr": "10.177.74.131", "view": "default", "extattrs": owned()})
+	api.add("record:ptr", map[string]interface{}{"ptrdname": "twice.ci.example", "ipv4addr": "10.177.74.131", "view": "default", "extattrs": owned()})
+	api.add("record:ptr", map[string]interface{}{"ptrdname": "gone.ci.example", "ipv4addr": "10.177.74.200", "view": "default", "extattrs": owned()})
+	api.add("record:ptr", map[string]interface{}{"ptrdname": "printer.ci.example", "ipv4addr": "10.177.74.201", "view": "default"})
+	api.add("record:host", map[string]interface{}{"name": "gone.ci.example", "ipv4addrs": []interface{}{map[string]interface{}{"ipv4addr": "10.177.74.200"}}, "view": "default", "extattrs": owned()})
+	server := httptest.NewTLSServer(api.handler())
+	defer server.Close()
+
+	c := newObjectClient()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	secret := &corev1.Secret{Data: map[string][]byte{InfobloxUsername: []byte("admin"), InfobloxPassword: []byte("infoblox\n"), InfobloxCA: ca}}
+	secret.Namespace, secret.Name = "dns", "wapi"
+	if err := c.Create(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	host := strings.TrimPrefix(server.URL, "https://")
+	target, err := ParseTarget("infoblox://"+host+"?secret=dns/wapi", DefaultRendererOptions())
+	if err != nil {
+		t.Fatalf("Error parsing target: %v", err)
+	}
+	if err := UpdateDNSHost(context.Background(), c, "", target, goldenInput(t)); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+
+	for addr, expected := range map[string]string{
+		"10.177.74.130": "ip-10-177-74-130.vlan1153.ci.example",
+		"10.177.74.131": "ip-10-177-74-131.vlan1153.ci.example",
+		"10.177.74.129": "gw.vlan1153.bcr01a.dal10",
+		"10.177.74.201": "printer.ci.example",
+	} {
+		ptrs := api.find("record:ptr", "ipv4addr", addr)
+		if len(ptrs) != 1 || ptrs[0]["ptrdname"] != expected {
+			t.Errorf("Expected one PTR record of %s pointing at %s, got %v", addr, expected, ptrs)
+		}
+	}
+	if ptrs := api.find("record:ptr", "ipv4addr", "10.177.74.200"); len(ptrs) != 0 {
+		t.Errorf("Expected the PTR record no longer published to be deleted, got %v", ptrs)
+	}
+	if hosts := api.find("record:host", "name", "gone.ci.example"); len(hosts) != 1 {
+		t.Errorf("Expected host records to be left alone unless enabled, got %v", hosts)
+	}
+
+	writes := api.writes
+	if err := UpdateDNSHost(context.Background(), c, "", target, goldenInput(t)); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+	if api.writes != writes {
+		t.Errorf("Expected no writes once the objects match, got %d more", api.writes-writes)
+	}
+
+	// host records serve the PTR records of their addresses
+	scoped, err := ParseTarget("infoblox://"+host+"?secret=dns/wapi&host=true&zone=ci.example&zone=74.177.10.in-addr.arpa&network=10.177.74.0/24", DefaultRendererOptions())
+	if err != nil {
+		t.Fatalf("Error parsing target: %v", err)
+	}
+	if err := UpdateDNSHost(context.Background(), c, "", scoped, goldenInput(t)); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+	if hosts := api.find("record:host", "name", "gone.ci.example"); len(hosts) != 0 {
+		t.Errorf("Expected the host record no longer published to be deleted, got %v", hosts)
+	}
+	hosts := api.find("record:host", "name", "ip-10-177-74-130.vlan1153.ci.example")
+	if len(hosts) != 1 || fmt.Sprint(hosts[0]["ipv4addrs"]) != "[map[ipv4addr:10.177.74.130]]" || fmt.Sprint(hosts[0]["extattrs"]) != "map[Owner:map[value:ptr-record-operator]]" {
+		t.Errorf("Expected an owned host record of 10.177.74.130, got %v", hosts)
+	}
+	for _, name := range []string{"api-int.ci.example", "gw.vlan1153.bcr01a.dal10"} {
+		if hosts := api.find("record:host", "name", name); len(hosts) != 0 {
+			t.Errorf("Expected no host record outside the zones and networks, got %v", hosts)
+		}
+	}
+	for addr, expected := range map[string]int{"10.177.74.130": 0, "10.177.74.131": 0, "10.177.74.129": 1, "10.177.74.201": 1, "10.0.0.130": 1} {
+		if ptrs := api.find("record:ptr", "ipv4addr", addr); len(ptrs) != expected {
+			t.Errorf("Expected %d PTR records of %s, got %v", expected, addr, ptrs)
+		}
+	}
+	writes = api.writes
+	if err := UpdateDNSHost(context.Background(), c, "", scoped, goldenInput(t)); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+	if api.writes != writes {
+		t.Errorf("Expected no writes once the objects match, got %d more", api.writes-writes)
+	}
+
+	secret.Data[InfobloxPassword] = []byte("wrong")
+	if err := c.Update(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateDNSHost(context.Background(), c, "", target, goldenInput(t)); err == nil || !strings.Contains(err.Error(), "Authorization Required") {
+		t.Errorf("Expected wrong credentials to fail, got %v", err)
+	}
+	for _, value := range []string{"infoblox://gm.example", "infoblox://gm.example?secret=dns/wapi&host=maybe", "infoblox://gm.example?secret=dns/wapi&version=2.12", "infoblox://gm.example?secret=dns/wapi&network=10.0.0.0", "infoblox://gm.example?secret=dns/wapi&zone=ci..example"} {
+		if _, err := ParseTarget(value, DefaultRendererOptions()); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
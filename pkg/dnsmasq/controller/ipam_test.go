@@ -0,0 +1,169 @@
+package controller
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/openshift-splat-team/vsphere-ci-dns/data"
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+	"github.com/pkg/errors"
+)
+
+func TestIPAMImports(t *testing.T) {
+	for _, test := range []struct {
+		file   string
+		parse  func([]byte) (data.Subnets, error)
+		failed []string
+	}{
+		{"lab.netbox.json", data.ParseNetBox, []string{"10.93.60.20/*", "10.93.62.0/24/*"}},
+		{"lab.phpipam.json", data.ParsePHPIPAM, []string{"2/*"}},
+	} {
+		t.Run(test.file, func(t *testing.T) {
+			content, err := os.ReadFile(filepath.Join("testdata", test.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			subnets, err := test.parse(content)
+			var subnetErrs data.SubnetErrors
+			if !errors.As(err, &subnetErrs) || len(subnetErrs) != len(test.failed) {
+				t.Fatalf("Expected %d invalid entries, got %v", len(test.failed), err)
+			}
+			for i, path := range test.failed {
+				if subnetErrs[i].Path() != path {
+					t.Errorf("Expected %s to be invalid, got %v", path, subnetErrs[i])
+				}
+			}
+
+			subnet, ok := subnets["dal10"]["1153"]
+			if !ok {
+				t.Fatalf("Expected dal10/1153 to be imported, got %v", subnets)
+			}
+			if subnet.Network != "10.93.60.0" || subnet.CIDR != 26 || subnet.Mask != "255.255.255.192" || !slices.Equal(subnet.IpAddresses, []string{"10.93.60.1", "10.93.60.10"}) {
+				t.Errorf("Unexpected IPv4 network %s/%d mask %s listing %v", subnet.Network, subnet.CIDR, subnet.Mask, subnet.IpAddresses)
+			}
+			if subnet.Ipv6prefix != "2001:db8:60::/64" || subnet.CidrIPv6 != 64 {
+				t.Errorf("Unexpected IPv6 prefix %s", subnet.Ipv6prefix)
+			}
+			if subnet.Gateway != "10.93.60.1" {
+				t.Errorf("Expected gateway 10.93.60.1, got %q", subnet.Gateway)
+			}
+			if len(subnet.Hostnames) != 3 || subnet.Hostnames["2001:db8:60::10"] != "api.ci.example.com" {
+				t.Errorf("Unexpected hostnames %v", subnet.Hostnames)
+			}
+
+			namer, err := NewNamer("ip-{{.Dashed}}.vlan{{.Vlan}}.{{.Datacenter}}")
+			if err != nil {
+				t.Fatalf("Error parsing template: %v", err)
+			}
+			out, err := parseRecordFile(test.file, string(content), record.SourceConfigMap, "ns/ipam/"+test.file, RecordOptions{Namer: namer, MaxCIDRAddresses: DefaultMaxCIDRAddresses})
+			if err == nil {
+				t.Error("Expected the invalid entries to be reported")
+			}
+			byAddr := map[netip.Addr]record.Record{}
+			for _, rec := range collectRecords(t, out) {
+				byAddr[rec.Addr] = rec
+			}
+			for addr, name := range map[string]string{
+				"10.93.60.1":      "gw.dal10.example.com",
+				"10.93.60.10":     "api.ci.example.com",
+				"2001:db8:60::10": "api.ci.example.com",
+			} {
+				if rec := byAddr[netip.MustParseAddr(addr)]; rec.Name() != name {
+					t.Errorf("Expected %s to be named %s, got %q", addr, name, rec.Name())
+				}
+			}
+			if rec := byAddr[netip.MustParseAddr("10.93.60.11")]; rec.Name() != "ip-10-93-60-11.vlan1153.dal10" {
+				t.Errorf("Expected unnamed addresses to follow the name template, got %q", rec.Name())
+			}
+			if want := "ns/ipam/" + test.file + ":dal10/1153"; byAddr[netip.MustParseAddr("10.93.60.10")].Source.Name != want {
+				t.Errorf("Expected source %s, got %v", want, byAddr[netip.MustParseAddr("10.93.60.10")].Source)
+			}
+		})
+	}
+}
+
+func TestNetBoxInvalidHostname(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("testdata", "lab.netbox.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	namer, err := NewNamer("ip-{{.Dashed}}.vlan{{.Vlan}}.{{.Datacenter}}")
+	if err != nil {
+		t.Fatalf("Error parsing template: %v", err)
+	}
+	out, err := parseRecordFile("lab.netbox.json", string(content), record.SourceFile, "lab.netbox.json", RecordOptions{Namer: namer, MaxCIDRAddresses: DefaultMaxCIDRAddresses})
+	records := collectRecords(t, out)
+	var subnetErrs data.SubnetErrors
+	if !errors.As(err, &subnetErrs) || len(subnetErrs) != 3 || subnetErrs[2].Path() != "wdc04/1154" {
+		t.Fatalf("Expected the invalid hostname of wdc04/1154 to be reported, got %v", err)
+	}
+	// 64 IPv4 and 1 IPv6 address in dal10/1153, 32 in wdc04/1154
+	if len(records) != 97 {
+		t.Fatalf("Expected 97 records, got %d", len(records))
+	}
+	for _, rec := range records {
+		if rec.Addr == netip.MustParseAddr("10.93.61.5") && rec.Name() != "ip-10-93-61-5.vlan1154.wdc04" {
+			t.Errorf("Expected the invalid hostname to fall back to the name template, got %q", rec.Name())
+		}
+	}
+}
+
+// collectRecords returns the records and the records of the streams of out.
+func collectRecords(t *testing.T, out SourceRecords) []record.Record {
+	records := out.Records
+	for _, stream := range out.Streams {
+		streamed, err := record.Collect(stream())
+		if err != nil {
+			t.Fatalf("Error expanding records: %v", err)
+		}
+		records = append(records, streamed...)
+	}
+	return records
+}
+
+func TestIPAMPrefixes(t *testing.T) {
+	export := `{
+		"prefixes": [
+			{"prefix": "10.96.0.0/16", "site": {"slug": "dal12"}, "vlan": {"vid": 1300}},
+			{"prefix": "10.97.0.0/12", "site": {"slug": "dal12"}, "vlan": {"vid": 1301}},
+			{"prefix": "2001:db8:70::/64", "site": {"slug": "dal12"}, "vlan": {"vid": 1302}}
+		],
+		"ip_addresses": [
+			{"address": "10.96.0.1/16", "dns_name": "gw.dal12.example.com", "tags": [{"slug": "gateway"}]},
+			{"address": "10.96.4.7/16", "dns_name": "registry.ci.example.com"},
+			{"address": "2001:db8:70::10/64", "dns_name": "mirror.ci.example.com"}
+		]
+	}`
+	subnets, err := data.ParseNetBox([]byte(export))
+	var subnetErrs data.SubnetErrors
+	if !errors.As(err, &subnetErrs) || len(subnetErrs) != 1 || subnetErrs[0].Path() != "dal12/1302" || !strings.Contains(subnetErrs[0].Error(), "no IPv4 prefix") {
+		t.Fatalf("Expected the IPv6-only prefix to be refused, got %v", err)
+	}
+	if listed := subnets["dal12"]["1300"].IpAddresses; !slices.Equal(listed, []string{"10.96.0.1", "10.96.4.7"}) {
+		t.Errorf("Expected only the gateway and named addresses to be listed, got %v", listed)
+	}
+
+	opts := RecordOptions{MaxCIDRAddresses: 1 << 16}
+	out, err := ipamRecords(subnets, nil, opts, func(datacenter, vlan string) record.Source {
+		return record.Source{Kind: record.SourceFile, Name: datacenter + "/" + vlan}
+	})
+	if !errors.As(err, &subnetErrs) || len(subnetErrs) != 1 || subnetErrs[0].Path() != "dal12/1301" {
+		t.Fatalf("Expected the network larger than --max-cidr-addresses to be reported, got %v", err)
+	}
+	if len(out.Records) != 0 || len(out.Streams) != 1 {
+		t.Fatalf("Expected the network to be expanded as a stream, got %d records and %d streams", len(out.Records), len(out.Streams))
+	}
+	records := collectRecords(t, out)
+	if len(records) != 1<<16 {
+		t.Errorf("Expected a record for every address of 10.96.0.0/16, got %d", len(records))
+	}
+	for _, rec := range records {
+		if rec.Addr == netip.MustParseAddr("10.96.4.7") && rec.Name() != "registry.ci.example.com" {
+			t.Errorf("Expected the named address to keep its name, got %q", rec.Name())
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"net/netip"
+
+	vcmv1 "github.com/openshift-splat-team/vsphere-capacity-manager/pkg/apis/vspherecapacitymanager.splat.io/v1"
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+)
+
+// DefaultMaxIPv6Range is the default upper bound on the number of addresses
+// expanded from a single IPv6 range. IPv6 subnets are usually a /64, which can
+// never be enumerated, so every range must be explicitly bounded.
+const DefaultMaxIPv6Range = 4096
+
+// ipv6RangeError reports an IPv6 range which is too large to expand.
+type ipv6RangeError struct {
+	start, stop netip.Addr
+	limit       uint64
+}
+
+func (e *ipv6RangeError) Error() string {
+	return fmt.Sprintf("IPv6 range %s-%s spans more than %d addresses", e.start, e.stop, e.limit)
+}
+
+// processIPv6Range returns ip6.arpa reverse records for every address from start
+// to stop inclusive. Ranges with more than opts.MaxIPv6Range addresses are
+// refused.
+func processIPv6Range(start, stop netip.Addr, data NameData, source record.Source, opts RecordOptions) ([]record.Record, error) {
+	if count := rangeSize(start, stop); count > opts.MaxIPv6Range {
+		return nil, &ipv6RangeError{start: start, stop: stop, limit: opts.MaxIPv6Range}
+	}
+
+	var ptrRecords []record.Record
+	for ip := start; ; ip = ip.Next() {
+		rec, err := formatRecord(ip, data, opts.Namer, source)
+		if err != nil {
+			return nil, err
+		}
+		ptrRecords = append(ptrRecords, rec)
+		if ip == stop {
+			break
+		}
+	}
+	return ptrRecords, nil
+}
+
+// processNetworkIPv6 returns ip6.arpa reverse records for a VCM network, named
+// from data. A network carries no stop address, so the range starts at
+// StartIPv6Address and spans as many addresses as the network has IPv4
+// addresses.
+func processNetworkIPv6(network *vcmv1.Network, data NameData, opts RecordOptions) ([]record.Record, error) {
+	spec := network.Spec
+	if spec.StartIPv6Address == "" {
+		return nil, nil
+	}
+	start, err := netip.ParseAddr(spec.StartIPv6Address)
+	if err != nil || !start.Is6() {
+		return nil, fmt.Errorf("invalid startIPv6Address %q", spec.StartIPv6Address)
+	}
+
+	count := uint64(len(spec.IpAddresses))
+	if spec.IpAddressCount != nil && *spec.IpAddressCount > 0 {
+		count = uint64(*spec.IpAddressCount)
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("unable to size IPv6 range starting at %s: network has no addresses", start)
+	}
+	if count > opts.MaxIPv6Range {
+		return nil, fmt.Errorf("IPv6 range starting at %s spans more than %d addresses", start, opts.MaxIPv6Range)
+	}
+	stop, ok := addrAdd(start, count-1)
+	if !ok {
+		return nil, fmt.Errorf("IPv6 range starting at %s overflows the address space", start)
+	}
+
+	if spec.IpV6prefix != "" {
+		prefix, err := netip.ParsePrefix(spec.IpV6prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ipv6prefix %q: %v", spec.IpV6prefix, err)
+		}
+		if !prefix.Contains(start) || !prefix.Contains(stop) {
+			return nil, fmt.Errorf("IPv6 range %s-%s is outside %s", start, stop, prefix.Masked())
+		}
+	}
+	return processIPv6Range(start, stop, data.withBase(start), networkSource(network), opts)
+}
+
+// rangeSize returns the number of addresses from start to stop inclusive,
+// saturating at math.MaxUint64.
+func rangeSize(start, stop netip.Addr) uint64 {
+	a, b := start.As16(), stop.As16()
+	size := new(big.Int).Sub(new(big.Int).SetBytes(b[:]), new(big.Int).SetBytes(a[:]))
+	size.Add(size, big.NewInt(1))
+	if !size.IsUint64() {
+		return math.MaxUint64
+	}
+	return size.Uint64()
+}
+
+// addrAdd returns addr+n, or false when the result leaves the address space.
+func addrAdd(addr netip.Addr, n uint64) (netip.Addr, bool) {
+	b := addr.As16()
+	sum := new(big.Int).Add(new(big.Int).SetBytes(b[:]), new(big.Int).SetUint64(n))
+	if sum.BitLen() > 128 {
+		return netip.Addr{}, false
+	}
+	sum.FillBytes(b[:])
+	return netip.AddrFrom16(b), true
+}
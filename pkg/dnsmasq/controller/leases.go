@@ -0,0 +1,95 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	vcmv1 "github.com/openshift-splat-team/vsphere-capacity-manager/pkg/apis/vspherecapacitymanager.splat.io/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// DefaultLeaseNameTemplate names the addresses of a leased network after the
+// CI job holding it, e.g. ci-op-abc123-node3.vlan1153.
+const DefaultLeaseNameTemplate = "{{.LeaseNamespace}}-node{{.Index}}.vlan{{.Vlan}}"
+
+// leaseActive returns true if lease currently holds its networks.
+func leaseActive(lease *vcmv1.Lease) bool {
+	return lease.DeletionTimestamp == nil && lease.Status.Phase == vcmv1.PHASE_FULFILLED
+}
+
+// networkLeases returns the active lease holding each network, keyed by the
+// network name. A network is held by the leases in its owner references.
+// Multi-tenant networks, going by their network-type label or by the lease,
+// are shared between CI jobs and are left out, as are networks held by more
+// than one active lease.
+func networkLeases(networks []vcmv1.Network, leases []vcmv1.Lease) map[string]*vcmv1.Lease {
+	byUID := map[types.UID]*vcmv1.Lease{}
+	byName := map[string]*vcmv1.Lease{}
+	for i := range leases {
+		lease := &leases[i]
+		if !leaseActive(lease) || lease.Spec.NetworkType == vcmv1.NetworkTypeMultiTenant {
+			continue
+		}
+		if lease.UID != "" {
+			byUID[lease.UID] = lease
+		}
+		byName[lease.Name] = lease
+	}
+
+	held := map[string]*vcmv1.Lease{}
+	for _, network := range networks {
+		if vcmv1.NetworkType(network.Labels[vcmv1.NetworkTypeLabel]) == vcmv1.NetworkTypeMultiTenant {
+			continue
+		}
+		var holders []*vcmv1.Lease
+		for _, owner := range network.OwnerReferences {
+			if owner.Kind != vcmv1.LeaseKind {
+				continue
+			}
+			lease, ok := byUID[owner.UID]
+			if !ok && owner.UID == "" {
+				lease, ok = byName[owner.Name]
+			}
+			if ok {
+				holders = append(holders, lease)
+			}
+		}
+		if len(holders) == 1 {
+			held[network.Name] = holders[0]
+		}
+	}
+	return held
+}
+
+// withLease returns a copy of d describing a network held by lease.
+func (d NameData) withLease(lease *vcmv1.Lease) NameData {
+	d.Lease = lease.Name
+	d.LeaseNamespace = lease.Labels[vcmv1.LeaseNamespace]
+	if d.LeaseNamespace == "" {
+		d.LeaseNamespace = lease.Name
+	}
+	return d
+}
+
+// configSecret maps any object to a reconcile of the vsphere-config secret,
+// which renders every record.
+func configSecret(context.Context, client.Object) []reconcile.Request {
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: "test-credentials", Name: "vsphere-config"}}}
+}
+
+// leaseNamer returns the namer of a network held by a lease, falling back to
+// fallback if the lease does not make valid hostnames, going by the name of
+// addr.
+func (s *NetworkSource) leaseNamer(data NameData, addr netip.Addr, fallback *Namer) (*Namer, error) {
+	sample, err := data.withAddr(addr)
+	if err == nil {
+		_, err = s.LeaseNamer.Name(sample)
+	}
+	if err != nil {
+		return fallback, fmt.Errorf("unable to name addresses after lease %s: %v", data.Lease, err)
+	}
+	return s.LeaseNamer, nil
+}
@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+
+	vcmv1 "github.com/openshift-splat-team/vsphere-capacity-manager/pkg/apis/vspherecapacitymanager.splat.io/v1"
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestNetworkLeases(t *testing.T) {
+	lease := func(name string, phase vcmv1.Phase, networkType vcmv1.NetworkType) vcmv1.Lease {
+		return vcmv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				UID:    types.UID("uid-" + name),
+				Labels: map[string]string{vcmv1.LeaseNamespace: "ci-op-" + name},
+			},
+			Spec:   vcmv1.LeaseSpec{NetworkType: networkType},
+			Status: vcmv1.LeaseStatus{Phase: phase},
+		}
+	}
+	leases := []vcmv1.Lease{
+		lease("abc123", vcmv1.PHASE_FULFILLED, vcmv1.NetworkTypeSingleTenant),
+		lease("def456", vcmv1.PHASE_PENDING, vcmv1.NetworkTypeSingleTenant),
+		lease("ghi789", vcmv1.PHASE_FULFILLED, vcmv1.NetworkTypeMultiTenant),
+	}
+	network := func(name, networkType string, owners ...vcmv1.Lease) vcmv1.Network {
+		n := vcmv1.Network{ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{vcmv1.NetworkTypeLabel: networkType},
+		}}
+		for _, owner := range owners {
+			n.OwnerReferences = append(n.OwnerReferences, metav1.OwnerReference{Kind: vcmv1.LeaseKind, Name: owner.Name, UID: owner.UID})
+		}
+		return n
+	}
+	networks := []vcmv1.Network{
+		network("ci-vlan-1153", "single-tenant", leases[0]),
+		network("ci-vlan-1154", "single-tenant", leases[1]),
+		network("ci-vlan-1155", "multi-tenant", leases[0]),
+		network("ci-vlan-1156", "single-tenant", leases[2]),
+		network("ci-vlan-1157", "single-tenant"),
+	}
+
+	held := networkLeases(networks, leases)
+	if len(held) != 1 || held["ci-vlan-1153"] == nil || held["ci-vlan-1153"].Name != "abc123" {
+		t.Fatalf("Expected only ci-vlan-1153 to be held by abc123, got %v", held)
+	}
+
+	for i := range networks {
+		networks[i].Namespace = "vcm"
+		networks[i].Spec = vcmv1.NetworkSpec{VlanId: strings.TrimPrefix(networks[i].Name, "ci-vlan-"), MachineNetworkCidr: fmt.Sprintf("10.93.%d.0/26", 60+i)}
+	}
+	leaseNamer, err := NewNamer(DefaultLeaseNameTemplate)
+	if err != nil {
+		t.Fatalf("Error parsing template: %v", err)
+	}
+	namer, err := NewNamer(DefaultNameTemplate)
+	if err != nil {
+		t.Fatalf("Error parsing template: %v", err)
+	}
+	source := &NetworkSource{Namespace: "vcm", LeaseNamer: leaseNamer}
+	env := SourceEnv{
+		Client:  &vcmClient{objectClient: newObjectClient(), networks: networks, leases: leases},
+		Options: RecordOptions{Namer: namer, MaxCIDRAddresses: DefaultMaxCIDRAddresses},
+	}
+	out, err := source.Records(context.TODO(), env)
+	if err != nil {
+		t.Fatalf("Error gathering records: %v", err)
+	}
+
+	// subnets.json names the leased and the free networks alike, and only
+	// the lease outranks it
+	var subnets []record.Record
+	for _, addr := range []string{"10.93.60.3", "10.93.64.3"} {
+		rec, err := record.New(netip.MustParseAddr(addr), record.Source{Kind: record.SourceSubnets}, "subnet-"+strings.ReplaceAll(addr, ".", "-"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		subnets = append(subnets, rec)
+	}
+	iters := []record.Iterator{record.FromSlice(subnets)}
+	for _, stream := range out.Streams {
+		iters = append(iters, stream())
+	}
+	records, err := record.Collect(record.Merge(record.DefaultPrecedence, nil, iters...))
+	if err != nil {
+		t.Fatalf("Error merging records: %v", err)
+	}
+	names := map[string]string{}
+	for _, rec := range records {
+		names[rec.Addr.String()] = rec.Name()
+	}
+	for addr, name := range map[string]string{
+		"10.93.60.3": "ci-op-abc123-node3.vlan1153",
+		"10.93.64.3": "subnet-10-93-64-3",
+		"10.93.61.3": "3.61.93.10.in-addr.arpa.",
+	} {
+		if names[addr] != name {
+			t.Errorf("Expected %s to be named %s, got %s", addr, name, names[addr])
+		}
+	}
+}
+
+// vcmClient lists the Networks and Leases it holds.
+type vcmClient struct {
+	*objectClient
+	networks []vcmv1.Network
+	leases   []vcmv1.Lease
+}
+
+func (c *vcmClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	switch list := list.(type) {
+	case *vcmv1.NetworkList:
+		list.Items = append(list.Items, c.networks...)
+	case *vcmv1.LeaseList:
+		list.Items = append(list.Items, c.leases...)
+	default:
+		return c.objectClient.List(ctx, list, opts...)
+	}
+	return nil
+}
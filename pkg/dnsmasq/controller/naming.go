@@ -0,0 +1,170 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/miekg/dns"
+	vcmv1 "github.com/openshift-splat-team/vsphere-capacity-manager/pkg/apis/vspherecapacitymanager.splat.io/v1"
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+)
+
+// DefaultNameTemplate names every address after its reverse lookup name.
+const DefaultNameTemplate = "{{.Arpa}}"
+
+var hostnameLabel = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// NameData is the data available to a hostname template.
+type NameData struct {
+	// IP is the address in its canonical text form.
+	IP string
+	// Dashed is the address with separators replaced by dashes. IPv6
+	// addresses are fully expanded so the result is always a valid label.
+	Dashed string
+	// Arpa is the reverse lookup name of the address.
+	Arpa string
+	// Datacenter is the subnets.json datacenter key, or the PodName of a VCM
+	// network.
+	Datacenter string
+	// Vlan is the subnets.json VLAN key, or the VlanId of a VCM network.
+	Vlan           string
+	Virtualcenter  string
+	PodName        string
+	DatacenterName string
+	PortGroupName  string
+	// Lease is the name of the vsphere-capacity-manager Lease holding the
+	// network, if any.
+	Lease string
+	// LeaseNamespace is the namespace of the CI job holding the lease, e.g.
+	// ci-op-abc123, or the lease name when it is not known.
+	LeaseNamespace string
+	// Index is the offset of the address from the start of its subnet, CIDR
+	// or IPv6 range.
+	Index uint64
+
+	// base is the address Index is counted from.
+	base netip.Addr
+}
+
+// Site returns the last label of Datacenter, e.g. dal10 for bcr01a.dal10.
+func (d NameData) Site() string {
+	return d.Datacenter[strings.LastIndex(d.Datacenter, ".")+1:]
+}
+
+// networkNameData returns the template data describing a VCM network.
+func networkNameData(network *vcmv1.Network) NameData {
+	data := NameData{
+		Vlan:          network.Spec.VlanId,
+		PortGroupName: network.Spec.PortGroupName,
+	}
+	if network.Spec.PodName != nil {
+		data.PodName = *network.Spec.PodName
+		data.Datacenter = data.PodName
+	}
+	if network.Spec.DatacenterName != nil {
+		data.DatacenterName = *network.Spec.DatacenterName
+	}
+	return data
+}
+
+// networkSource returns the record source of a VCM network.
+func networkSource(network *vcmv1.Network) record.Source {
+	return record.Source{Kind: record.SourceNetwork, Name: fmt.Sprintf("%s/%s", network.Namespace, network.Name)}
+}
+
+// withBase returns a copy of d counting Index from base.
+func (d NameData) withBase(base netip.Addr) NameData {
+	d.base = base
+	return d
+}
+
+// withAddr returns a copy of d describing addr.
+func (d NameData) withAddr(addr netip.Addr) (NameData, error) {
+	arpa, err := dns.ReverseAddr(addr.String())
+	if err != nil {
+		return d, fmt.Errorf("unable to reverse address: %v", err)
+	}
+	d.IP = addr.String()
+	d.Arpa = arpa
+	if d.base.IsValid() && d.base.BitLen() == addr.BitLen() && !addr.Less(d.base) {
+		d.Index = rangeSize(d.base, addr) - 1
+	}
+	if addr.Is4() {
+		d.Dashed = strings.ReplaceAll(d.IP, ".", "-")
+	} else {
+		d.Dashed = strings.ReplaceAll(addr.StringExpanded(), ":", "-")
+	}
+	return d, nil
+}
+
+// Namer renders the names PTR records point at.
+type Namer struct {
+	tmpl *template.Template
+}
+
+// NewNamer parses a hostname template, e.g.
+// `ip-{{.Dashed}}.vlan{{.Vlan}}.{{.Datacenter}}.ci.example.`, and checks that
+// it renders a valid hostname.
+func NewNamer(text string) (*Namer, error) {
+	tmpl, err := template.New("hostname").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse hostname template: %v", err)
+	}
+	namer := &Namer{tmpl: tmpl}
+
+	sample, err := NameData{
+		Datacenter:     "dc",
+		Vlan:           "1",
+		Virtualcenter:  "vcenter.example.com",
+		PodName:        "pod",
+		DatacenterName: "datacenter",
+		PortGroupName:  "portgroup",
+		Lease:          "lease",
+		LeaseNamespace: "ci-op-sample",
+	}.withAddr(netip.MustParseAddr("192.0.2.1"))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := namer.Name(sample); err != nil {
+		return nil, err
+	}
+	return namer, nil
+}
+
+// Name renders the hostname for data. A nil Namer uses the reverse lookup name.
+func (n *Namer) Name(data NameData) (string, error) {
+	if n == nil {
+		return data.Arpa, nil
+	}
+	var buf bytes.Buffer
+	if err := n.tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("unable to render hostname for %s: %v", data.IP, err)
+	}
+	name := buf.String()
+	if err := ValidateHostname(name); err != nil {
+		return "", fmt.Errorf("invalid hostname for %s: %v", data.IP, err)
+	}
+	return name, nil
+}
+
+// ValidateHostname checks that name is a valid RFC 1123 hostname. A trailing
+// dot marking the name as fully qualified is allowed.
+func ValidateHostname(name string) error {
+	trimmed := strings.TrimSuffix(name, ".")
+	if trimmed == "" {
+		return fmt.Errorf("hostname is empty")
+	}
+	if len(trimmed) > 253 {
+		return fmt.Errorf("hostname %q is longer than 253 characters", name)
+	}
+	for _, label := range strings.Split(trimmed, ".") {
+		if !hostnameLabel.MatchString(label) {
+			return fmt.Errorf("hostname %q has invalid label %q", name, label)
+		}
+	}
+	return nil
+}
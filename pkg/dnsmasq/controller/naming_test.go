@@ -0,0 +1,49 @@
+package controller
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+)
+
+func TestNameTemplate(t *testing.T) {
+	namer, err := NewNamer("ip-{{.Dashed}}.vlan{{.Vlan}}.{{.Datacenter}}.ci.example.")
+	if err != nil {
+		t.Fatalf("Error parsing template: %v", err)
+	}
+
+	tests := []struct {
+		addr     string
+		expected string
+	}{
+		{"10.177.74.130", "ip-10-177-74-130.vlan1153.bcr01a.dal10.ci.example."},
+		{"fd65:a1a8:60ad:1153::4", "ip-fd65-a1a8-60ad-1153-0000-0000-0000-0004.vlan1153.bcr01a.dal10.ci.example."},
+	}
+	for _, test := range tests {
+		rec, err := formatRecord(netip.MustParseAddr(test.addr), NameData{Datacenter: "bcr01a.dal10", Vlan: "1153"}, namer, record.Source{})
+		if err != nil {
+			t.Errorf("Error formatting %s: %v", test.addr, err)
+		}
+		if rec.Name() != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, rec.Name())
+		}
+	}
+
+	// an empty datacenter leaves an empty label
+	if _, err := formatRecord(netip.MustParseAddr("192.168.0.1"), NameData{Vlan: "1153"}, namer, record.Source{}); err == nil {
+		t.Errorf("Expected an invalid hostname error")
+	}
+}
+
+func TestNewNamerRejectsInvalidTemplates(t *testing.T) {
+	for _, text := range []string{
+		"{{.Unknown}}.example.",
+		"ip_{{.Dashed}}.example.",
+		"{{.Dashed",
+	} {
+		if _, err := NewNamer(text); err == nil {
+			t.Errorf("Expected %q to be rejected", text)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// PowerDNSAPIKey is the key of the Secret holding the API key of a
+	// powerdns target.
+	PowerDNSAPIKey = "api-key"
+	// PowerDNSAccount is the comment account marking the RRsets owned by the
+	// operator in PowerDNS zones.
+	PowerDNSAccount = "ptr-record-operator"
+
+	powerDNSComment = "managed by vsphere-ci-dns"
+)
+
+// powerDNSPublisher applies the records to the zones of a PowerDNS
+// Authoritative server through its HTTP API, creating the zones which do
+// not exist.
+//
+// The RRsets it writes carry a comment by PowerDNSAccount, and only those
+// are ever replaced or deleted: RRsets of the same name and type owned by
+// anyone else are left alone. Zones are selected as for rfc2136 targets,
+// except that without zone= every zone of the server is read, so that the
+// owned RRsets of zones no record falls in any more are deleted too.
+type powerDNSPublisher struct {
+	zoneSelector
+	// endpoint is the API URL of the server, e.g.
+	// http://10.0.0.53:8081/api/v1/servers/localhost.
+	endpoint    string
+	secret      types.NamespacedName
+	nameServers []string
+	client      *http.Client
+}
+
+// newPowerDNSPublisher returns the publisher of
+// powerdns://host[:port]?secret=namespace/name[&server=id][&tls=true][&zone=zone...].
+func newPowerDNSPublisher(u *url.URL, opts RendererOptions) (Publisher, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("expected powerdns://host[:port]")
+	}
+	host := u.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "8081")
+	}
+	query := u.Query()
+	namespace, name, ok := strings.Cut(query.Get("secret"), "/")
+	if !ok || namespace == "" || name == "" {
+		return nil, fmt.Errorf("expected the API key as secret=namespace/name")
+	}
+	scheme := "http"
+	if value := query.Get("tls"); value != "" {
+		tls, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls %q: %v", value, err)
+		}
+		if tls {
+			scheme = "https"
+		}
+	}
+	server := query.Get("server")
+	if server == "" {
+		server = "localhost"
+	}
+	zones, err := newZoneSelector(query, opts)
+	if err != nil {
+		return nil, err
+	}
+	nameServers := opts.Bind.NameServers
+	if len(nameServers) == 0 {
+		nameServers = []string{opts.Bind.PrimaryNS}
+	}
+	p := &powerDNSPublisher{
+		zoneSelector: zones,
+		endpoint:     fmt.Sprintf("%s://%s/api/v1/servers/%s", scheme, host, url.PathEscape(server)),
+		secret:       types.NamespacedName{Namespace: namespace, Name: name},
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}
+	for _, ns := range nameServers {
+		p.nameServers = append(p.nameServers, fqdn(ns))
+	}
+	return p, nil
+}
+
+// Format returns OutputHosts, as the records are published without any
+// dnsmasq configuration.
+func (p *powerDNSPublisher) Format() OutputFormat {
+	return OutputHosts
+}
+
+func (p *powerDNSPublisher) String() string {
+	return "powerdns://" + strings.TrimPrefix(strings.TrimPrefix(p.endpoint, "http://"), "https://")
+}
+
+// pdnsZone, pdnsRRset, pdnsRecord and pdnsComment are the objects of the
+// PowerDNS API.
+type pdnsZone struct {
+	Name        string      `json:"name"`
+	Kind        string      `json:"kind,omitempty"`
+	Nameservers []string    `json:"nameservers,omitempty"`
+	RRsets      []pdnsRRset `json:"rrsets,omitempty"`
+}
+
+type pdnsRRset struct {
+	Name       string        `json:"name"`
+	Type       string        `json:"type"`
+	TTL        uint32        `json:"ttl,omitempty"`
+	ChangeType string        `json:"changetype,omitempty"`
+	Records    []pdnsRecord  `json:"records,omitempty"`
+	Comments   []pdnsComment `json:"comments,omitempty"`
+}
+
+type pdnsRecord struct {
+	Content  string `json:"content"`
+	Disabled bool   `json:"disabled"`
+}
+
+type pdnsComment struct {
+	Content string `json:"content"`
+	Account string `json:"account"`
+}
+
+// owned returns true if the operator wrote the RRset.
+func (r pdnsRRset) owned() bool {
+	for _, comment := range r.Comments {
+		if comment.Account == PowerDNSAccount {
+			return true
+		}
+	}
+	return false
+}
+
+// content returns the enabled contents of the RRset, sorted.
+func (r pdnsRRset) content() []string {
+	var content []string
+	for _, record := range r.Records {
+		if !record.Disabled {
+			content = append(content, strings.ToLower(record.Content))
+		}
+	}
+	sort.Strings(content)
+	return content
+}
+
+// Publish updates every zone, carrying on past zones which fail.
+func (p *powerDNSPublisher) Publish(ctx context.Context, c client.Client, in RenderInput) error {
+	logr := log.FromContext(ctx)
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, p.secret, secret); err != nil {
+		return fmt.Errorf("unable to read API key from %s: %v", p.secret, err)
+	}
+	apiKey := strings.TrimSpace(string(secret.Data[PowerDNSAPIKey]))
+	if apiKey == "" {
+		return fmt.Errorf("%s must hold the %s of the PowerDNS API", p.secret, PowerDNSAPIKey)
+	}
+	desired, skipped, err := p.desired(in)
+	if err != nil {
+		return err
+	}
+	if skipped > 0 {
+		logr.Info("records outside the zones of the target are not published", "target", p.String(), "records", skipped)
+	}
+	var errs []error
+	zones := p.managed(desired)
+	if p.zones == nil {
+		listed, err := p.listZones(ctx, apiKey)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to list zones: %v", err))
+		}
+		for _, zone := range listed {
+			if _, ok := desired[zone]; !ok {
+				zones = append(zones, zone)
+			}
+		}
+		sort.Strings(zones)
+	}
+	for _, zone := range zones {
+		existing, err := p.zone(ctx, apiKey, zone)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to read %s: %v", zone, err))
+			continue
+		}
+		if existing == nil {
+			if err := p.call(ctx, apiKey, http.MethodPost, "/zones", pdnsZone{Name: zone, Kind: "Native", Nameservers: p.nameServers}, nil); err != nil {
+				errs = append(errs, fmt.Errorf("unable to create %s: %v", zone, err))
+				continue
+			}
+			logr.Info("created zone", "target", p.String(), "zone", zone)
+			existing = &pdnsZone{Name: zone}
+		}
+		changes, conflicts := p.diff(desired[zone], existing.RRsets)
+		if conflicts > 0 {
+			logr.Info("RRsets owned by others are not replaced", "target", p.String(), "zone", zone, "rrsets", conflicts)
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		if err := p.call(ctx, apiKey, http.MethodPatch, "/zones/"+url.PathEscape(zone), pdnsZone{Name: zone, RRsets: changes}, nil); err != nil {
+			errs = append(errs, fmt.Errorf("unable to update %s: %v", zone, err))
+			continue
+		}
+		logr.Info("updated zone", "target", p.String(), "zone", zone, "rrsets", len(changes))
+	}
+	return errors.Join(errs...)
+}
+
+// listZones returns the names of the zones of the server.
+func (p *powerDNSPublisher) listZones(ctx context.Context, apiKey string) ([]string, error) {
+	var listed []pdnsZone
+	if err := p.call(ctx, apiKey, http.MethodGet, "/zones", nil, &listed); err != nil {
+		return nil, err
+	}
+	zones := make([]string, 0, len(listed))
+	for _, zone := range listed {
+		zones = append(zones, dns.CanonicalName(zone.Name))
+	}
+	return zones, nil
+}
+
+// zone returns the zone, or nil if the server has no such zone.
+func (p *powerDNSPublisher) zone(ctx context.Context, apiKey, zone string) (*pdnsZone, error) {
+	existing := &pdnsZone{}
+	err := p.call(ctx, apiKey, http.MethodGet, "/zones/"+url.PathEscape(zone), nil, existing)
+	var status pdnsError
+	if errors.As(err, &status) && (status.code == http.StatusNotFound || status.code == http.StatusUnprocessableEntity) {
+		return nil, nil
+	}
+	return existing, err
+}
+
+// diff returns the changes turning the owned RRsets of existing into
+// desired, in name order, and the number of desired RRsets left alone as
+// someone else owns them.
+func (p *powerDNSPublisher) diff(desired map[rrsetKey][]dns.RR, existing []pdnsRRset) ([]pdnsRRset, int) {
+	have := map[rrsetKey]pdnsRRset{}
+	for _, rrset := range existing {
+		have[rrsetKey{name: dns.CanonicalName(rrset.Name), rrtype: dns.StringToType[rrset.Type]}] = rrset
+	}
+	var changes []pdnsRRset
+	conflicts := 0
+	for key, rrs := range desired {
+		rrset := pdnsRRset{Name: key.name, Type: dns.TypeToString[key.rrtype], TTL: rrs[0].Header().Ttl, ChangeType: "REPLACE"}
+		for _, rr := range rrs {
+			rrset.Records = append(rrset.Records, pdnsRecord{Content: rdata(rr)})
+		}
+		sort.Slice(rrset.Records, func(i, j int) bool { return rrset.Records[i].Content < rrset.Records[j].Content })
+		if current, ok := have[key]; ok {
+			if slices.Equal(current.content(), rrset.content()) && current.TTL == rrset.TTL {
+				continue
+			}
+			if !current.owned() {
+				conflicts++
+				continue
+			}
+		}
+		rrset.Comments = []pdnsComment{{Content: powerDNSComment, Account: PowerDNSAccount}}
+		changes = append(changes, rrset)
+	}
+	for key, current := range have {
+		if _, ok := desired[key]; !ok && current.owned() {
+			changes = append(changes, pdnsRRset{Name: key.name, Type: current.Type, ChangeType: "DELETE"})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Name != changes[j].Name {
+			return changes[i].Name < changes[j].Name
+		}
+		return changes[i].Type < changes[j].Type
+	})
+	return changes, conflicts
+}
+
+// pdnsError is an API call answered with an error status.
+type pdnsError struct {
+	code    int
+	message string
+}
+
+func (e pdnsError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("server answered %d %s", e.code, http.StatusText(e.code))
+	}
+	return fmt.Sprintf("server answered %d: %s", e.code, e.message)
+}
+
+// call sends body as JSON to the API path and decodes the answer into out,
+// unless it is nil.
+func (p *powerDNSPublisher) call(ctx context.Context, apiKey, method, path string, body, out interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.endpoint+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-Key", apiKey)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		answer := struct {
+			Error string `json:"error"`
+		}{}
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&answer)
+		return pdnsError{code: resp.StatusCode, message: answer.Error}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,221 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// testPowerDNS stands in for the zones API of a PowerDNS server, applying
+// REPLACE and DELETE changes to the zones it holds.
+type testPowerDNS struct {
+	mu      sync.Mutex
+	zones   map[string]*pdnsZone
+	patches int
+}
+
+func (s *testPowerDNS) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/servers/localhost/zones", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		zones := []pdnsZone{}
+		for name := range s.zones {
+			zones = append(zones, pdnsZone{Name: name, Kind: "Native"})
+		}
+		_ = json.NewEncoder(w).Encode(zones)
+	})
+	mux.HandleFunc("GET /api/v1/servers/localhost/zones/{zone}", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		zone, ok := s.zones[r.PathValue("zone")]
+		if !ok {
+			http.Error(w, `{"error": "Could not find domain"}`, http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(zone)
+	})
+	mux.HandleFunc("POST /api/v1/servers/localhost/zones", func(w http.ResponseWriter, r *http.Request) {
+		zone := &pdnsZone{}
+		if err := json.NewDecoder(r.Body).Decode(zone); err != nil || zone.Kind != "Native" || len(zone.Nameservers) == 0 {
+			http.Error(w, `{"error": "invalid zone"}`, http.StatusUnprocessableEntity)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.zones[zone.Name] = zone
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(zone)
+	})
+	mux.HandleFunc("PATCH /api/v1/servers/localhost/zones/{zone}", func(w http.ResponseWriter, r *http.Request) {
+		patch := &pdnsZone{}
+		if err := json.NewDecoder(r.Body).Decode(patch); err != nil {
+			http.Error(w, `{"error": "invalid patch"}`, http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		zone, ok := s.zones[r.PathValue("zone")]
+		if !ok {
+			http.Error(w, `{"error": "Could not find domain"}`, http.StatusNotFound)
+			return
+		}
+		s.patches++
+		for _, change := range patch.RRsets {
+			var kept []pdnsRRset
+			for _, rrset := range zone.RRsets {
+				if rrset.Name != change.Name || rrset.Type != change.Type {
+					kept = append(kept, rrset)
+				}
+			}
+			if change.ChangeType == "REPLACE" {
+				change.ChangeType = ""
+				kept = append(kept, change)
+			}
+			zone.RRsets = kept
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "pdns-key" {
+			http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// rrset returns the content of the RRset, and whether the operator owns it.
+func (s *testPowerDNS) rrset(zone, name, rrtype string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.zones[zone] == nil {
+		return "", false
+	}
+	for _, rrset := range s.zones[zone].RRsets {
+		if rrset.Name == name && rrset.Type == rrtype {
+			return strings.Join(rrset.content(), " "), rrset.owned()
+		}
+	}
+	return "", false
+}
+
+func TestPowerDNSPublisher(t *testing.T) {
+	owned := []pdnsComment{{Content: powerDNSComment, Account: PowerDNSAccount}}
+	api := &testPowerDNS{zones: map[string]*pdnsZone{
+		"74.177.10.in-addr.arpa.": {Name: "74.177.10.in-addr.arpa.", RRsets: []pdnsRRset{
+			{Name: "74.177.10.in-addr.arpa.", Type: "SOA", TTL: 3600, Records: []pdnsRecord{{Content: "ns1.ci.example. hostmaster.ci.example. 1 3600 900 604800 300"}}},
+			{Name: "130.74.177.10.in-addr.arpa.", Type: "PTR", TTL: 3600, Records: []pdnsRecord{{Content: "stale.ci.example."}}, Comments: owned},
+			{Name: "131.74.177.10.in-addr.arpa.", Type: "PTR", TTL: 3600, Records: []pdnsRecord{{Content: "manual.ci.example."}}},
+			{Name: "200.74.177.10.in-addr.arpa.", Type: "PTR", TTL: 3600, Records: []pdnsRecord{{Content: "gone.ci.example."}}, Comments: owned},
+			{Name: "201.74.177.10.in-addr.arpa.", Type: "PTR", TTL: 3600, Records: []pdnsRecord{{Content: "printer.ci.example."}}},
+		}},
+	}}
+	server := httptest.NewServer(api.handler())
+	defer server.Close()
+
+	c := newObjectClient()
+	secret := &corev1.Secret{Data: map[string][]byte{PowerDNSAPIKey: []byte("pdns-key\n")}}
+	secret.Namespace, secret.Name = "dns", "pdns"
+	if err := c.Create(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	target, err := ParseTarget("powerdns://"+strings.TrimPrefix(server.URL, "http://")+"?secret=dns/pdns&zone=74.177.10.in-addr.arpa&zone=ci.example", DefaultRendererOptions())
+	if err != nil {
+		t.Fatalf("Error parsing target: %v", err)
+	}
+	if err := UpdateDNSHost(context.Background(), c, "", target, goldenInput(t)); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+
+	for _, expected := range []struct {
+		zone, name, rrtype, content string
+		owned                       bool
+	}{
+		{"74.177.10.in-addr.arpa.", "130.74.177.10.in-addr.arpa.", "PTR", "ip-10-177-74-130.vlan1153.ci.example.", true},
+		{"74.177.10.in-addr.arpa.", "129.74.177.10.in-addr.arpa.", "PTR", "gw.vlan1153.bcr01a.dal10.", true},
+		{"74.177.10.in-addr.arpa.", "131.74.177.10.in-addr.arpa.", "PTR", "manual.ci.example.", false},
+		{"74.177.10.in-addr.arpa.", "201.74.177.10.in-addr.arpa.", "PTR", "printer.ci.example.", false},
+		{"74.177.10.in-addr.arpa.", "200.74.177.10.in-addr.arpa.", "PTR", "", false},
+		{"ci.example.", "api-int.ci.example.", "A", "192.168.10.5", true},
+	} {
+		content, owned := api.rrset(expected.zone, expected.name, expected.rrtype)
+		if content != expected.content || owned != expected.owned {
+			t.Errorf("Expected %s %s %q owned %t, got %q owned %t", expected.name, expected.rrtype, expected.content, expected.owned, content, owned)
+		}
+	}
+
+	patches := api.patches
+	if err := UpdateDNSHost(context.Background(), c, "", target, goldenInput(t)); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+	if api.patches != patches {
+		t.Errorf("Expected no PATCH once the zones match, got %d more", api.patches-patches)
+	}
+
+	secret.Data[PowerDNSAPIKey] = []byte("wrong")
+	if err := c.Update(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateDNSHost(context.Background(), c, "", target, goldenInput(t)); err == nil || !strings.Contains(err.Error(), "Unauthorized") {
+		t.Errorf("Expected a wrong API key to fail, got %v", err)
+	}
+	for _, value := range []string{"powerdns://10.0.0.53", "powerdns://10.0.0.53?secret=dns/pdns&tls=maybe"} {
+		if _, err := ParseTarget(value, DefaultRendererOptions()); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestPowerDNSPublisherReverseZones(t *testing.T) {
+	owned := []pdnsComment{{Content: powerDNSComment, Account: PowerDNSAccount}}
+	api := &testPowerDNS{zones: map[string]*pdnsZone{
+		"9.9.10.in-addr.arpa.": {Name: "9.9.10.in-addr.arpa.", RRsets: []pdnsRRset{
+			{Name: "5.9.9.10.in-addr.arpa.", Type: "PTR", TTL: 3600, Records: []pdnsRecord{{Content: "gone.ci.example."}}, Comments: owned},
+			{Name: "6.9.9.10.in-addr.arpa.", Type: "PTR", TTL: 3600, Records: []pdnsRecord{{Content: "manual.ci.example."}}},
+		}},
+	}}
+	server := httptest.NewServer(api.handler())
+	defer server.Close()
+
+	c := newObjectClient()
+	secret := &corev1.Secret{Data: map[string][]byte{PowerDNSAPIKey: []byte("pdns-key")}}
+	secret.Namespace, secret.Name = "dns", "pdns"
+	if err := c.Create(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	target, err := ParseTarget("powerdns://"+strings.TrimPrefix(server.URL, "http://")+"?secret=dns/pdns", DefaultRendererOptions())
+	if err != nil {
+		t.Fatalf("Error parsing target: %v", err)
+	}
+	rec, err := record.New(netip.MustParseAddr("10.177.74.130"), record.Source{Kind: record.SourceFile}, "bastion.ci.example.")
+	if err != nil {
+		t.Fatalf("Error creating record: %v", err)
+	}
+	in := RenderInput{Records: func() record.Iterator { return record.FromSlice([]record.Record{rec}) }}
+	if err := UpdateDNSHost(context.Background(), c, "", target, in); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+
+	for _, expected := range []struct {
+		zone, name, content string
+		owned               bool
+	}{
+		{"74.177.10.in-addr.arpa.", "130.74.177.10.in-addr.arpa.", "bastion.ci.example.", true},
+		{"9.9.10.in-addr.arpa.", "5.9.9.10.in-addr.arpa.", "", false},
+		{"9.9.10.in-addr.arpa.", "6.9.9.10.in-addr.arpa.", "manual.ci.example.", false},
+	} {
+		content, owned := api.rrset(expected.zone, expected.name, "PTR")
+		if content != expected.content || owned != expected.owned {
+			t.Errorf("Expected %s PTR %q owned %t, got %q owned %t", expected.name, expected.content, expected.owned, content, owned)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+)
+
+// DnsmasqConfig is the dnsmasq configuration rendered ahead of the records
+// by OutputDnsmasq.
+type DnsmasqConfig struct {
+	Synths []SynthDomain
+	DHCP   []DHCPRange
+}
+
+// writeAdditionalHosts writes the hosts file format read by dnsmasq from
+// /opt/ci-dns/additional-hosts. dnsmasq answers both forward and reverse
+// queries from a hosts file, whatever the publish mode of the records.
+func writeAdditionalHosts(w io.Writer, it record.Iterator) error {
+	bw := bufio.NewWriter(w)
+	for rec, ok := it.Next(); ok; rec, ok = it.Next() {
+		if _, err := fmt.Fprintf(bw, "%s %s\n", rec.Addr, strings.Join(rec.Names, " ")); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// writeRecords writes the directives of every record not covered by synths:
+// a ptr-record for reverse records, preceded by a cname from the parent zone
+// when they are delegated to an RFC 2317 child zone, and a host-record for
+// forward records. dnsmasq derives a PTR record in the parent zone from every
+// host-record, so records published both ways only need the ptr-record of
+// the child zone when delegated, and must not get the cname, which cannot
+// share its name with the PTR record.
+func writeRecords(w io.Writer, synths []SynthDomain, it record.Iterator) error {
+	bw := bufio.NewWriter(w)
+	for rec, ok := it.Next(); ok; rec, ok = it.Next() {
+		if covered(rec, synths) {
+			continue
+		}
+		if rec.Publish.Forward() {
+			if _, err := fmt.Fprintf(bw, "host-record=%s,%s\n", strings.Join(rec.Names, ","), rec.Addr); err != nil {
+				return err
+			}
+			if rec.Delegation == "" {
+				continue
+			}
+		}
+		if !rec.Publish.Reverse() {
+			continue
+		}
+		if rec.Delegation != "" && !rec.Publish.Forward() {
+			if _, err := fmt.Fprintf(bw, "cname=%s,%s\n", rec.Reverse, rec.Owner()); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(bw, "ptr-record=%s,%s\n", rec.Owner(), rec.Name()); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func writeDnsmasq(w io.Writer, config DnsmasqConfig, it record.Iterator) error {
+	for _, synth := range config.Synths {
+		if _, err := fmt.Fprintln(w, synth.Directive()); err != nil {
+			return err
+		}
+	}
+	if err := writeDHCPRanges(w, config.DHCP); err != nil {
+		return err
+	}
+	return writeRecords(w, config.Synths, it)
+}
@@ -0,0 +1,168 @@
+package controller
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+)
+
+// OutputFormat selects the format of the file pushed to the DNS server.
+type OutputFormat string
+
+const (
+	// OutputHosts writes a hosts file, loaded by dnsmasq with addn-hosts.
+	OutputHosts OutputFormat = "hosts"
+	// OutputDnsmasq writes dnsmasq configuration directives, loaded by dnsmasq
+	// with conf-file.
+	OutputDnsmasq OutputFormat = "dnsmasq"
+	// OutputBind writes an archive of BIND zone files, one per reverse zone.
+	OutputBind OutputFormat = "bind"
+	// OutputUnbound writes an unbound server clause of local-zone and
+	// local-data entries.
+	OutputUnbound OutputFormat = "unbound"
+)
+
+// ParseOutputFormat validates an output format name.
+func ParseOutputFormat(name string) (OutputFormat, error) {
+	switch format := OutputFormat(name); format {
+	case OutputHosts, OutputDnsmasq, OutputBind, OutputUnbound:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown output format %q", name)
+}
+
+// RenderInput is everything a Renderer draws on.
+type RenderInput struct {
+	// Records returns a new iterator over the published records, in address
+	// order, on each call.
+	Records func() record.Iterator
+	// Dnsmasq configures dnsmasq itself. Other formats ignore it.
+	Dnsmasq DnsmasqConfig
+	// MaxRecords bounds the records read by the targets which hold all of
+	// them in memory, zero leaving them unbounded. hosts, dnsmasq and
+	// unbound files are written as the records are read; bind files,
+	// unbound local_datas, and the coredns, rfc2136, powerdns and infoblox
+	// targets first collect every record.
+	MaxRecords uint64
+}
+
+// buffered returns a new iterator over the records for a target holding all
+// of them in memory, failing past MaxRecords.
+func (in RenderInput) buffered() record.Iterator {
+	if in.MaxRecords == 0 {
+		return in.Records()
+	}
+	return record.Limit(in.Records(), in.MaxRecords)
+}
+
+// Renderer turns the published records into the file pushed to a DNS server.
+// The file is rendered more than once, first to size it, so Render must
+// produce the same bytes for the same input.
+type Renderer interface {
+	Format() OutputFormat
+	Render(w io.Writer, in RenderInput) error
+}
+
+// RendererOptions configures the renderers of the formats that take options.
+type RendererOptions struct {
+	Bind    BindOptions
+	Unbound UnboundOptions
+}
+
+// DefaultRendererOptions returns the defaults of every format.
+func DefaultRendererOptions() RendererOptions {
+	return RendererOptions{Bind: DefaultBindOptions(), Unbound: DefaultUnboundOptions()}
+}
+
+// NewRenderer returns the renderer of format.
+func NewRenderer(format OutputFormat, opts RendererOptions) (Renderer, error) {
+	switch format {
+	case OutputHosts:
+		return hostsRenderer{}, nil
+	case OutputDnsmasq:
+		return dnsmasqRenderer{}, nil
+	case OutputBind:
+		if err := opts.Bind.Validate(); err != nil {
+			return nil, err
+		}
+		return newBindRenderer(opts.Bind), nil
+	case OutputUnbound:
+		if err := opts.Unbound.Validate(); err != nil {
+			return nil, err
+		}
+		return newUnboundRenderer(opts.Unbound), nil
+	}
+	return nil, fmt.Errorf("unknown output format %q", format)
+}
+
+// targetDefaulter is implemented by renderers whose files are not written to
+// DefaultTargetPath and loaded by DefaultReloadCommand.
+type targetDefaulter interface {
+	defaultPath() string
+	reloadCommand(path string) string
+}
+
+// incrementalRenderer is implemented by renderers able to load their changes
+// into the DNS server without a full reload.
+type incrementalRenderer interface {
+	// changes returns the commands loading in since the last commit, or nil
+	// to reload the server in full, and commit, which records in as loaded
+	// once the file is written and the commands succeed.
+	changes(in RenderInput) (cmds []reloadCommand, commit func(), err error)
+}
+
+// writeHeader marks the file as generated, in a comment starting with
+// comment.
+func writeHeader(w io.Writer, format OutputFormat, comment string) error {
+	_, err := fmt.Fprintf(w, "%[1]s Generated by vsphere-ci-dns as %[2]s output from test-credentials/vsphere-config.\n%[1]s Do not edit: changes are overwritten on the next reconcile.\n", comment, format)
+	return err
+}
+
+// hostsRenderer writes a hosts file. It publishes every record both forward
+// and reverse, and ignores the dnsmasq configuration.
+type hostsRenderer struct{}
+
+func (hostsRenderer) Format() OutputFormat {
+	return OutputHosts
+}
+
+func (hostsRenderer) Render(w io.Writer, in RenderInput) error {
+	if err := writeHeader(w, OutputHosts, "#"); err != nil {
+		return err
+	}
+	return writeAdditionalHosts(w, in.Records())
+}
+
+// dnsmasqRenderer writes dnsmasq configuration: synth-domain and DHCP
+// directives followed by a ptr-record and, for forward records, a
+// host-record per record.
+type dnsmasqRenderer struct{}
+
+func (dnsmasqRenderer) Format() OutputFormat {
+	return OutputDnsmasq
+}
+
+func (dnsmasqRenderer) Render(w io.Writer, in RenderInput) error {
+	if err := writeHeader(w, OutputDnsmasq, "#"); err != nil {
+		return err
+	}
+	config := in.Dnsmasq
+	config.Synths = sortedSynths(config.Synths)
+	return writeDnsmasq(w, config, in.Records())
+}
+
+// sortedSynths returns a copy of synths in address order, as synth-domains
+// are gathered in source order.
+func sortedSynths(synths []SynthDomain) []SynthDomain {
+	synths = append([]SynthDomain(nil), synths...)
+	sort.SliceStable(synths, func(i, j int) bool {
+		a, b := synths[i].Prefix, synths[j].Prefix
+		if a.Addr() != b.Addr() {
+			return a.Addr().Less(b.Addr())
+		}
+		return a.Bits() < b.Bits()
+	})
+	return synths
+}
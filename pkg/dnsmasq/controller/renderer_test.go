@@ -0,0 +1,177 @@
+package controller
+
+import (
+	"bytes"
+	"flag"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/openshift-splat-team/vsphere-ci-dns/data"
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of renderer tests")
+
+const goldenSubnets = `{
+    "version": 2,
+    "subnets": {
+        "bcr01a.dal10": {
+            "1153": {
+                "cidr": 29,
+                "network": "10.177.74.128",
+                "mask": "255.255.255.248",
+                "gateway": "10.177.74.129",
+                "dnsServer": "10.177.74.129",
+                "ipAddresses": ["10.177.74.128", "10.177.74.129", "10.177.74.130", "10.177.74.131", "10.177.74.132", "10.177.74.133", "10.177.74.134", "10.177.74.135"],
+                "ipv6prefix": "fd65:a1a8:60ad:1153::/64",
+                "startIPv6Address": "fd65:a1a8:60ad:1153::10",
+                "stopIPv6Address": "fd65:a1a8:60ad:1153::11",
+                "dhcpEndLocation": 6
+            }
+        }
+    }
+}`
+
+// goldenInput returns the records and dnsmasq configuration rendered by the
+// golden files: a classless subnet published both ways, with a DHCP pool and
+// IPv6 range, static forward records, a classless reverse record and two
+// synth-domains.
+func goldenInput(t *testing.T) RenderInput {
+	namer, err := NewNamer("ip-{{.Dashed}}.vlan{{.Vlan}}.ci.example.")
+	if err != nil {
+		t.Fatalf("Error parsing template: %v", err)
+	}
+	reservations, err := ParseReservations(DefaultReservations)
+	if err != nil {
+		t.Fatalf("Error parsing reservations: %v", err)
+	}
+	opts := RecordOptions{Namer: namer, MaxIPv6Range: DefaultMaxIPv6Range, Reservations: reservations, Classless: true}
+	records, err := parseSubnets(goldenSubnets, opts, subnetsSource)
+	if err != nil {
+		t.Fatalf("Error parsing subnets: %v", err)
+	}
+	static, err := parseHosts("192.168.10.5 api.ci.example. api-int.ci.example.\n192.168.10.6 bastion.ci.example.\n", record.Source{Kind: record.SourceFile})
+	if err != nil {
+		t.Fatalf("Error parsing hosts: %v", err)
+	}
+	modes, err := ParsePublishModes(map[string]string{"subnets": "both", "file": "forward"})
+	if err != nil {
+		t.Fatalf("Error parsing publish modes: %v", err)
+	}
+	delegated, err := record.New(netip.MustParseAddr("10.0.0.130"), record.Source{Kind: record.SourceCIDR}, "ip-10-0-0-130.ci.example.")
+	if err != nil {
+		t.Fatalf("Error creating record: %v", err)
+	}
+	static = append(static, delegated.Delegate(netip.MustParsePrefix("10.0.0.128/26")))
+	set := record.NewSet(record.DefaultPrecedence)
+	for _, rec := range append(records, static...) {
+		set.Add(modes.Apply(rec))
+	}
+	published, err := record.Collect(record.Published(record.FromSlice(set.Records())))
+	if err != nil {
+		t.Fatalf("Error publishing records: %v", err)
+	}
+
+	subnets, err := data.ParseSubnets([]byte(goldenSubnets))
+	ranges, err := subnetDHCPRanges(subnets, err, DHCPOptions{})
+	if err != nil {
+		t.Fatalf("Error generating DHCP ranges: %v", err)
+	}
+	var synths []SynthDomain
+	for _, cidr := range []string{"192.168.20.0/24", "192.168.0.0/24"} {
+		synth, err := NewSynthDomain("ci.example", cidr, "ip-")
+		if err != nil {
+			t.Fatalf("Error creating synth-domain: %v", err)
+		}
+		synths = append(synths, synth)
+	}
+	return RenderInput{
+		Records: func() record.Iterator { return record.FromSlice(published) },
+		Dnsmasq: DnsmasqConfig{Synths: synths, DHCP: ranges},
+	}
+}
+
+// render renders records, and config, in format, without the header.
+func render(t *testing.T, format OutputFormat, config DnsmasqConfig, records []record.Record) string {
+	t.Helper()
+	renderer, err := NewRenderer(format, DefaultRendererOptions())
+	if err != nil {
+		t.Fatalf("Error creating renderer: %v", err)
+	}
+	var out bytes.Buffer
+	in := RenderInput{Records: func() record.Iterator { return record.FromSlice(records) }, Dnsmasq: config}
+	if err := renderer.Render(&out, in); err != nil {
+		t.Fatalf("Error rendering: %v", err)
+	}
+	var header bytes.Buffer
+	if err := writeHeader(&header, format, "#"); err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimPrefix(out.String(), header.String())
+}
+
+func TestRenderers(t *testing.T) {
+	for _, format := range []OutputFormat{OutputHosts, OutputDnsmasq, OutputUnbound} {
+		t.Run(string(format), func(t *testing.T) {
+			renderer, err := NewRenderer(format, DefaultRendererOptions())
+			if err != nil {
+				t.Fatalf("Error creating renderer: %v", err)
+			}
+			in := goldenInput(t)
+			var first, second bytes.Buffer
+			if err := renderer.Render(&first, in); err != nil {
+				t.Fatalf("Error rendering: %v", err)
+			}
+			// the synth-domains are reversed, as sources may gather them in
+			// any order
+			in.Dnsmasq.Synths[0], in.Dnsmasq.Synths[1] = in.Dnsmasq.Synths[1], in.Dnsmasq.Synths[0]
+			if err := renderer.Render(&second, in); err != nil {
+				t.Fatalf("Error rendering: %v", err)
+			}
+			if !bytes.Equal(first.Bytes(), second.Bytes()) {
+				t.Errorf("Expected the same output for the same records, got\n%s\nthen\n%s", first.String(), second.String())
+			}
+
+			golden := filepath.Join("testdata", "golden."+string(format))
+			if *update {
+				if err := os.WriteFile(golden, first.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("Error reading golden file, rerun with -update to create it: %v", err)
+			}
+			if !bytes.Equal(first.Bytes(), expected) {
+				t.Errorf("Output differs from %s, rerun with -update to accept it:\n%s", golden, first.String())
+			}
+		})
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	target, err := ParseTarget("10.0.0.53=dnsmasq:/etc/dnsmasq.d/ci.conf", DefaultRendererOptions())
+	if err != nil {
+		t.Fatalf("Error parsing target: %v", err)
+	}
+	if target.Server != "10.0.0.53" || target.Renderer.Format() != OutputDnsmasq || target.Path != "/etc/dnsmasq.d/ci.conf" || target.Reload != DefaultReloadCommand {
+		t.Errorf("Unexpected target %+v", target)
+	}
+	if target, err = ParseTarget("ns1.example=hosts", DefaultRendererOptions()); err != nil || target.Path != DefaultTargetPath {
+		t.Errorf("Expected the default path, got %+v, %v", target, err)
+	}
+	if target, err = ParseTarget("ns1.example=bind", DefaultRendererOptions()); err != nil || target.Path != DefaultBindZoneDir+".tar" || !strings.Contains(target.Reload, "rndc reload") {
+		t.Errorf("Expected the bind archive to be extracted and reloaded, got %+v, %v", target, err)
+	}
+	if target, err = ParseTarget("ns1.example=unbound+local_datas", DefaultRendererOptions()); err != nil || target.Path != DefaultUnboundPath {
+		t.Errorf("Expected an unbound target, got %+v, %v", target, err)
+	}
+	for _, value := range []string{"10.0.0.53", "=dnsmasq", "10.0.0.53=tinydns", "10.0.0.53=dnsmasq+local_datas", "10.0.0.53=unbound+restart"} {
+		if _, err := ParseTarget(value, DefaultRendererOptions()); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
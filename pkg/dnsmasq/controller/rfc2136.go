@@ -0,0 +1,516 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// TSIGKeyName, TSIGSecret and TSIGAlgorithm are the keys of the Secret
+	// holding the TSIG key of an rfc2136 target. The secret is base64
+	// encoded, as in a BIND key statement, and the algorithm defaults to
+	// hmac-sha256.
+	TSIGKeyName   = "name"
+	TSIGSecret    = "secret"
+	TSIGAlgorithm = "algorithm"
+	// RFC2136Owner is the TXT record marking the names of the forward zones
+	// of rfc2136 targets whose A and AAAA RRsets the operator owns.
+	RFC2136Owner = "heritage=ptr-record-operator"
+
+	// rfc2136Batch bounds the RRsets changed by an UPDATE message.
+	rfc2136Batch = 200
+	// tsigFudge is the clock skew allowed by the TSIG signatures.
+	tsigFudge = 300
+)
+
+// rfc2136Publisher applies the records to the zones of a DNS server with
+// RFC 2136 UPDATE messages signed with TSIG. Each zone is fetched with AXFR
+// and only the RRsets which differ are replaced.
+//
+// The PTR records of reverse zones are owned by the operator: those it does
+// not publish are deleted. In forward zones, the names it publishes carry an
+// RFC2136Owner TXT record, and only the A and AAAA RRsets of those names are
+// replaced or deleted. Forward zones are only updated when given, while
+// reverse zones default to the /24 and nibble zones of the records, which are
+// remembered so that their PTR records are deleted once no record falls in
+// them. RFC 2317 delegations are ignored.
+type rfc2136Publisher struct {
+	zoneSelector
+	server  string
+	secret  types.NamespacedName
+	timeout time.Duration
+
+	// owned are the reverse zones derived from the records which may hold
+	// PTR records of the operator, persisted in the state ConfigMap if it is
+	// named.
+	owned   map[string]bool
+	state   types.NamespacedName
+	loaded  bool
+	changed bool
+}
+
+// zoneSelector sorts the records of publishers managing zones through an
+// API into RRsets by zone.
+type zoneSelector struct {
+	// zones are the zones managed, or nil to derive reverse zones from the
+	// records.
+	zones    []string
+	ipv4Bits int
+	ipv6Bits int
+	ttl      uint32
+}
+
+// newZoneSelector returns the selector of the zone query parameters, at the
+// reverse zone boundaries and TTL of opts.
+func newZoneSelector(query url.Values, opts RendererOptions) (zoneSelector, error) {
+	if err := validateZoneBits(opts.Bind.IPv4Bits, opts.Bind.IPv6Bits); err != nil {
+		return zoneSelector{}, err
+	}
+	z := zoneSelector{
+		ipv4Bits: opts.Bind.IPv4Bits,
+		ipv6Bits: opts.Bind.IPv6Bits,
+		ttl:      uint32(seconds(opts.Bind.TTL)),
+	}
+	for _, zone := range query["zone"] {
+		if _, ok := dns.IsDomainName(zone); !ok {
+			return zoneSelector{}, fmt.Errorf("invalid zone %q", zone)
+		}
+		z.zones = append(z.zones, dns.CanonicalName(zone))
+	}
+	return z, nil
+}
+
+// newRFC2136Publisher returns the publisher of
+// rfc2136://server[:port]?secret=namespace/name[&zone=zone...][&state=namespace/name].
+func newRFC2136Publisher(u *url.URL, opts RendererOptions) (Publisher, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("expected rfc2136://server[:port]")
+	}
+	server := u.Host
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	query := u.Query()
+	namespace, name, ok := strings.Cut(query.Get("secret"), "/")
+	if !ok || namespace == "" || name == "" {
+		return nil, fmt.Errorf("expected the TSIG key as secret=namespace/name")
+	}
+	zones, err := newZoneSelector(query, opts)
+	if err != nil {
+		return nil, err
+	}
+	p := &rfc2136Publisher{
+		zoneSelector: zones,
+		server:       server,
+		secret:       types.NamespacedName{Namespace: namespace, Name: name},
+		timeout:      30 * time.Second,
+		owned:        map[string]bool{},
+	}
+	if value := query.Get("state"); value != "" {
+		namespace, name, ok := strings.Cut(value, "/")
+		if !ok || namespace == "" || name == "" {
+			return nil, fmt.Errorf("expected the state ConfigMap as state=namespace/name")
+		}
+		p.state = types.NamespacedName{Namespace: namespace, Name: name}
+	}
+	return p, nil
+}
+
+// Format returns OutputHosts, as the records are published without any
+// dnsmasq configuration.
+func (p *rfc2136Publisher) Format() OutputFormat {
+	return OutputHosts
+}
+
+func (p *rfc2136Publisher) String() string {
+	return fmt.Sprintf("rfc2136://%s", p.server)
+}
+
+// tsigKey is the TSIG key signing the messages.
+type tsigKey struct {
+	name      string
+	secret    string
+	algorithm string
+}
+
+func (p *rfc2136Publisher) tsigKey(ctx context.Context, c client.Client) (tsigKey, error) {
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, p.secret, secret); err != nil {
+		return tsigKey{}, fmt.Errorf("unable to read TSIG key from %s: %v", p.secret, err)
+	}
+	key := tsigKey{
+		name:      dns.CanonicalName(string(secret.Data[TSIGKeyName])),
+		secret:    strings.TrimSpace(string(secret.Data[TSIGSecret])),
+		algorithm: dns.HmacSHA256,
+	}
+	if algorithm := string(secret.Data[TSIGAlgorithm]); algorithm != "" {
+		key.algorithm = dns.CanonicalName(algorithm)
+	}
+	if key.name == "." || key.secret == "" {
+		return tsigKey{}, fmt.Errorf("%s must hold the %s and %s of the TSIG key", p.secret, TSIGKeyName, TSIGSecret)
+	}
+	return key, nil
+}
+
+func (k tsigKey) sign(m *dns.Msg) {
+	m.SetTsig(k.name, k.algorithm, tsigFudge, time.Now().Unix())
+}
+
+// rrsetKey identifies an RRset within a zone.
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+}
+
+// zoneRRsets are the RRsets managed in each zone.
+type zoneRRsets map[string]map[rrsetKey][]dns.RR
+
+func (z zoneRRsets) add(zone string, rr dns.RR) {
+	if z[zone] == nil {
+		z[zone] = map[rrsetKey][]dns.RR{}
+	}
+	key := rrsetKey{name: dns.CanonicalName(rr.Header().Name), rrtype: rr.Header().Rrtype}
+	z[zone][key] = append(z[zone][key], rr)
+}
+
+// zoneOf returns the most specific zone holding name.
+func (z zoneSelector) zoneOf(name string) (string, bool) {
+	best := ""
+	for _, zone := range z.zones {
+		if dns.IsSubDomain(zone, name) && len(zone) > len(best) {
+			best = zone
+		}
+	}
+	return best, best != ""
+}
+
+// desired returns the RRsets of the records, by zone, and the number of
+// records outside every zone.
+func (z zoneSelector) desired(in RenderInput) (zoneRRsets, int, error) {
+	desired := zoneRRsets{}
+	skipped := 0
+	it := in.buffered()
+	for rec, ok := it.Next(); ok; rec, ok = it.Next() {
+		ttl := z.ttl
+		if rec.Publish.Reverse() {
+			owner := dns.CanonicalName(rec.Reverse)
+			zone, ok := z.zoneOf(owner)
+			if z.zones == nil {
+				zone, ok = reverseZone(rec, z.ipv4Bits, z.ipv6Bits), true
+			}
+			if ok {
+				desired.add(zone, &dns.PTR{Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl}, Ptr: dns.CanonicalName(rec.Name())})
+			} else {
+				skipped++
+			}
+		}
+		if !rec.Publish.Forward() {
+			continue
+		}
+		for _, name := range rec.Names {
+			owner := dns.CanonicalName(name)
+			zone, ok := z.zoneOf(owner)
+			if !ok {
+				skipped++
+				continue
+			}
+			hdr := dns.RR_Header{Name: owner, Class: dns.ClassINET, Ttl: ttl}
+			if rec.Family == record.IPv6 {
+				hdr.Rrtype = dns.TypeAAAA
+				desired.add(zone, &dns.AAAA{Hdr: hdr, AAAA: rec.Addr.AsSlice()})
+			} else {
+				hdr.Rrtype = dns.TypeA
+				desired.add(zone, &dns.A{Hdr: hdr, A: rec.Addr.AsSlice()})
+			}
+		}
+	}
+	return desired, skipped, it.Err()
+}
+
+// managed returns the zones to update, sorted.
+func (z zoneSelector) managed(desired zoneRRsets) []string {
+	zones := append([]string(nil), z.zones...)
+	if z.zones == nil {
+		for zone := range desired {
+			zones = append(zones, zone)
+		}
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// Publish updates every zone, carrying on past zones which fail.
+func (p *rfc2136Publisher) Publish(ctx context.Context, c client.Client, in RenderInput) error {
+	logr := log.FromContext(ctx)
+	key, err := p.tsigKey(ctx, c)
+	if err != nil {
+		return err
+	}
+	desired, skipped, err := p.desired(in)
+	if err != nil {
+		return err
+	}
+	if skipped > 0 {
+		logr.Info("records outside the zones of the target are not published", "target", p.String(), "records", skipped)
+	}
+	desired.markOwned(p.ttl)
+	var errs []error
+	zones := p.managed(desired)
+	if p.zones == nil {
+		if err := p.loadOwned(ctx, c); err != nil {
+			errs = append(errs, err)
+		}
+		for zone := range p.owned {
+			if _, ok := desired[zone]; !ok {
+				zones = append(zones, zone)
+			}
+		}
+		sort.Strings(zones)
+		for zone := range desired {
+			p.setOwned(zone, true)
+		}
+	}
+	for _, zone := range zones {
+		existing, err := p.transfer(ctx, zone, key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to transfer %s: %v", zone, err))
+			continue
+		}
+		changes := diffRRsets(zone, desired[zone], existing)
+		if err := p.update(ctx, zone, key, changes); err != nil {
+			errs = append(errs, fmt.Errorf("unable to update %s: %v", zone, err))
+			continue
+		}
+		if p.zones == nil && len(desired[zone]) == 0 {
+			p.setOwned(zone, false)
+		}
+		logr.Info("updated zone", "target", p.String(), "zone", zone, "rrsets", len(changes))
+	}
+	if p.zones == nil {
+		if err := p.saveOwned(ctx, c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// markOwned adds an RFC2136Owner TXT record, with ttl, to every name with A or
+// AAAA records.
+func (z zoneRRsets) markOwned(ttl uint32) {
+	for _, rrsets := range z {
+		for key := range rrsets {
+			if key.rrtype == dns.TypeA || key.rrtype == dns.TypeAAAA {
+				rrsets[rrsetKey{name: key.name, rrtype: dns.TypeTXT}] = []dns.RR{ownerTXT(key.name, ttl)}
+			}
+		}
+	}
+}
+
+func ownerTXT(name string, ttl uint32) dns.RR {
+	return &dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl}, Txt: []string{RFC2136Owner}}
+}
+
+// setOwned records whether zone may hold PTR records of the operator.
+func (p *rfc2136Publisher) setOwned(zone string, owned bool) {
+	if p.owned[zone] != owned {
+		p.changed = true
+	}
+	if owned {
+		p.owned[zone] = true
+	} else {
+		delete(p.owned, zone)
+	}
+}
+
+// loadOwned adds the zones persisted in the state ConfigMap to the owned
+// zones, once.
+func (p *rfc2136Publisher) loadOwned(ctx context.Context, c client.Client) error {
+	if p.loaded || p.state.Name == "" {
+		return nil
+	}
+	configMap := &corev1.ConfigMap{}
+	if err := c.Get(ctx, p.state, configMap); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("unable to read the zones of %s from %s: %v", p, p.state, err)
+	}
+	for key := range configMap.Data {
+		p.owned[key+"."] = true
+	}
+	p.loaded = true
+	return nil
+}
+
+// saveOwned persists the owned zones to the state ConfigMap if they changed
+// since the last save, as keys without the trailing dot.
+func (p *rfc2136Publisher) saveOwned(ctx context.Context, c client.Client) error {
+	if !p.changed || p.state.Name == "" {
+		return nil
+	}
+	data := make(map[string]string, len(p.owned))
+	for zone := range p.owned {
+		data[strings.TrimSuffix(zone, ".")] = ""
+	}
+	configMap := &corev1.ConfigMap{}
+	err := c.Get(ctx, p.state, configMap)
+	switch {
+	case apierrors.IsNotFound(err):
+		configMap.Namespace, configMap.Name = p.state.Namespace, p.state.Name
+		configMap.Data = data
+		err = c.Create(ctx, configMap)
+	case err == nil:
+		configMap.Data = data
+		err = c.Update(ctx, configMap)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to save the zones of %s to %s: %v", p, p.state, err)
+	}
+	p.changed = false
+	return nil
+}
+
+// transfer returns the PTR, A and AAAA RRsets and the RFC2136Owner TXT
+// records of zone. The transfer is aborted once ctx is done.
+func (p *rfc2136Publisher) transfer(ctx context.Context, zone string, key tsigKey) (map[rrsetKey][]dns.RR, error) {
+	dialer := &net.Dialer{Timeout: p.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", p.server)
+	if err != nil {
+		return nil, err
+	}
+	// closing the connection fails the read the transfer is blocked in
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	t := &dns.Transfer{Conn: &dns.Conn{Conn: conn}, ReadTimeout: p.timeout, TsigSecret: map[string]string{key.name: key.secret}}
+	m := new(dns.Msg).SetAxfr(zone)
+	key.sign(m)
+	envelopes, err := t.In(m, p.server)
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.Join(ctx.Err(), err)
+	}
+	existing := zoneRRsets{}
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, errors.Join(ctx.Err(), envelope.Error)
+		}
+		for _, rr := range envelope.RR {
+			switch rr := rr.(type) {
+			case *dns.PTR, *dns.A, *dns.AAAA:
+				existing.add(zone, rr)
+			case *dns.TXT:
+				if slices.Equal(rr.Txt, []string{RFC2136Owner}) {
+					existing.add(zone, rr)
+				}
+			}
+		}
+	}
+	return existing[zone], nil
+}
+
+// rrsetChange replaces, or with no RRs deletes, the RRset of key.
+type rrsetChange struct {
+	key    rrsetKey
+	remove bool
+	rrs    []dns.RR
+}
+
+// diffRRsets returns the changes turning existing into desired, in name
+// order. PTR RRsets which are not desired are only deleted from reverse
+// zones, and A and AAAA RRsets only from names with an RFC2136Owner TXT
+// record.
+func diffRRsets(zone string, desired, existing map[rrsetKey][]dns.RR) []rrsetChange {
+	var changes []rrsetChange
+	for key, rrs := range desired {
+		if have, ok := existing[key]; !ok || !sameRRset(rrs, have) {
+			changes = append(changes, rrsetChange{key: key, remove: ok, rrs: rrs})
+		}
+	}
+	for key := range existing {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+		// the only TXT records transferred are the owner records
+		owned := key.rrtype == dns.TypeTXT
+		switch key.rrtype {
+		case dns.TypePTR:
+			owned = strings.HasSuffix(zone, ".arpa.")
+		case dns.TypeA, dns.TypeAAAA:
+			_, owned = existing[rrsetKey{name: key.name, rrtype: dns.TypeTXT}]
+		}
+		if owned {
+			changes = append(changes, rrsetChange{key: key, remove: true})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].key.name != changes[j].key.name {
+			return changes[i].key.name < changes[j].key.name
+		}
+		return changes[i].key.rrtype < changes[j].key.rrtype
+	})
+	return changes
+}
+
+// sameRRset returns true if a and b hold the same data with the same TTL,
+// regardless of order.
+func sameRRset(a, b []dns.RR) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	data := map[string]int{}
+	for _, rr := range a {
+		data[fmt.Sprintf("%d %s", rr.Header().Ttl, rdata(rr))]++
+	}
+	for _, rr := range b {
+		data[fmt.Sprintf("%d %s", rr.Header().Ttl, rdata(rr))]--
+	}
+	for _, n := range data {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func rdata(rr dns.RR) string {
+	return strings.ToLower(strings.TrimPrefix(rr.String(), rr.Header().String()))
+}
+
+// update sends changes in batches of UPDATE messages.
+func (p *rfc2136Publisher) update(ctx context.Context, zone string, key tsigKey, changes []rrsetChange) error {
+	c := &dns.Client{Net: "tcp", Timeout: p.timeout, TsigSecret: map[string]string{key.name: key.secret}}
+	for start := 0; start < len(changes); start += rfc2136Batch {
+		m := new(dns.Msg).SetUpdate(zone)
+		for _, change := range changes[start:min(start+rfc2136Batch, len(changes))] {
+			switch {
+			case change.remove && change.key.rrtype == dns.TypeTXT:
+				// the other TXT records of the name are not the operator's
+				m.Remove([]dns.RR{ownerTXT(change.key.name, 0)})
+			case change.remove:
+				m.RemoveRRset([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: change.key.name, Rrtype: change.key.rrtype}}})
+			}
+			m.Insert(change.rrs)
+		}
+		key.sign(m)
+		reply, _, err := c.ExchangeContext(ctx, m, p.server)
+		if err != nil {
+			return err
+		}
+		if reply.Rcode != dns.RcodeSuccess {
+			return fmt.Errorf("server answered %s", dns.RcodeToString[reply.Rcode])
+		}
+	}
+	return nil
+}
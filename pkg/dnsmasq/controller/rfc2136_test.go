@@ -0,0 +1,265 @@
+package controller
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const testTSIGSecret = "c2VjcmV0LWtleS1mb3ItdGVzdHM="
+
+// testZoneServer serves zones over TCP, answering AXFR and applying UPDATE
+// messages signed with the ci-key TSIG key.
+type testZoneServer struct {
+	mu        sync.Mutex
+	zones     map[string][]dns.RR
+	updates   int
+	transfers int
+}
+
+func (s *testZoneServer) records(zone string) []dns.RR {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]dns.RR(nil), s.zones[zone]...)
+}
+
+func (s *testZoneServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	reply := new(dns.Msg).SetReply(r)
+	tsig := r.IsTsig()
+	if tsig == nil || w.TsigStatus() != nil {
+		reply.SetRcode(r, dns.RcodeNotAuth)
+		_ = w.WriteMsg(reply)
+		return
+	}
+	zone := r.Question[0].Name
+	rrs := s.records(zone)
+	if rrs == nil {
+		reply.SetRcode(r, dns.RcodeNotAuth)
+	} else if r.Opcode == dns.OpcodeUpdate {
+		s.apply(zone, r.Ns)
+	} else if r.Question[0].Qtype == dns.TypeAXFR {
+		s.mu.Lock()
+		s.transfers++
+		s.mu.Unlock()
+		ch := make(chan *dns.Envelope, 1)
+		ch <- &dns.Envelope{RR: append(rrs, rrs[0])}
+		close(ch)
+		_ = new(dns.Transfer).Out(w, r, ch)
+		_ = w.Close()
+		return
+	}
+	reply.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	_ = w.WriteMsg(reply)
+}
+
+func (s *testZoneServer) apply(zone string, changes []dns.RR) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updates++
+	for _, change := range changes {
+		h := change.Header()
+		if h.Class != dns.ClassANY && h.Class != dns.ClassNONE {
+			s.zones[zone] = append(s.zones[zone], change)
+			continue
+		}
+		// class ANY deletes the RRset, class NONE the RR with the same data
+		var kept []dns.RR
+		for _, rr := range s.zones[zone] {
+			if !strings.EqualFold(rr.Header().Name, h.Name) || rr.Header().Rrtype != h.Rrtype || (h.Class == dns.ClassNONE && rdata(rr) != rdata(change)) {
+				kept = append(kept, rr)
+			}
+		}
+		s.zones[zone] = kept
+	}
+}
+
+// start serves the zones on a local port until the test ends, returning its
+// address.
+func (s *testZoneServer) start(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{
+		Listener:          listener,
+		Handler:           s,
+		TsigSecret:        map[string]string{"ci-key.": testTSIGSecret},
+		MsgAcceptFunc:     func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return listener.Addr().String()
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("Error parsing %q: %v", s, err)
+	}
+	return rr
+}
+
+func TestRFC2136Publisher(t *testing.T) {
+	server := &testZoneServer{zones: map[string][]dns.RR{
+		"74.177.10.in-addr.arpa.": {
+			mustRR(t, "74.177.10.in-addr.arpa. 3600 IN SOA ns1.ci.example. hostmaster.ci.example. 1 3600 900 604800 300"),
+			mustRR(t, "74.177.10.in-addr.arpa. 3600 IN NS ns1.ci.example."),
+			mustRR(t, "130.74.177.10.in-addr.arpa. 3600 IN PTR stale.ci.example."),
+			mustRR(t, "131.74.177.10.in-addr.arpa. 60 IN PTR IP-10-177-74-131.vlan1153.ci.example."),
+			mustRR(t, "200.74.177.10.in-addr.arpa. 3600 IN PTR gone.ci.example."),
+		},
+		"ci.example.": {
+			mustRR(t, "ci.example. 3600 IN SOA ns1.ci.example. hostmaster.ci.example. 1 3600 900 604800 300"),
+			mustRR(t, "other.ci.example. 3600 IN A 192.168.10.99"),
+			mustRR(t, "other.ci.example. 3600 IN TXT \"v=spf1 -all\""),
+			mustRR(t, "stale.ci.example. 3600 IN A 192.168.10.98"),
+			mustRR(t, "stale.ci.example. 3600 IN TXT \"v=spf1 -all\""),
+			mustRR(t, "stale.ci.example. 3600 IN TXT \""+RFC2136Owner+"\""),
+		},
+	}}
+	c := newObjectClient()
+	secret := &corev1.Secret{Data: map[string][]byte{TSIGKeyName: []byte("ci-key"), TSIGSecret: []byte(testTSIGSecret + "\n")}}
+	secret.Namespace, secret.Name = "dns", "tsig"
+	if err := c.Create(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	target, err := ParseTarget("rfc2136://"+server.start(t)+"?secret=dns/tsig&zone=74.177.10.in-addr.arpa&zone=ci.example", DefaultRendererOptions())
+	if err != nil {
+		t.Fatalf("Error parsing target: %v", err)
+	}
+	if err := UpdateDNSHost(context.Background(), c, "", target, goldenInput(t)); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+
+	zone := map[string]string{}
+	for _, rr := range append(server.records("74.177.10.in-addr.arpa."), server.records("ci.example.")...) {
+		zone[strings.ToLower(rr.Header().Name)+" "+dns.TypeToString[rr.Header().Rrtype]] = rdata(rr)
+	}
+	for name, expected := range map[string]string{
+		"130.74.177.10.in-addr.arpa. PTR": "ip-10-177-74-130.vlan1153.ci.example.",
+		"131.74.177.10.in-addr.arpa. PTR": "ip-10-177-74-131.vlan1153.ci.example.",
+		"129.74.177.10.in-addr.arpa. PTR": "gw.vlan1153.bcr01a.dal10.",
+		"api-int.ci.example. A":           "192.168.10.5",
+		"other.ci.example. A":             "192.168.10.99",
+		"other.ci.example. TXT":           "\"v=spf1 -all\"",
+		"stale.ci.example. TXT":           "\"v=spf1 -all\"",
+		"api-int.ci.example. TXT":         "\"" + RFC2136Owner + "\"",
+		"74.177.10.in-addr.arpa. NS":      "ns1.ci.example.",
+	} {
+		if zone[name] != expected {
+			t.Errorf("Expected %s %s, got %q", name, expected, zone[name])
+		}
+	}
+	if _, ok := zone["200.74.177.10.in-addr.arpa. PTR"]; ok {
+		t.Errorf("Expected the PTR record no longer published to be deleted")
+	}
+	if _, ok := zone["stale.ci.example. A"]; ok {
+		t.Errorf("Expected the owned A record no longer published to be deleted")
+	}
+	if _, ok := zone["ip-10-177-74-128.vlan1153.ci.example. A"]; !ok {
+		t.Errorf("Expected the forward records of the subnet in ci.example, got %v", zone)
+	}
+
+	updates := server.updates
+	if err := UpdateDNSHost(context.Background(), c, "", target, goldenInput(t)); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+	if server.updates != updates {
+		t.Errorf("Expected no UPDATE once the zones match, got %d more", server.updates-updates)
+	}
+
+	opts := DefaultRendererOptions()
+	opts.Bind.TTL = 5 * time.Minute
+	shorter, err := ParseTarget("rfc2136://"+server.start(t)+"?secret=dns/tsig&zone=74.177.10.in-addr.arpa&zone=ci.example", opts)
+	if err != nil {
+		t.Fatalf("Error parsing target: %v", err)
+	}
+	if err := UpdateDNSHost(context.Background(), c, "", shorter, goldenInput(t)); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+	for _, rr := range server.records("74.177.10.in-addr.arpa.") {
+		if rr.Header().Rrtype == dns.TypePTR && rr.Header().Ttl != 300 {
+			t.Errorf("Expected the TTL of the records to follow the target, got %v", rr)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	transfers := server.transfers
+	if err := UpdateDNSHost(ctx, c, "", target, goldenInput(t)); err == nil || server.transfers != transfers {
+		t.Errorf("Expected a cancelled publish to fail without transferring any zone, got %d transfers: %v", server.transfers-transfers, err)
+	}
+
+	secret.Data[TSIGSecret] = []byte("d3Jvbmcta2V5")
+	if err := c.Update(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateDNSHost(context.Background(), c, "", target, goldenInput(t)); err == nil {
+		t.Errorf("Expected a wrong TSIG key to fail")
+	}
+	if _, err := ParseTarget("rfc2136://10.0.0.53", DefaultRendererOptions()); err == nil {
+		t.Errorf("Expected a target without a TSIG key to be refused")
+	}
+}
+
+func TestRFC2136PublisherReverseZones(t *testing.T) {
+	server := &testZoneServer{zones: map[string][]dns.RR{
+		"74.177.10.in-addr.arpa.": {
+			mustRR(t, "74.177.10.in-addr.arpa. 3600 IN SOA ns1.ci.example. hostmaster.ci.example. 1 3600 900 604800 300"),
+		},
+	}}
+	c := newObjectClient()
+	secret := &corev1.Secret{Data: map[string][]byte{TSIGKeyName: []byte("ci-key"), TSIGSecret: []byte(testTSIGSecret)}}
+	secret.Namespace, secret.Name = "dns", "tsig"
+	if err := c.Create(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	url := "rfc2136://" + server.start(t) + "?secret=dns/tsig&state=dns/rfc2136-zones"
+	rec, err := record.New(netip.MustParseAddr("10.177.74.130"), record.Source{Kind: record.SourceFile}, "bastion.ci.example.")
+	if err != nil {
+		t.Fatalf("Error creating record: %v", err)
+	}
+	publish := func(records ...record.Record) {
+		// a new target forgets the zones it updated, as on a restart
+		target, err := ParseTarget(url, DefaultRendererOptions())
+		if err != nil {
+			t.Fatalf("Error parsing target: %v", err)
+		}
+		in := RenderInput{Records: func() record.Iterator { return record.FromSlice(records) }}
+		if err := UpdateDNSHost(context.Background(), c, "", target, in); err != nil {
+			t.Fatalf("Error publishing: %v", err)
+		}
+	}
+
+	publish(rec)
+	if rrs := server.records("74.177.10.in-addr.arpa."); len(rrs) != 2 {
+		t.Fatalf("Expected the PTR record of 10.177.74.130, got %v", rrs)
+	}
+	state := &corev1.ConfigMap{}
+	if err := c.Get(context.Background(), types.NamespacedName{Namespace: "dns", Name: "rfc2136-zones"}, state); err != nil {
+		t.Fatalf("Expected the zones to be saved: %v", err)
+	}
+	if _, ok := state.Data["74.177.10.in-addr.arpa"]; !ok || len(state.Data) != 1 {
+		t.Errorf("Expected the zone of the record to be saved, got %v", state.Data)
+	}
+
+	publish()
+	if rrs := server.records("74.177.10.in-addr.arpa."); len(rrs) != 1 {
+		t.Errorf("Expected the PTR record of the emptied zone to be deleted, got %v", rrs)
+	}
+	if err := c.Get(context.Background(), types.NamespacedName{Namespace: "dns", Name: "rfc2136-zones"}, state); err != nil || len(state.Data) != 0 {
+		t.Errorf("Expected the emptied zone to be forgotten, got %v %v", state.Data, err)
+	}
+}
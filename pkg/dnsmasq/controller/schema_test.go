@@ -0,0 +1,115 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/openshift-splat-team/vsphere-ci-dns/data"
+)
+
+func TestSubnetsSchema(t *testing.T) {
+	var schema struct {
+		Defs struct {
+			Subnet struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+			} `json:"subnet"`
+		} `json:"$defs"`
+	}
+	if err := json.Unmarshal(data.SubnetsSchema, &schema); err != nil {
+		t.Fatalf("Error decoding the schema: %v", err)
+	}
+	subnetType := reflect.TypeOf(data.Subnet{})
+	for i := 0; i < subnetType.NumField(); i++ {
+		name, _, _ := strings.Cut(subnetType.Field(i).Tag.Get("json"), ",")
+		if _, ok := schema.Defs.Subnet.Properties[name]; !ok {
+			t.Errorf("Expected the schema to describe %s", name)
+		}
+		delete(schema.Defs.Subnet.Properties, name)
+	}
+	for name := range schema.Defs.Subnet.Properties {
+		t.Errorf("Expected data.Subnet to have a field for %s", name)
+	}
+}
+
+func TestLegacySubnets(t *testing.T) {
+	legacy, err := data.DecodeSubnets([]byte(SUBNETS_JSON))
+	if err != nil {
+		t.Fatalf("Error decoding legacy subnets: %v", err)
+	}
+	if legacy.Version != 1 || len(legacy.Unknown) > 0 {
+		t.Errorf("Expected a version 1 document without unknown fields, got version %d and %v", legacy.Version, legacy.Unknown)
+	}
+	subnet := legacy.Subnets["bcr01a.dal10"]["1153"]
+	if subnet.CidrIPv6 != 64 || subnet.DhcpEndLocation == 0 || subnet.MachineNetworkCidr != "10.177.74.128/25" || subnet.GatewayIPv6 != "fd65:a1a8:60ad:1153::2" {
+		t.Errorf("Expected legacy field names to be matched regardless of case, got %+v", subnet)
+	}
+
+	migrated, err := data.MigrateSubnets([]byte(SUBNETS_JSON))
+	if err != nil {
+		t.Fatalf("Error migrating subnets: %v", err)
+	}
+	current, err := data.DecodeSubnets(migrated)
+	if err != nil {
+		t.Fatalf("Error decoding migrated subnets: %v", err)
+	}
+	if current.Version != data.SubnetsSchemaVersion || len(current.Unknown) > 0 || !reflect.DeepEqual(current.Subnets, legacy.Subnets) {
+		t.Errorf("Expected migration to preserve every entry")
+	}
+}
+
+func TestSubnetsVersions(t *testing.T) {
+	content := `{
+    "version": 2,
+    "subnets": {
+        "dc1": {
+            "100": {"cidr": 29, "network": "10.0.0.0", "CidrIPv6": 64, "color": "blue"},
+            "101": {"cidr": 29, "network": "10.0.1.0", "machineNetworkCidr": "10.0.2.0/29"}
+        }
+    },
+    "owner": "team"
+}`
+	doc, err := data.DecodeSubnets([]byte(content))
+	var subnetErrs data.SubnetErrors
+	if !errors.As(err, &subnetErrs) || len(subnetErrs) != 1 || subnetErrs[0].Path() != "dc1/101" {
+		t.Fatalf("Expected dc1/101 to be invalid, got %v", err)
+	}
+	unknown := []string{"*/*: owner", "dc1/100: CidrIPv6", "dc1/100: color"}
+	if len(doc.Unknown) != len(unknown) {
+		t.Fatalf("Expected unknown fields %v, got %v", unknown, doc.Unknown)
+	}
+	for i, field := range unknown {
+		if doc.Unknown[i].String() != field {
+			t.Errorf("Expected unknown field %s, got %s", field, doc.Unknown[i])
+		}
+	}
+	if doc.Subnets["dc1"]["100"].CidrIPv6 != 0 {
+		t.Errorf("Expected current documents to require the field names of the schema")
+	}
+
+	if _, err := data.DecodeSubnets([]byte(`{"version": 3, "subnets": {}}`)); err == nil {
+		t.Errorf("Expected a future version to be refused")
+	}
+
+	legacy := `{"dc1": {"100": {"machineNetworkCidr": "10.0.0.0/29", "ipAddresses": ["10.0.0.1"]}}}`
+	doc, err = data.DecodeSubnets([]byte(legacy))
+	if err != nil {
+		t.Fatalf("Error decoding legacy subnets: %v", err)
+	}
+	if subnet := doc.Subnets["dc1"]["100"]; subnet.Network != "10.0.0.0" || subnet.CIDR != 29 || subnet.Mask != "255.255.255.248" {
+		t.Errorf("Expected the network of legacy entries to be migrated from machineNetworkCidr, got %+v", subnet)
+	}
+
+	wrapped, err := data.DecodeSubnets([]byte(`{"version": 1, "subnets": ` + legacy + `}`))
+	if err != nil {
+		t.Fatalf("Error decoding wrapped legacy subnets: %v", err)
+	}
+	if wrapped.Version != 1 || !reflect.DeepEqual(wrapped.Subnets, doc.Subnets) {
+		t.Errorf("Expected a wrapped version 1 document to decode as the legacy one, got version %d and %+v", wrapped.Version, wrapped.Subnets)
+	}
+	if _, err := data.DecodeSubnets([]byte(`{"version": 0, "subnets": {}}`)); err == nil {
+		t.Errorf("Expected version 0 to be refused")
+	}
+}
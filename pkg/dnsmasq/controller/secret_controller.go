@@ -20,15 +20,17 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"net"
+	"net/netip"
 	"os"
+	"strings"
 
-	"github.com/miekg/dns"
 	vcmv1 "github.com/openshift-splat-team/vsphere-capacity-manager/pkg/apis/vspherecapacitymanager.splat.io/v1"
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	kuberecord "k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -46,88 +48,249 @@ var (
 // SecretReconciler reconciles a HaproxyMetal object
 type SecretReconciler struct {
 	client.Client
-	Scheme         *runtime.Scheme
-	AdditionalCIDR string
+	Scheme *runtime.Scheme
+	// Sources are the enabled inputs records are generated from.
+	Sources []RecordSource
+	// Targets are the DNS servers the records are pushed to, each in its own
+	// format.
+	Targets        []Target
 	PrivateKeyPath string
-	DnsServer      string
+	MaxIPv6Range   uint64
+	// MaxCIDRAddresses bounds the size of any CIDR expanded into records.
+	MaxCIDRAddresses uint64
+	Namer            *Namer
+	Precedence       record.Precedence
+	Recorder         kuberecord.EventRecorder
+	// Filters restricts the addresses each source publishes records for.
+	Filters Filters
+	// SkipNetworkBroadcast omits the network and broadcast addresses of IPv4
+	// subnets and CIDRs.
+	SkipNetworkBroadcast bool
+	// Reservations names, or suppresses, the infrastructure addresses of
+	// subnets.json entries.
+	Reservations Reservations
+	// Classless places the PTR records of sub-/24 IPv4 ranges in RFC 2317
+	// child zones. It requires OutputDnsmasq or OutputBind.
+	Classless bool
+	// Publish selects whether each source publishes reverse records, forward
+	// records or both.
+	Publish PublishModes
+	// Serials is shared by the BIND targets, and persisted around each
+	// reconcile.
+	Serials *SerialState
+
+	// complete are the records each source last returned without error.
+	complete map[RecordSource]SourceRecords
+}
+
+func (r *SecretReconciler) recordOptions() RecordOptions {
+	return RecordOptions{
+		Namer:                r.Namer,
+		MaxIPv6Range:         r.MaxIPv6Range,
+		MaxCIDRAddresses:     r.MaxCIDRAddresses,
+		SkipNetworkBroadcast: r.SkipNetworkBroadcast,
+		Reservations:         r.Reservations,
+		Classless:            r.Classless,
+	}
+}
+
+// DefaultMaxCIDRAddresses is the default upper bound on the number of
+// addresses expanded from a single CIDR, a /12.
+const DefaultMaxCIDRAddresses = 1 << 20
+
+// cidrExpansion lazily generates a record for every address of a CIDR, or of
+// the part of it given by r.
+type cidrExpansion struct {
+	prefix netip.Prefix
+	r      record.Range
+	data   NameData
+	source record.Source
+	namer  *Namer
+	// skipNetworkBroadcast omits the network and broadcast addresses.
+	skipNetworkBroadcast bool
+	// classless places the records in the RFC 2317 child zone of prefix.
+	classless bool
+	// fixed replaces the generated record of its addresses, e.g. to name
+	// the gateway of a network.
+	fixed map[netip.Addr]record.Record
 }
 
-// incIP increments an IP address.
-func incIP(ip net.IP) {
-	for j := len(ip) - 1; j >= 0; j-- {
-		ip[j]++
-		if ip[j] > 0 {
-			break
+// Records returns a new iterator over the records of the CIDR.
+func (e cidrExpansion) Records() record.Iterator {
+	it := record.ExpandRange(e.r, func(addr netip.Addr) (record.Record, error) {
+		rec, err := formatRecord(addr, e.data, e.namer, e.source)
+		if fixed, ok := e.fixed[addr]; ok {
+			rec, err = fixed, nil
+		}
+		if err != nil || !e.classless {
+			return rec, err
 		}
+		return rec.Delegate(e.prefix), nil
+	})
+	if e.skipNetworkBroadcast {
+		it = record.Filter(it, func(rec record.Record) bool {
+			return !isNetworkOrBroadcast(e.prefix, rec.Addr)
+		})
 	}
+	return it
 }
 
-func processCIDR(ctx context.Context, cidr string) ([]string, error) {
+// processCIDR prepares the expansion of cidr. CIDRs with more than
+// opts.MaxCIDRAddresses addresses are refused.
+func processCIDR(ctx context.Context, cidr string, data NameData, source record.Source, opts RecordOptions) (cidrExpansion, error) {
 	logr := log.FromContext(ctx)
 	logr.V(1).Info("processing CIDR", "cidr", cidr)
-	ip, ipnet, err := net.ParseCIDR(cidr)
+	prefix, err := netip.ParsePrefix(cidr)
 	if err != nil {
-		return nil, err
+		return cidrExpansion{}, err
+	}
+	if hostBits := prefix.Addr().BitLen() - prefix.Bits(); hostBits >= 64 || uint64(1)<<hostBits > opts.MaxCIDRAddresses {
+		return cidrExpansion{}, fmt.Errorf("CIDR %s spans more than %d addresses; raise --max-cidr-addresses if this is intended", cidr, opts.MaxCIDRAddresses)
 	}
+	return cidrExpansion{
+		prefix:               prefix.Masked(),
+		r:                    record.RangeOf(prefix),
+		data:                 data.withBase(prefix.Masked().Addr()),
+		source:               source,
+		namer:                opts.Namer,
+		skipNetworkBroadcast: opts.SkipNetworkBroadcast,
+		classless:            opts.Classless,
+	}, nil
+}
 
-	var ptrRecords []string
-	for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); incIP(ip) {
-		addr, err := dns.ReverseAddr(ip.String())
+// processCIDRs checks every CIDR of cidrs against opts.MaxCIDRAddresses and
+// returns them as a prefix set, each CIDR being its own source.
+func processCIDRs(ctx context.Context, cidrs []string, opts RecordOptions) (*record.PrefixSet, error) {
+	set := &record.PrefixSet{}
+	for _, cidr := range cidrs {
+		expansion, err := processCIDR(ctx, cidr, NameData{}, record.Source{Kind: record.SourceCIDR, Name: cidr}, opts)
 		if err != nil {
-			return nil, fmt.Errorf("unable to reverse address: %v", err)
+			return nil, err
 		}
-		ptrRecords = append(ptrRecords, fmt.Sprintf("%s %s", ip.String(), addr))
+		set.Add(expansion.prefix, expansion.source)
+	}
+	return set, nil
+}
+
+// cidrExpansions returns the expansion of every segment of cidrs, so that
+// overlapping CIDRs are only expanded once. A segment shared by several CIDRs
+// is attributed to the one listed first.
+func cidrExpansions(ctx context.Context, cidrs *record.PrefixSet, opts RecordOptions) []cidrExpansion {
+	logr := log.FromContext(ctx)
+	var expansions []cidrExpansion
+	for _, segment := range cidrs.Segments() {
+		owner := segment.Owners[0]
+		logr.V(1).Info("expanding additional CIDR", "range", segment.Range.String(), "owner", owner.Name, "owners", len(segment.Owners))
+		expansions = append(expansions, cidrExpansion{
+			// owners are parsed by processCIDRs
+			prefix:               netip.MustParsePrefix(owner.Name).Masked(),
+			r:                    segment.Range,
+			source:               owner,
+			namer:                opts.Namer,
+			skipNetworkBroadcast: opts.SkipNetworkBroadcast,
+			classless:            opts.Classless,
+		})
 	}
-	return ptrRecords, nil
+	return expansions
 }
 
 // +kubebuilder:rbac:groups=v1,resources=namespaces,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups=vspherecapacitymanager.splat.io,resources=networks;leases,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;delete
 func (r *SecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logr := log.FromContext(ctx)
 	logr.V(1).Info("reconciling Secret")
 	secret := &corev1.Secret{}
 
-	var records []string
+	opts := r.recordOptions()
 	err := r.Client.Get(ctx, req.NamespacedName, secret)
 	if err != nil {
 		logr.Error(err, "unable to fetch secret")
 		return ctrl.Result{}, err
 	}
-	if val, exists := secret.Data["subnets.json"]; exists {
-		records, err := SubnetParse(string(val))
-		if err != nil {
-			return ctrl.Result{}, fmt.Errorf("unable to parse subnets.json: %v", err)
-		}
 
-		if r.AdditionalCIDR != "" {
-			additionalRecords, err := processCIDR(ctx, r.AdditionalCIDR)
-			if err != nil {
-				return ctrl.Result{}, fmt.Errorf("unable to process additional CIDR: %v", err)
-			}
-			records = append(records, additionalRecords...)
+	var gathered SourceRecords
+	var incomplete []string
+	env := SourceEnv{Client: r.Client, Secret: secret, Options: opts}
+	if r.complete == nil {
+		r.complete = map[RecordSource]SourceRecords{}
+	}
+	for _, source := range r.Sources {
+		out, err := source.Records(ctx, env)
+		logr.V(1).Info("gathered records", "source", source.Kind(), "records", len(out.Records), "streams", len(out.Streams))
+		gathered.add(out)
+		if err == nil || !r.reportSourceError(ctx, secret, source, err) {
+			r.complete[source] = SourceRecords{Records: out.Records, Streams: out.Streams}
+			continue
 		}
+		// targets delete whatever is missing from the records, so the
+		// records the source last returned in full still fill in for the
+		// addresses it no longer returns
+		last, ok := r.complete[source]
+		if !ok {
+			incomplete = append(incomplete, string(source.Kind()))
+			continue
+		}
+		gathered.add(last.held())
+	}
+	if len(incomplete) > 0 {
+		return ctrl.Result{}, fmt.Errorf("not updating any DNS host as the %s sources failed before returning their records in full", strings.Join(incomplete, ", "))
 	}
 
-	var networkList vcmv1.NetworkList
+	report := newConflictReport(ctx)
+	set := record.NewSet(r.Precedence)
+	for _, rec := range r.Filters.Apply(gathered.Records) {
+		set.Add(r.Publish.Apply(rec))
+	}
+	for _, conflict := range set.Conflicts() {
+		report.add(conflict)
+	}
+	explicit := set.Records()
+	logr.V(1).Info("records after duplicate removal", "records", len(explicit), "streams", len(gathered.Streams))
 
-	err = r.Client.List(ctx, &networkList, client.InNamespace("vsphere-infra-helpers"))
-	if err != nil {
-		return ctrl.Result{}, fmt.Errorf("unable to list networks: %v", err)
+	// streams are merged with the explicit records as they are rendered,
+	// so a large CIDR is never held in memory. Conflicts are only collected
+	// the first time, as the records are rendered more than once.
+	passes := 0
+	stream := func() record.Iterator {
+		iters := []record.Iterator{record.FromSlice(explicit)}
+		for _, stream := range gathered.Streams {
+			iters = append(iters, record.Map(record.Filter(stream(), r.Filters.Allows), r.Publish.Apply))
+		}
+		var onConflict func(record.Conflict)
+		if passes == 0 {
+			onConflict = report.add
+		}
+		passes++
+		// reserved addresses without a name shadow other sources during the
+		// merge and are only dropped afterwards
+		return record.Published(record.Merge(r.Precedence, onConflict, iters...))
 	}
-	for _, network := range networkList.Items {
-		logr.V(1).Info("processing VCM network", "network", network.Name)
-		additionalRecords, err := processCIDR(ctx, network.Spec.MachineNetworkCidr)
-		if err != nil {
-			logr.V(1).Info(fmt.Sprintf("unable to process additional CIDR: %v", err))
-			continue
+
+	if r.Serials != nil {
+		if err := r.Serials.Load(ctx, r.Client); err != nil {
+			logr.Error(err, "unable to load zone serials")
 		}
-		logr.V(1).Info(fmt.Sprintf("appending %d records", len(additionalRecords)))
-		records = append(records, additionalRecords...)
 	}
 
-	err = UpdateDNSHost(ctx, r.Client, r.PrivateKeyPath, r.DnsServer, string(secret.Data["dnsmasq.cfg"]), records)
-	if err != nil {
-		return ctrl.Result{}, fmt.Errorf("unable to update ci-dns.OCP-vsphere.cloud with additional hosts: %v", err)
+	// a target which fails does not hold back the others
+	in := RenderInput{Records: stream, Dnsmasq: DnsmasqConfig{Synths: gathered.Synths, DHCP: gathered.DHCP}, MaxRecords: r.MaxCIDRAddresses}
+	var failed []string
+	for _, target := range r.Targets {
+		if err := UpdateDNSHost(ctx, r.Client, r.PrivateKeyPath, target, in); err != nil {
+			logr.Error(err, "unable to update DNS host", "target", target.String())
+			failed = append(failed, fmt.Sprintf("%s: %v", target, err))
+		}
+	}
+	if r.Serials != nil {
+		if err := r.Serials.Save(ctx, r.Client); err != nil {
+			logr.Error(err, "unable to save zone serials")
+		}
+	}
+	r.reportConflicts(ctx, secret, report)
+	if len(failed) > 0 {
+		return ctrl.Result{}, fmt.Errorf("unable to update %d of %d DNS hosts: %s", len(failed), len(r.Targets), strings.Join(failed, "; "))
 	}
 
 	return ctrl.Result{}, nil
@@ -135,11 +298,16 @@ func (r *SecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *SecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&corev1.Secret{}, builder.WithPredicates(predicate.ResourceVersionChangedPredicate{}, predicate.NewPredicateFuncs(func(object client.Object) bool {
 			return object.GetNamespace() == "test-credentials" && object.GetName() == "vsphere-config"
-		}))).
-		Complete(r)
+		})))
+	for _, source := range r.Sources {
+		if watcher, ok := source.(sourceWatcher); ok {
+			b = watcher.watch(b)
+		}
+	}
+	return b.Complete(r)
 }
 
 func StartManager(context SecretReconciler) {
@@ -178,11 +346,22 @@ func StartManager(context SecretReconciler) {
 	appsv1.AddToScheme(mgr.GetScheme())
 	vcmv1.AddToScheme(mgr.GetScheme())
 	if err = (&SecretReconciler{
-		Client:         client,
-		Scheme:         mgr.GetScheme(),
-		AdditionalCIDR: context.AdditionalCIDR,
-		PrivateKeyPath: context.PrivateKeyPath,
-		DnsServer:      context.DnsServer,
+		Client:               client,
+		Scheme:               mgr.GetScheme(),
+		Sources:              context.Sources,
+		Targets:              context.Targets,
+		PrivateKeyPath:       context.PrivateKeyPath,
+		MaxIPv6Range:         context.MaxIPv6Range,
+		MaxCIDRAddresses:     context.MaxCIDRAddresses,
+		Namer:                context.Namer,
+		Precedence:           context.Precedence,
+		Recorder:             mgr.GetEventRecorderFor("ptr-record-operator"),
+		Filters:              context.Filters,
+		Reservations:         context.Reservations,
+		SkipNetworkBroadcast: context.SkipNetworkBroadcast,
+		Classless:            context.Classless,
+		Publish:              context.Publish,
+		Serials:              context.Serials,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "namespace")
 		os.Exit(1)
@@ -0,0 +1,133 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// SerialState hands out the SOA serial of each zone, in the date-based
+// YYYYMMDDnn form. The serial of a zone only increases when its content
+// changes, to the first serial of the day or, if that is not greater, to
+// the next serial.
+//
+// The state is kept in memory, and in ConfigMap if it is named, so that
+// serials keep increasing across restarts.
+type SerialState struct {
+	// ConfigMap persists the serials, as "serial digest" values keyed by
+	// zone.
+	ConfigMap types.NamespacedName
+	// Now dates new serials, time.Now when nil.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	zones   map[string]zoneSerial
+	changed bool
+}
+
+type zoneSerial struct {
+	serial uint32
+	digest string
+}
+
+// serial returns the serial of zone for content with digest.
+func (s *SerialState) serial(zone, digest string) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.zones[zone]
+	if ok && prev.digest == digest {
+		return prev.serial
+	}
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	year, month, day := now().UTC().Date()
+	next := uint32(year*1000000 + int(month)*10000 + day*100)
+	if ok && prev.serial >= next {
+		next = prev.serial + 1
+	}
+	if s.zones == nil {
+		s.zones = map[string]zoneSerial{}
+	}
+	s.zones[zone] = zoneSerial{serial: next, digest: digest}
+	s.changed = true
+	return next
+}
+
+// Load reads the serials persisted in ConfigMap, if any. Serials already in
+// memory are kept when they are not lower.
+func (s *SerialState) Load(ctx context.Context, c client.Client) error {
+	if s.ConfigMap.Name == "" {
+		return nil
+	}
+	configMap := &corev1.ConfigMap{}
+	if err := c.Get(ctx, s.ConfigMap, configMap); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("unable to read serials from %s: %v", s.ConfigMap, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.zones == nil {
+		s.zones = map[string]zoneSerial{}
+	}
+	for key, value := range configMap.Data {
+		text, digest, _ := strings.Cut(value, " ")
+		serial, err := strconv.ParseUint(text, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid serial of %s in %s: %q", key, s.ConfigMap, value)
+		}
+		zone := key + "."
+		if prev, ok := s.zones[zone]; !ok || prev.serial < uint32(serial) {
+			s.zones[zone] = zoneSerial{serial: uint32(serial), digest: digest}
+		}
+	}
+	return nil
+}
+
+// Save persists the serials to ConfigMap if any changed since the last Save.
+func (s *SerialState) Save(ctx context.Context, c client.Client) error {
+	if s.ConfigMap.Name == "" {
+		return nil
+	}
+	s.mu.Lock()
+	if !s.changed {
+		s.mu.Unlock()
+		return nil
+	}
+	data := make(map[string]string, len(s.zones))
+	for zone, serial := range s.zones {
+		data[strings.TrimSuffix(zone, ".")] = fmt.Sprintf("%d %s", serial.serial, serial.digest)
+	}
+	s.changed = false
+	s.mu.Unlock()
+
+	configMap := &corev1.ConfigMap{}
+	err := c.Get(ctx, s.ConfigMap, configMap)
+	switch {
+	case apierrors.IsNotFound(err):
+		configMap.Namespace, configMap.Name = s.ConfigMap.Namespace, s.ConfigMap.Name
+		configMap.Data = data
+		err = c.Create(ctx, configMap)
+	case err == nil:
+		configMap.Data = data
+		err = c.Update(ctx, configMap)
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.changed = true
+		s.mu.Unlock()
+		return fmt.Errorf("unable to save serials to %s: %v", s.ConfigMap, err)
+	}
+	return nil
+}
@@ -0,0 +1,469 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	vcmv1 "github.com/openshift-splat-team/vsphere-capacity-manager/pkg/apis/vspherecapacitymanager.splat.io/v1"
+	"github.com/openshift-splat-team/vsphere-ci-dns/data"
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// SourceEnv is what a RecordSource may draw on while reconciling.
+type SourceEnv struct {
+	Client client.Client
+	// Secret is the vsphere-config secret being reconciled.
+	Secret  *corev1.Secret
+	Options RecordOptions
+}
+
+// SourceRecords is the output of a RecordSource.
+type SourceRecords struct {
+	// Records are held in memory and deduplicated up front.
+	Records []record.Record
+	// Streams are expanded as the output is rendered, so that large ranges
+	// are never held in memory. Each call returns a new iterator over records
+	// in address order.
+	Streams []func() record.Iterator
+	// Synths and DHCP configure dnsmasq itself.
+	Synths []SynthDomain
+	DHCP   []DHCPRange
+}
+
+// heldPriority marks the records a failed source last returned in full, so
+// that they lose to its current records.
+const heldPriority = math.MinInt
+
+// held returns the records and streams of s at heldPriority.
+func (s SourceRecords) held() SourceRecords {
+	hold := func(rec record.Record) record.Record {
+		rec.Priority = heldPriority
+		return rec
+	}
+	var out SourceRecords
+	for _, rec := range s.Records {
+		out.Records = append(out.Records, hold(rec))
+	}
+	for _, stream := range s.Streams {
+		out.Streams = append(out.Streams, func() record.Iterator { return record.Map(stream(), hold) })
+	}
+	return out
+}
+
+func (s *SourceRecords) add(other SourceRecords) {
+	s.Records = append(s.Records, other.Records...)
+	s.Streams = append(s.Streams, other.Streams...)
+	s.Synths = append(s.Synths, other.Synths...)
+	s.DHCP = append(s.DHCP, other.DHCP...)
+}
+
+// RecordSource is an input the operator generates records from. Sources are
+// isolated from each other: an error is reported against its source, and the
+// records it returned alongside the error, if any, are still published. The
+// records it last returned without error are kept for the addresses it no
+// longer returns, so a failing source never deletes records. Nothing is
+// published while a failing source has not returned its records in full
+// since the operator started.
+type RecordSource interface {
+	// Kind is the kind of the records of the source, which sets their
+	// precedence.
+	Kind() record.SourceKind
+	Records(ctx context.Context, env SourceEnv) (SourceRecords, error)
+}
+
+// sourceWatcher is implemented by sources backed by Kubernetes objects, which
+// trigger a reconcile when they change.
+type sourceWatcher interface {
+	watch(b *builder.Builder) *builder.Builder
+}
+
+// watchObjects reconciles the vsphere-config secret whenever an object of
+// the type of obj in namespace, and matching selector if not nil, changes.
+func watchObjects(b *builder.Builder, obj client.Object, namespace string, selector labels.Selector) *builder.Builder {
+	return b.Watches(obj, handler.EnqueueRequestsFromMapFunc(configSecret), builder.WithPredicates(predicate.NewPredicateFuncs(func(object client.Object) bool {
+		return object.GetNamespace() == namespace && (selector == nil || selector.Matches(labels.Set(object.GetLabels())))
+	})))
+}
+
+// SubnetsSource reads subnets.json from the vsphere-config secret.
+type SubnetsSource struct {
+	// DHCP, when set, renders the DHCP configuration of every entry with a
+	// DHCP pool.
+	DHCP *DHCPOptions
+	// Keys are further keys of the secret, such as IPAM exports, parsed as by
+	// parseRecordFile.
+	Keys []string
+}
+
+func (s *SubnetsSource) Kind() record.SourceKind {
+	return record.SourceSubnets
+}
+
+// Records returns the records of every valid entry, along with a
+// data.SubnetErrors for the invalid ones of subnets.json and a
+// data.UnknownFields for the fields it ignored, joined with the errors of
+// Keys.
+func (s *SubnetsSource) Records(ctx context.Context, env SourceEnv) (SourceRecords, error) {
+	out, keysErr := s.keyRecords(env)
+	content, exists := env.Secret.Data["subnets.json"]
+	if !exists {
+		return out, keysErr
+	}
+	doc, err := data.DecodeSubnets(content)
+	records, err := subnetRecords(doc.Subnets, err, env.Options, subnetsSource)
+	if records == nil {
+		return out, errors.Join(fmt.Errorf("unable to parse subnets.json: %v", err), keysErr)
+	}
+	if doc.Version < data.SubnetsSchemaVersion {
+		log.FromContext(ctx).V(1).Info("subnets.json uses a legacy schema", "version", doc.Version, "current", data.SubnetsSchemaVersion)
+	}
+	out.Records = append(out.Records, records...)
+	if s.DHCP != nil {
+		// invalid entries are reported by subnetRecords
+		ranges, dhcpErr := subnetDHCPRanges(doc.Subnets, nil, *s.DHCP)
+		if ranges == nil && dhcpErr != nil {
+			return out, errors.Join(fmt.Errorf("unable to render DHCP ranges: %v", dhcpErr), keysErr)
+		}
+		out.DHCP = ranges
+	}
+	if len(doc.Unknown) > 0 {
+		err = errors.Join(err, doc.Unknown)
+	}
+	return out, errors.Join(err, keysErr)
+}
+
+// keyRecords returns the records of Keys. Keys which are missing or fail to
+// parse are reported in the returned error without affecting the others.
+func (s *SubnetsSource) keyRecords(env SourceEnv) (SourceRecords, error) {
+	var out SourceRecords
+	var errs []string
+	for _, key := range s.Keys {
+		origin := fmt.Sprintf("%s/%s/%s", env.Secret.Namespace, env.Secret.Name, key)
+		content, exists := env.Secret.Data[key]
+		if !exists {
+			errs = append(errs, fmt.Sprintf("%s: no such key", origin))
+			continue
+		}
+		records, err := parseRecordFile(key, string(content), record.SourceSubnets, origin, env.Options)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", origin, err))
+		}
+		out.add(records)
+	}
+	if len(errs) > 0 {
+		return out, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return out, nil
+}
+
+// CIDRSource names every address of a list of CIDRs with the default name
+// template, or with dnsmasq synth-domain directives.
+type CIDRSource struct {
+	CIDRs []string
+	// SynthDomain, when set, names the CIDRs with dnsmasq synth-domain
+	// directives instead of one record per address. It requires
+	// OutputDnsmasq.
+	SynthDomain string
+	SynthPrefix string
+}
+
+func (s *CIDRSource) Kind() record.SourceKind {
+	return record.SourceCIDR
+}
+
+func (s *CIDRSource) Records(ctx context.Context, env SourceEnv) (SourceRecords, error) {
+	opts := env.Options
+	if s.SynthDomain != "" {
+		// dnsmasq names synth-domain ranges itself, so their size is not a
+		// concern
+		opts.MaxCIDRAddresses = math.MaxUint64
+	}
+	cidrs, err := processCIDRs(ctx, s.CIDRs, opts)
+	if err != nil {
+		return SourceRecords{}, fmt.Errorf("unable to process additional CIDRs: %v", err)
+	}
+
+	var out SourceRecords
+	if s.SynthDomain != "" {
+		for _, prefix := range cidrs.Prefixes() {
+			synth, err := NewSynthDomain(s.SynthDomain, prefix.String(), s.SynthPrefix)
+			if err != nil {
+				return SourceRecords{}, fmt.Errorf("unable to process additional CIDRs: %v", err)
+			}
+			out.Synths = append(out.Synths, synth)
+		}
+		return out, nil
+	}
+	for _, expansion := range cidrExpansions(ctx, cidrs, opts) {
+		out.Streams = append(out.Streams, expansion.Records)
+	}
+	return out, nil
+}
+
+// NetworkSource names the machine network and IPv6 range of every
+// vsphere-capacity-manager Network.
+type NetworkSource struct {
+	Namespace string
+	// Selector, when set, limits the source to matching Networks.
+	Selector labels.Selector
+	// LeaseNamer, when set, names the addresses of networks held by a Lease.
+	// They revert to the default namer when the lease is released. Their
+	// records take the precedence of record.SourceLease.
+	LeaseNamer *Namer
+}
+
+func (s *NetworkSource) Kind() record.SourceKind {
+	return record.SourceNetwork
+}
+
+// Records returns the records of every valid network. Invalid networks are
+// logged and skipped.
+func (s *NetworkSource) Records(ctx context.Context, env SourceEnv) (SourceRecords, error) {
+	logr := log.FromContext(ctx)
+	listOpts := []client.ListOption{client.InNamespace(s.Namespace)}
+	if s.Selector != nil {
+		listOpts = append(listOpts, client.MatchingLabelsSelector{Selector: s.Selector})
+	}
+	var networkList vcmv1.NetworkList
+	if err := env.Client.List(ctx, &networkList, listOpts...); err != nil {
+		return SourceRecords{}, fmt.Errorf("unable to list networks: %v", err)
+	}
+
+	var leases map[string]*vcmv1.Lease
+	if s.LeaseNamer != nil {
+		var leaseList vcmv1.LeaseList
+		if err := env.Client.List(ctx, &leaseList, client.InNamespace(s.Namespace)); err != nil {
+			// leased networks fall back to the default names
+			logr.Error(err, "unable to list leases")
+		}
+		leases = networkLeases(networkList.Items, leaseList.Items)
+	}
+
+	var out SourceRecords
+	opts := env.Options
+	for _, network := range networkList.Items {
+		logr.V(1).Info("processing VCM network", "network", network.Name)
+		data := networkNameData(&network)
+		networkOpts := opts
+		lease, leased := leases[network.Name]
+		if leased {
+			data = data.withLease(lease)
+		}
+		expansion, err := processCIDR(ctx, network.Spec.MachineNetworkCidr, data, networkSource(&network), opts)
+		if err != nil {
+			logr.V(1).Info(fmt.Sprintf("unable to process additional CIDR: %v", err))
+			continue
+		}
+		if leased {
+			logr.V(1).Info("naming leased network", "network", network.Name, "lease", lease.Name)
+			if networkOpts.Namer, err = s.leaseNamer(data, expansion.prefix.Addr(), opts.Namer); err != nil {
+				logr.Error(err, "using default names", "network", network.Name)
+				leased = false
+			}
+			expansion.namer = networkOpts.Namer
+			if leased {
+				expansion.source.Lease = lease.Name
+			}
+		}
+		gateway, ok, err := networkGateway(&network, opts)
+		if err != nil {
+			logr.V(1).Info(fmt.Sprintf("unable to name gateway: %v", err))
+		} else if ok && expansion.prefix.Contains(gateway.Addr) {
+			expansion.fixed = map[netip.Addr]record.Record{gateway.Addr: gateway}
+		} else if ok {
+			out.Records = append(out.Records, gateway)
+		}
+		out.Streams = append(out.Streams, expansion.Records)
+
+		ipv6Records, err := processNetworkIPv6(&network, data, networkOpts)
+		if err != nil {
+			logr.V(1).Info(fmt.Sprintf("unable to process IPv6 range: %v", err))
+			continue
+		}
+		if leased {
+			for i := range ipv6Records {
+				ipv6Records[i].Source.Lease = lease.Name
+			}
+		}
+		logr.V(1).Info(fmt.Sprintf("appending %d IPv6 records", len(ipv6Records)))
+		out.Records = append(out.Records, ipv6Records...)
+	}
+	return out, nil
+}
+
+func (s *NetworkSource) watch(b *builder.Builder) *builder.Builder {
+	b = watchObjects(b, &vcmv1.Network{}, s.Namespace, s.Selector)
+	if s.LeaseNamer != nil {
+		b = watchObjects(b, &vcmv1.Lease{}, s.Namespace, nil)
+	}
+	return b
+}
+
+// DefaultConfigMapSelector selects the ConfigMaps read by ConfigMapSource.
+const DefaultConfigMapSelector = "ptr-record-operator.splat.io/records=true"
+
+// ConfigMapSource reads records from every key of the selected ConfigMaps.
+// Keys are parsed as by parseRecordFile.
+type ConfigMapSource struct {
+	Namespace string
+	Selector  labels.Selector
+}
+
+func (s *ConfigMapSource) Kind() record.SourceKind {
+	return record.SourceConfigMap
+}
+
+// Records returns the records of every ConfigMap key. Keys which fail to
+// parse are reported in the returned error without affecting the others.
+func (s *ConfigMapSource) Records(ctx context.Context, env SourceEnv) (SourceRecords, error) {
+	var configMaps corev1.ConfigMapList
+	if err := env.Client.List(ctx, &configMaps, client.InNamespace(s.Namespace), client.MatchingLabelsSelector{Selector: s.Selector}); err != nil {
+		return SourceRecords{}, fmt.Errorf("unable to list config maps: %v", err)
+	}
+
+	var out SourceRecords
+	var errs []string
+	for _, configMap := range configMaps.Items {
+		keys := make([]string, 0, len(configMap.Data))
+		for key := range configMap.Data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			origin := fmt.Sprintf("%s/%s/%s", configMap.Namespace, configMap.Name, key)
+			records, err := parseRecordFile(key, configMap.Data[key], record.SourceConfigMap, origin, env.Options)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", origin, err))
+			}
+			out.add(records)
+		}
+	}
+	if len(errs) > 0 {
+		return out, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return out, nil
+}
+
+func (s *ConfigMapSource) watch(b *builder.Builder) *builder.Builder {
+	return watchObjects(b, &corev1.ConfigMap{}, s.Namespace, s.Selector)
+}
+
+// FileSource reads records from local files, which are read again on every
+// reconcile. Files are parsed as by parseRecordFile.
+type FileSource struct {
+	Paths []string
+}
+
+func (s *FileSource) Kind() record.SourceKind {
+	return record.SourceFile
+}
+
+// Records returns the records of every file. Files which cannot be read or
+// parsed are reported in the returned error without affecting the others.
+func (s *FileSource) Records(ctx context.Context, env SourceEnv) (SourceRecords, error) {
+	var out SourceRecords
+	var errs []string
+	for _, filePath := range s.Paths {
+		content, err := os.ReadFile(filePath)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		records, err := parseRecordFile(path.Base(filePath), string(content), record.SourceFile, filePath, env.Options)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", filePath, err))
+		}
+		out.add(records)
+	}
+	if len(errs) > 0 {
+		return out, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return out, nil
+}
+
+// parseRecordFile parses the records of a file, ConfigMap key or Secret key.
+// Names ending in .netbox.json hold a data.NetBoxExport, names ending in
+// .phpipam.json a data.PHPIPAMExport, and other names ending in .json
+// subnets.json content. Anything else is in hosts file format: an address
+// followed by its names on each line, with # starting a comment. Entries
+// which fail to parse are reported in the returned error along with the
+// records of the others. The networks of IPAM exports are expanded as
+// streams by ipamRecords.
+func parseRecordFile(name, content string, kind record.SourceKind, origin string, opts RecordOptions) (SourceRecords, error) {
+	sourceOf := func(datacenter, vlan string) record.Source {
+		return record.Source{Kind: kind, Name: fmt.Sprintf("%s:%s/%s", origin, datacenter, vlan)}
+	}
+	var records []record.Record
+	var err error
+	switch {
+	case strings.HasSuffix(name, ".netbox.json"):
+		subnets, err := data.ParseNetBox([]byte(content))
+		return ipamRecords(subnets, err, opts, sourceOf)
+	case strings.HasSuffix(name, ".phpipam.json"):
+		subnets, err := data.ParsePHPIPAM([]byte(content))
+		return ipamRecords(subnets, err, opts, sourceOf)
+	case strings.HasSuffix(name, ".json"):
+		records, err = parseSubnets(content, opts, sourceOf)
+	default:
+		records, err = parseHosts(content, record.Source{Kind: kind, Name: origin})
+	}
+	return SourceRecords{Records: records}, err
+}
+
+// parseHosts parses content in hosts file format.
+func parseHosts(content string, source record.Source) ([]record.Record, error) {
+	var records []record.Record
+	var errs []string
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		rec, err := parseHostsLine(fields, source)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("line %d: %v", line, err))
+			continue
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return records, fmt.Errorf("unable to read: %w", err)
+	}
+	if len(errs) > 0 {
+		return records, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return records, nil
+}
+
+func parseHostsLine(fields []string, source record.Source) (record.Record, error) {
+	if len(fields) < 2 {
+		return record.Record{}, fmt.Errorf("expected an address followed by at least one name")
+	}
+	addr, err := netip.ParseAddr(fields[0])
+	if err != nil {
+		return record.Record{}, err
+	}
+	for _, name := range fields[1:] {
+		if err := ValidateHostname(name); err != nil {
+			return record.Record{}, err
+		}
+	}
+	return record.New(addr, source, fields[1:]...)
+}
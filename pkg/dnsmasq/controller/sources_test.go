@@ -0,0 +1,215 @@
+package controller
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+	corev1 "k8s.io/api/core/v1"
+	kuberecord "k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestParseHosts(t *testing.T) {
+	content := `# static records
+10.0.0.1 gw.example.com gateway.example.com
+10.0.0.2 # no names
+fd00::5 v6.example.com
+
+not-an-address host.example.com
+10.0.0.3 bad_name!
+`
+	source := record.Source{Kind: record.SourceFile, Name: "hosts"}
+	records, err := parseHosts(content, source)
+	if err == nil {
+		t.Fatal("Expected an error for the invalid lines")
+	}
+	for _, line := range []string{"line 3", "line 6", "line 7"} {
+		if !strings.Contains(err.Error(), line) {
+			t.Errorf("Expected the error to report %s, got %v", line, err)
+		}
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(records))
+	}
+	if records[0].Name() != "gw.example.com" || len(records[0].Names) != 2 || records[0].Source != source {
+		t.Errorf("Unexpected record %v", records[0])
+	}
+	if records[1].Reverse != "5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa." {
+		t.Errorf("Unexpected reverse name %s", records[1].Reverse)
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	dir := t.TempDir()
+	hostsPath := filepath.Join(dir, "static.hosts")
+	if err := os.WriteFile(hostsPath, []byte("10.0.0.1 gw.example.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	subnetsPath := filepath.Join(dir, "lab.json")
+	subnets := `{"dc1": {"100": {"cidr": 30, "network": "10.1.0.0", "virtualcenter": "vcenter.example.com", "ipAddresses": ["10.1.0.0", "10.1.0.1", "10.1.0.2", "10.1.0.3"], "mask": "255.255.255.252"}}}`
+	if err := os.WriteFile(subnetsPath, []byte(subnets), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	missingPath := filepath.Join(dir, "missing.hosts")
+
+	namer, err := NewNamer(DefaultNameTemplate)
+	if err != nil {
+		t.Fatalf("Error parsing template: %v", err)
+	}
+	source := &FileSource{Paths: []string{hostsPath, missingPath, subnetsPath}}
+	out, err := source.Records(context.TODO(), SourceEnv{Options: RecordOptions{Namer: namer, MaxIPv6Range: DefaultMaxIPv6Range}})
+	if err == nil || !strings.Contains(err.Error(), "missing.hosts") {
+		t.Errorf("Expected the missing file to be reported, got %v", err)
+	}
+	// the missing file does not affect the others
+	if len(out.Records) != 5 {
+		t.Fatalf("Expected 5 records, got %d", len(out.Records))
+	}
+	if out.Records[0].Source != (record.Source{Kind: record.SourceFile, Name: hostsPath}) {
+		t.Errorf("Unexpected source %v", out.Records[0].Source)
+	}
+	if want := (record.Source{Kind: record.SourceFile, Name: subnetsPath + ":dc1/100"}); out.Records[1].Source != want {
+		t.Errorf("Expected source %v, got %v", want, out.Records[1].Source)
+	}
+}
+
+func TestReportSourceError(t *testing.T) {
+	recorder := kuberecord.NewFakeRecorder(10)
+	r := &SecretReconciler{Recorder: recorder}
+	r.reportSourceError(context.TODO(), &corev1.Secret{}, &FileSource{}, fmt.Errorf("unable to read"))
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "SourceFailed") || !strings.Contains(event, "file: unable to read") {
+			t.Errorf("Unexpected event %q", event)
+		}
+	default:
+		t.Error("Expected a SourceFailed event")
+	}
+}
+
+// testSource returns fixed records, and err.
+type testSource struct {
+	records []record.Record
+	err     error
+}
+
+func (s *testSource) Kind() record.SourceKind {
+	return record.SourceFile
+}
+
+func (s *testSource) Records(ctx context.Context, env SourceEnv) (SourceRecords, error) {
+	return SourceRecords{Records: s.records}, s.err
+}
+
+func TestReconcileHoldsFailedSources(t *testing.T) {
+	c := newObjectClient()
+	config := &corev1.Secret{}
+	config.Namespace, config.Name = "test-credentials", "vsphere-config"
+	tsig := &corev1.Secret{Data: map[string][]byte{TSIGKeyName: []byte("ci-key"), TSIGSecret: []byte(testTSIGSecret)}}
+	tsig.Namespace, tsig.Name = "dns", "tsig"
+	pdnsKey := &corev1.Secret{Data: map[string][]byte{PowerDNSAPIKey: []byte("pdns-key")}}
+	pdnsKey.Namespace, pdnsKey.Name = "dns", "pdns"
+
+	zones := &testZoneServer{zones: map[string][]dns.RR{
+		"74.177.10.in-addr.arpa.": {
+			mustRR(t, "74.177.10.in-addr.arpa. 3600 IN SOA ns1.ci.example. hostmaster.ci.example. 1 3600 900 604800 300"),
+			mustRR(t, "130.74.177.10.in-addr.arpa. 3600 IN PTR live.ci.example."),
+		},
+	}}
+	pdns := &testPowerDNS{zones: map[string]*pdnsZone{
+		"74.177.10.in-addr.arpa.": {Name: "74.177.10.in-addr.arpa.", RRsets: []pdnsRRset{
+			{Name: "130.74.177.10.in-addr.arpa.", Type: "PTR", TTL: 3600, Records: []pdnsRecord{{Content: "live.ci.example."}}, Comments: []pdnsComment{{Content: powerDNSComment, Account: PowerDNSAccount}}},
+		}},
+	}}
+	pdnsServer := httptest.NewServer(pdns.handler())
+	defer pdnsServer.Close()
+	wapi := &testWAPI{objects: map[string]map[string]interface{}{}, pages: map[string]url.Values{}}
+	wapi.add("record:ptr", map[string]interface{}{"ptrdname": "live.ci.example", "ipv4addr": "10.177.74.130", "view": "default", "extattrs": map[string]interface{}{"Owner": map[string]interface{}{"value": InfobloxOwner}}})
+	wapiServer := httptest.NewTLSServer(wapi.handler())
+	defer wapiServer.Close()
+	wapiCreds := &corev1.Secret{Data: map[string][]byte{InfobloxUsername: []byte("admin"), InfobloxPassword: []byte("infoblox"), InfobloxCA: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: wapiServer.Certificate().Raw})}}
+	wapiCreds.Namespace, wapiCreds.Name = "dns", "wapi"
+	for _, secret := range []*corev1.Secret{config, tsig, pdnsKey, wapiCreds} {
+		if err := c.Create(context.Background(), secret); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var targets []Target
+	for _, value := range []string{
+		"rfc2136://" + zones.start(t) + "?secret=dns/tsig&zone=74.177.10.in-addr.arpa",
+		"powerdns://" + strings.TrimPrefix(pdnsServer.URL, "http://") + "?secret=dns/pdns&zone=74.177.10.in-addr.arpa",
+		"infoblox://" + strings.TrimPrefix(wapiServer.URL, "https://") + "?secret=dns/wapi",
+	} {
+		target, err := ParseTarget(value, DefaultRendererOptions())
+		if err != nil {
+			t.Fatalf("Error parsing %s: %v", value, err)
+		}
+		targets = append(targets, target)
+	}
+	rec, err := record.New(netip.MustParseAddr("10.177.74.131"), record.Source{Kind: record.SourceFile}, "other.ci.example.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	healthy := &testSource{records: []record.Record{rec}}
+	r := &SecretReconciler{
+		Client:  c,
+		Sources: []RecordSource{healthy, &testSource{err: fmt.Errorf("unable to read")}},
+		Targets: targets,
+	}
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(config)}
+	if _, err := r.Reconcile(context.Background(), req); err == nil {
+		t.Errorf("Expected a failing source to fail the reconcile")
+	}
+	if zones.updates != 0 || pdns.patches != 0 || wapi.writes != 0 {
+		t.Errorf("Expected no target to be updated, got %d updates, %d patches and %d writes", zones.updates, pdns.patches, wapi.writes)
+	}
+	if len(wapi.find("record:ptr", "ptrdname", "live.ci.example")) != 1 {
+		t.Errorf("Expected the live Infoblox record to be kept")
+	}
+
+	// the live record is only dropped once every source succeeds
+	r.Sources = []RecordSource{healthy}
+	if _, err := r.Reconcile(context.Background(), req); err != nil {
+		t.Fatalf("Error reconciling: %v", err)
+	}
+	if zones.updates == 0 || pdns.patches == 0 || wapi.writes == 0 {
+		t.Errorf("Expected every target to be updated, got %d updates, %d patches and %d writes", zones.updates, pdns.patches, wapi.writes)
+	}
+
+	// once a source returned its records in full, they are kept for the
+	// addresses it no longer returns while it fails, and the valid records
+	// are still published
+	newRecord := func(addr, name string) record.Record {
+		rec, err := record.New(netip.MustParseAddr(addr), record.Source{Kind: record.SourceFile, Name: "flaky"}, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+	flaky := &testSource{records: []record.Record{newRecord("10.177.74.132", "held.ci.example."), newRecord("10.177.74.133", "before.ci.example.")}}
+	r.Sources = []RecordSource{healthy, flaky}
+	if _, err := r.Reconcile(context.Background(), req); err != nil {
+		t.Fatalf("Error reconciling: %v", err)
+	}
+	flaky.records, flaky.err = []record.Record{newRecord("10.177.74.133", "after.ci.example.")}, fmt.Errorf("unable to read")
+	if _, err := r.Reconcile(context.Background(), req); err != nil {
+		t.Fatalf("Expected the records of a failing source to be held, got %v", err)
+	}
+	for addr, expected := range map[string]string{"10.177.74.131": "other.ci.example", "10.177.74.132": "held.ci.example", "10.177.74.133": "after.ci.example"} {
+		if ptrs := wapi.find("record:ptr", "ipv4addr", addr); len(ptrs) != 1 || ptrs[0]["ptrdname"] != expected {
+			t.Errorf("Expected one PTR record of %s pointing at %s, got %v", addr, expected, ptrs)
+		}
+	}
+}
@@ -1,27 +1,518 @@
 package controller
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"net/netip"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	vcmv1 "github.com/openshift-splat-team/vsphere-capacity-manager/pkg/apis/vspherecapacitymanager.splat.io/v1"
+	"github.com/openshift-splat-team/vsphere-ci-dns/data"
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
 )
 
 func TestParseSubnets(t *testing.T) {
-	records, err := SubnetParse(SUBNETS_JSON)
+	records, err := parseSubnets(SUBNETS_JSON, RecordOptions{MaxIPv6Range: DefaultMaxIPv6Range}, subnetsSource)
 	if err != nil {
 		t.Errorf("Error parsing subnets: %v", err)
 	}
+	ipv6 := 0
+	for _, rec := range records {
+		if rec.Family == record.IPv6 {
+			ipv6++
+		}
+	}
+	if len(records)-ipv6 != 8864 {
+		t.Errorf("Expected 8864 IPv4 records, got %d", len(records)-ipv6)
+	}
+	// 66 of the 67 subnets carry a ::4-::64 IPv6 range
+	if ipv6 != 6402 {
+		t.Errorf("Expected 6402 IPv6 records, got %d", ipv6)
+	}
+}
+
+func TestIPv6RangeLimit(t *testing.T) {
+	records, err := parseSubnets(SUBNETS_JSON, RecordOptions{MaxIPv6Range: 64}, subnetsSource)
+	var subnetErrs data.SubnetErrors
+	if !errors.As(err, &subnetErrs) || len(subnetErrs) != 66 {
+		t.Errorf("Expected 66 subnet errors, got %v", err)
+	}
 	if len(records) != 8864 {
 		t.Errorf("Expected 8864 records, got %d", len(records))
 	}
+
+	start, stop := netip.MustParseAddr("fd65:a1a8:60ad:1153::"), netip.MustParseAddr("fd65:a1a8:60ad:1153:ffff:ffff:ffff:ffff")
+	if _, err := processIPv6Range(start, stop, NameData{}, record.Source{}, RecordOptions{MaxIPv6Range: DefaultMaxIPv6Range}); err == nil {
+		t.Errorf("Expected a /64 to exceed the range limit")
+	}
+}
+
+func TestSubnetConflicts(t *testing.T) {
+	namer, err := NewNamer("ip-{{.Dashed}}.vlan{{.Vlan}}.{{.Datacenter}}.ci.example.")
+	if err != nil {
+		t.Fatalf("Error parsing template: %v", err)
+	}
+	records, err := parseSubnets(SUBNETS_JSON, RecordOptions{Namer: namer, MaxIPv6Range: DefaultMaxIPv6Range}, subnetsSource)
+	if err != nil {
+		t.Fatalf("Error parsing subnets: %v", err)
+	}
+
+	// seven VLANs reuse the IPv6 prefix of a VLAN in another datacenter
+	set := record.NewSet(nil)
+	set.Add(records...)
+	if len(set.Conflicts()) != 7*97 {
+		t.Errorf("Expected %d conflicts, got %d", 7*97, len(set.Conflicts()))
+	}
+	kept, _ := set.Get(netip.MustParseAddr("fd65:a1a8:60ad:1225::4"))
+	if kept.Source.Name != "bcr01a.dal10/1225" {
+		t.Errorf("Expected bcr01a.dal10/1225 to be kept, got %s", kept.Source)
+	}
+}
+
+func TestNetworkIPv6(t *testing.T) {
+	count := uint(3)
+	network := &vcmv1.Network{
+		Spec: vcmv1.NetworkSpec{
+			IpV6prefix:       "fd65:a1a8:60ad:1153::/64",
+			StartIPv6Address: "fd65:a1a8:60ad:1153::4",
+			IpAddressCount:   &count,
+		},
+	}
+	records, err := processNetworkIPv6(network, networkNameData(network), RecordOptions{MaxIPv6Range: DefaultMaxIPv6Range})
+	if err != nil {
+		t.Fatalf("Error processing network: %v", err)
+	}
+	expected := `fd65:a1a8:60ad:1153::4 4.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.3.5.1.1.d.a.0.6.8.a.1.a.5.6.d.f.ip6.arpa.
+fd65:a1a8:60ad:1153::5 5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.3.5.1.1.d.a.0.6.8.a.1.a.5.6.d.f.ip6.arpa.
+fd65:a1a8:60ad:1153::6 6.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.3.5.1.1.d.a.0.6.8.a.1.a.5.6.d.f.ip6.arpa.
+`
+	if hosts := render(t, OutputHosts, DnsmasqConfig{}, records); hosts != expected {
+		t.Errorf("Expected %v, got %v", expected, hosts)
+	}
 }
 
 func TestAdditionalSubnets(t *testing.T) {
-	records, err := processCIDR(context.TODO(), "192.168.0.0/16")
+	expansion, err := processCIDR(context.TODO(), "192.168.0.0/16", NameData{}, record.Source{}, RecordOptions{MaxCIDRAddresses: DefaultMaxCIDRAddresses})
 	if err != nil {
 		t.Errorf("Error parsing subnets: %v", err)
 	}
-	if len(records) != 65536 {
-		t.Errorf("Expected 65536 records, got %d", len(records))
+	records, err := record.Count(expansion.Records())
+	if err != nil {
+		t.Errorf("Error expanding subnets: %v", err)
+	}
+	if records != 65536 {
+		t.Errorf("Expected 65536 records, got %d", records)
+	}
+}
+
+func TestAdditionalSubnetsLimit(t *testing.T) {
+	for _, cidr := range []string{"10.0.0.0/8", "10.0.0.0/11", "fd65::/64"} {
+		if _, err := processCIDR(context.TODO(), cidr, NameData{}, record.Source{}, RecordOptions{MaxCIDRAddresses: DefaultMaxCIDRAddresses}); err == nil {
+			t.Errorf("Expected %s to exceed the CIDR limit", cidr)
+		}
+	}
+}
+
+func TestOverlappingAdditionalSubnets(t *testing.T) {
+	opts := RecordOptions{MaxCIDRAddresses: DefaultMaxCIDRAddresses}
+	cidrs, err := processCIDRs(context.TODO(), []string{"192.168.0.0/16", "192.168.10.0/24", "10.38.0.0/24", "10.38.1.0/24"}, opts)
+	if err != nil {
+		t.Fatalf("Error processing CIDRs: %v", err)
+	}
+	var iters []record.Iterator
+	for _, expansion := range cidrExpansions(context.TODO(), cidrs, opts) {
+		iters = append(iters, expansion.Records())
+	}
+	conflicts := 0
+	records, err := record.Collect(record.Merge(nil, func(record.Conflict) { conflicts++ }, iters...))
+	if err != nil {
+		t.Fatalf("Error expanding CIDRs: %v", err)
+	}
+	if len(records) != 65536+512 || conflicts != 0 {
+		t.Errorf("Expected %d records without conflicts, got %d records and %d conflicts", 65536+512, len(records), conflicts)
+	}
+	for _, rec := range records {
+		if rec.Addr.Is4() && rec.Addr.As4()[0] == 192 && rec.Source.Name != "192.168.0.0/16" {
+			t.Fatalf("Expected %s to be owned by 192.168.0.0/16, got %s", rec.Addr, rec.Source)
+		}
+	}
+	if prefixes := cidrs.Prefixes(); len(prefixes) != 2 || prefixes[0].String() != "10.38.0.0/23" {
+		t.Errorf("Expected 10.38.0.0/23 and 192.168.0.0/16, got %v", prefixes)
+	}
+}
+
+func TestStreamingRender(t *testing.T) {
+	subnets, err := parseSubnets(SUBNETS_JSON, RecordOptions{MaxIPv6Range: DefaultMaxIPv6Range}, subnetsSource)
+	if err != nil {
+		t.Fatalf("Error parsing subnets: %v", err)
+	}
+	set := record.NewSet(nil)
+	set.Add(subnets...)
+	explicit := set.Records()
+
+	opts := RecordOptions{MaxCIDRAddresses: DefaultMaxCIDRAddresses}
+	additional, err := processCIDR(context.TODO(), "192.168.0.0/16", NameData{}, record.Source{Kind: record.SourceCIDR}, opts)
+	if err != nil {
+		t.Fatalf("Error processing CIDR: %v", err)
+	}
+	// overlaps the first subnet of SUBNETS_JSON
+	overlapping, err := processCIDR(context.TODO(), "10.177.74.0/24", NameData{}, record.Source{Kind: record.SourceNetwork}, opts)
+	if err != nil {
+		t.Fatalf("Error processing CIDR: %v", err)
+	}
+	stream := func() record.Iterator {
+		return record.Merge(nil, nil, record.FromSlice(explicit), additional.Records(), overlapping.Records())
+	}
+
+	var size countingWriter
+	if err := writeAdditionalHosts(&size, stream()); err != nil {
+		t.Fatalf("Error rendering: %v", err)
+	}
+	var rendered bytes.Buffer
+	if err := writeAdditionalHosts(&rendered, stream()); err != nil {
+		t.Fatalf("Error rendering: %v", err)
+	}
+	if int64(rendered.Len()) != size.n {
+		t.Errorf("Expected both passes to render %d bytes, got %d", size.n, rendered.Len())
+	}
+	expected := len(explicit) + 65536 + 128
+	if lines := bytes.Count(rendered.Bytes(), []byte("\n")); lines != expected {
+		t.Errorf("Expected %d lines, got %d", expected, lines)
+	}
+}
+
+func TestClasslessSubnets(t *testing.T) {
+	content := `{
+    "bcr01a.dal10": {
+        "1153": {
+            "cidr": 30,
+            "mask": "255.255.255.252",
+            "network": "10.177.74.128",
+            "ipAddresses": ["10.177.74.129", "10.177.74.130"]
+        }
+    }
+}`
+	records, err := parseSubnets(content, RecordOptions{Classless: true}, subnetsSource)
+	if err != nil {
+		t.Fatalf("Error parsing subnets: %v", err)
+	}
+	expected := `cname=129.74.177.10.in-addr.arpa.,129.128-30.74.177.10.in-addr.arpa.
+ptr-record=129.128-30.74.177.10.in-addr.arpa.,129.74.177.10.in-addr.arpa.
+cname=130.74.177.10.in-addr.arpa.,130.128-30.74.177.10.in-addr.arpa.
+ptr-record=130.128-30.74.177.10.in-addr.arpa.,130.74.177.10.in-addr.arpa.
+`
+	if output := render(t, OutputDnsmasq, DnsmasqConfig{}, records); output != expected {
+		t.Errorf("Expected %q, got %q", expected, output)
+	}
+
+	expansion, err := processCIDR(context.TODO(), "192.168.0.0/25", NameData{}, record.Source{}, RecordOptions{MaxCIDRAddresses: DefaultMaxCIDRAddresses, Classless: true})
+	if err != nil {
+		t.Fatalf("Error processing CIDR: %v", err)
+	}
+	first, _ := expansion.Records().Next()
+	if first.Owner() != "0.0-25.0.168.192.in-addr.arpa." {
+		t.Errorf("Expected the CIDR to be delegated, got %s", first.Owner())
+	}
+}
+
+func TestForwardRecords(t *testing.T) {
+	modes, err := ParsePublishModes(map[string]string{"subnets": "both", "network": "forward"})
+	if err != nil {
+		t.Fatalf("Error parsing publish modes: %v", err)
+	}
+	var records []record.Record
+	for _, r := range []struct {
+		addr   string
+		kind   record.SourceKind
+		prefix string
+	}{
+		{"10.177.74.129", record.SourceSubnets, ""},
+		{"10.177.74.130", record.SourceSubnets, "10.177.74.128/25"},
+		{"10.177.75.1", record.SourceNetwork, ""},
+		{"fd65::1", record.SourceCIDR, ""},
+	} {
+		addr := netip.MustParseAddr(r.addr)
+		rec, err := record.New(addr, record.Source{Kind: r.kind}, "host-"+strings.ReplaceAll(strings.ReplaceAll(r.addr, ".", "-"), ":", "-")+".ci.example.")
+		if err != nil {
+			t.Fatalf("Error creating record: %v", err)
+		}
+		if r.prefix != "" {
+			rec = rec.Delegate(netip.MustParsePrefix(r.prefix))
+		}
+		records = append(records, modes.Apply(rec))
+	}
+
+	expected := `host-record=host-10-177-74-129.ci.example.,10.177.74.129
+host-record=host-10-177-74-130.ci.example.,10.177.74.130
+ptr-record=130.128-25.74.177.10.in-addr.arpa.,host-10-177-74-130.ci.example.
+host-record=host-10-177-75-1.ci.example.,10.177.75.1
+ptr-record=1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.5.6.d.f.ip6.arpa.,host-fd65--1.ci.example.
+`
+	if output := render(t, OutputDnsmasq, DnsmasqConfig{}, records); output != expected {
+		t.Errorf("Expected %q, got %q", expected, output)
+	}
+
+	if _, err := ParsePublishModes(map[string]string{"cidr": "ptr"}); err == nil {
+		t.Errorf("Expected unknown publish mode to be rejected")
+	}
+}
+
+func TestDHCPRanges(t *testing.T) {
+	subnets, err := data.ParseSubnets([]byte(SUBNETS_JSON))
+	ranges, err := subnetDHCPRanges(subnets, err, DHCPOptions{LeaseTime: 12 * time.Hour})
+	if err != nil {
+		t.Fatalf("Error generating DHCP ranges: %v", err)
+	}
+	if len(ranges) != 67 {
+		t.Errorf("Expected 67 DHCP ranges, got %d", len(ranges))
+	}
+	expected := `dhcp-range=set:vlan1153.bcr01a.dal10,10.177.74.130,10.177.74.254,255.255.255.128,43200s
+dhcp-option=tag:vlan1153.bcr01a.dal10,option:router,10.177.74.129
+dhcp-option=tag:vlan1153.bcr01a.dal10,option:dns-server,10.177.74.129
+`
+	var output bytes.Buffer
+	if err := writeDnsmasq(&output, DnsmasqConfig{DHCP: ranges[:1]}, record.FromSlice(nil)); err != nil {
+		t.Fatalf("Error rendering: %v", err)
+	}
+	if output.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, output.String())
+	}
+}
+
+func TestInfrastructureNames(t *testing.T) {
+	reservations, err := ParseReservations(DefaultReservations)
+	if err != nil {
+		t.Fatalf("Error parsing reservations: %v", err)
+	}
+	opts := RecordOptions{Reservations: reservations, MaxIPv6Range: DefaultMaxIPv6Range, MaxCIDRAddresses: DefaultMaxCIDRAddresses}
+	records, err := parseSubnets(SUBNETS_JSON, opts, subnetsSource)
+	if err != nil {
+		t.Fatalf("Error parsing subnets: %v", err)
+	}
+	set := record.NewSet(nil)
+	set.Add(records...)
+	for addr, name := range map[string]string{
+		"10.177.74.129":          "gw.vlan1153.bcr01a.dal10.",
+		"192.168.18.5":           "vif.vlan1153.bcr01a.dal10.",
+		"fd65:a1a8:60ad:1153::1": "vif.vlan1153.bcr01a.dal10.",
+		// bcr01a.dal10 and bcr03a.dal10 both have a VLAN 1225
+		"10.176.82.129": "gw.vlan1225.bcr01a.dal10.",
+		"10.38.83.129":  "gw.vlan1225.bcr03a.dal10.",
+	} {
+		rec, _ := set.Get(netip.MustParseAddr(addr))
+		if rec.Name() != name || rec.Publish != record.PublishBoth {
+			t.Errorf("Expected %s to be published both ways as %s, got %s %s", addr, name, rec.Name(), rec.Publish)
+		}
+	}
+	type forwardKey struct {
+		name string
+		bits int
+	}
+	forward := map[forwardKey]netip.Addr{}
+	for _, rec := range records {
+		if rec.Publish != record.PublishBoth {
+			continue
+		}
+		key := forwardKey{name: rec.Name(), bits: rec.Addr.BitLen()}
+		if other, exists := forward[key]; exists && other != rec.Addr {
+			t.Errorf("Expected every reserved name to resolve to one address, %s resolves to %s and %s", rec.Name(), other, rec.Addr)
+		}
+		forward[key] = rec.Addr
+	}
+
+	gateway, pod := "10.93.60.1", "dal10.pod03"
+	network := &vcmv1.Network{
+		Spec: vcmv1.NetworkSpec{
+			VlanId:                "1240",
+			PodName:               &pod,
+			Gateway:               &gateway,
+			MachineNetworkCidr:    "10.93.60.0/26",
+			PrimaryRouterHostname: "fcr03a.dal10",
+		},
+	}
+	rec, ok, err := networkGateway(network, opts)
+	if err != nil || !ok || rec.Name() != "fcr03a.dal10" {
+		t.Fatalf("Expected the gateway to be named after the router, got %v %v", rec.Name(), err)
+	}
+	network.Spec.PrimaryRouterHostname = ""
+	if rec, _, _ := networkGateway(network, opts); rec.Name() != "gw.vlan1240.dal10.pod03." {
+		t.Errorf("Expected the gateway reservation to name the gateway, got %v", rec.Name())
+	}
+}
+
+func TestSynthDomain(t *testing.T) {
+	synth, err := NewSynthDomain("ci.example.", "192.168.0.0/16", "ip-")
+	if err != nil {
+		t.Fatalf("Error creating synth-domain: %v", err)
+	}
+	var records []record.Record
+	for addr, name := range map[string]string{
+		"192.168.1.1": "ip-192-168-1-1.ci.example.",
+		"192.168.1.2": "bastion.ci.example.",
+		"10.0.0.1":    "ip-10-0-0-1.ci.example.",
+	} {
+		rec, err := record.New(netip.MustParseAddr(addr), record.Source{}, name)
+		if err != nil {
+			t.Fatalf("Error creating record: %v", err)
+		}
+		records = append(records, rec)
+	}
+	record.Sort(records)
+
+	expected := `synth-domain=ci.example,192.168.0.0/16,ip-
+ptr-record=1.0.0.10.in-addr.arpa.,ip-10-0-0-1.ci.example.
+ptr-record=2.1.168.192.in-addr.arpa.,bastion.ci.example.
+`
+	if output := render(t, OutputDnsmasq, DnsmasqConfig{Synths: []SynthDomain{synth}}, records); output != expected {
+		t.Errorf("Expected %q, got %q", expected, output)
+	}
+
+	if _, err := NewSynthDomain("ci.example.", "fd65::/64", "ip-"); err == nil {
+		t.Errorf("Expected IPv6 synth-domain to be rejected")
+	}
+}
+
+func TestParseSubnetsInvalidEntries(t *testing.T) {
+	content := `{
+    "bcr01a.dal10": {
+        "1153": {
+            "cidr": 25,
+            "mask": "255.255.255.128",
+            "network": "10.177.74.128",
+            "ipAddresses": ["10.177.74.129", "10.177.74.130"]
+        },
+        "1179": {
+            "cidr": 25,
+            "mask": "255.255.255.0",
+            "network": "10.177.186.0",
+            "ipAddresses": ["10.177.186.1"]
+        },
+        "1211": {
+            "cidr": 25,
+            "mask": "255.255.255.128",
+            "network": "10.176.54.1",
+            "ipAddresses": ["10.176.54.2", "10.176.55.2"]
+        },
+        "1225": {
+            "cidr": 25,
+            "network": "10.176.82.128",
+            "ipAddresses": "10.176.82.129"
+        }
+    }
+}`
+	records, err := parseSubnets(content, RecordOptions{MaxIPv6Range: DefaultMaxIPv6Range}, subnetsSource)
+	if len(records) != 2 {
+		t.Errorf("Expected 2 records, got %d", len(records))
+	}
+
+	var subnetErrs data.SubnetErrors
+	if !errors.As(err, &subnetErrs) {
+		t.Fatalf("Expected subnet errors, got %v", err)
+	}
+	paths := map[string]int{}
+	for _, subnetErr := range subnetErrs {
+		paths[subnetErr.Path()]++
+	}
+	expected := map[string]int{
+		"bcr01a.dal10/1179": 1,
+		"bcr01a.dal10/1211": 2,
+		"bcr01a.dal10/1225": 1,
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected errors for %v, got %v", expected, subnetErrs)
+	}
+}
+
+func TestReservedAddresses(t *testing.T) {
+	content := `{
+    "bcr01a.dal10": {
+        "1153": {
+            "cidr": 29,
+            "mask": "255.255.255.248",
+            "network": "10.177.74.128",
+            "gateway": "10.177.74.129",
+            "ipAddresses": ["10.177.74.128", "10.177.74.129", "10.177.74.130", "10.177.74.131", "10.177.74.132", "10.177.74.133", "10.177.74.134", "10.177.74.135"],
+            "VifIpAddress": "192.168.18.5",
+            "DhcpEndLocation": 4
+        }
+    }
+}`
+	reservations, err := ParseReservations(map[string]string{
+		"gateway": "gw.vlan{{.Vlan}}.{{.Datacenter}}.",
+		"vif":     "vif.vlan{{.Vlan}}.{{.Datacenter}}.",
+		"dhcp":    "",
+	})
+	if err != nil {
+		t.Fatalf("Error parsing reservations: %v", err)
+	}
+	records, err := parseSubnets(content, RecordOptions{Reservations: reservations, SkipNetworkBroadcast: true}, subnetsSource)
+	if err != nil {
+		t.Fatalf("Error parsing subnets: %v", err)
+	}
+
+	set := record.NewSet(nil)
+	set.Add(records...)
+	// the dhcp pool shadows the additional CIDR without publishing anything
+	additional, err := processCIDR(context.TODO(), "10.177.74.128/29", NameData{}, record.Source{Kind: record.SourceCIDR}, RecordOptions{MaxCIDRAddresses: DefaultMaxCIDRAddresses})
+	if err != nil {
+		t.Fatalf("Error processing CIDR: %v", err)
+	}
+	published, err := record.Collect(record.Published(record.Merge(nil, nil, record.FromSlice(set.Records()), additional.Records())))
+	if err != nil {
+		t.Fatalf("Error merging records: %v", err)
+	}
+
+	expected := `10.177.74.128 128.74.177.10.in-addr.arpa.
+10.177.74.129 gw.vlan1153.bcr01a.dal10.
+10.177.74.133 133.74.177.10.in-addr.arpa.
+10.177.74.134 134.74.177.10.in-addr.arpa.
+10.177.74.135 135.74.177.10.in-addr.arpa.
+192.168.18.5 vif.vlan1153.bcr01a.dal10.
+`
+	if hosts := render(t, OutputHosts, DnsmasqConfig{}, published); hosts != expected {
+		t.Errorf("Expected %v, got %v", expected, hosts)
+	}
+
+	if _, err := ParseReservations(map[string]string{"router": ""}); err == nil {
+		t.Errorf("Expected unknown role to be rejected")
+	}
+}
+
+func TestAddressFilters(t *testing.T) {
+	filters, err := ParseFilters([]string{"cidr=192.168.0.0/16"}, []string{"cidr=192.168.1.0/24", "network=10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("Error parsing filters: %v", err)
+	}
+	for addr, expected := range map[string]bool{
+		"192.168.0.1": true,
+		"192.168.1.1": false,
+		"172.16.0.1":  false,
+	} {
+		if allowed := filters[record.SourceCIDR].Allows(netip.MustParseAddr(addr)); allowed != expected {
+			t.Errorf("Expected %s allowed to be %v", addr, expected)
+		}
+	}
+
+	opts := RecordOptions{MaxCIDRAddresses: DefaultMaxCIDRAddresses, SkipNetworkBroadcast: true}
+	expansion, err := processCIDR(context.TODO(), "192.168.0.0/23", NameData{}, record.Source{Kind: record.SourceCIDR}, opts)
+	if err != nil {
+		t.Fatalf("Error processing CIDR: %v", err)
+	}
+	count, err := record.Count(record.Filter(expansion.Records(), filters.Allows))
+	if err != nil {
+		t.Fatalf("Error expanding CIDR: %v", err)
+	}
+	// 192.168.0.0/24 less the network address
+	if count != 255 {
+		t.Errorf("Expected 255 records, got %d", count)
+	}
+
+	if _, err := ParseFilters([]string{"cidr"}, nil); err == nil {
+		t.Errorf("Expected a filter without a prefix to be rejected")
 	}
 }
 
@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+)
+
+// SynthDomain is an IPv4 range named by dnsmasq itself with a synth-domain
+// directive rather than one record per address. Every address in Prefix
+// resolves to <NamePrefix><dashed address>.<Domain>, e.g. ip-192-168-0-1.example.com.
+type SynthDomain struct {
+	Domain     string
+	Prefix     netip.Prefix
+	NamePrefix string
+}
+
+// NewSynthDomain returns the synth-domain for cidr.
+func NewSynthDomain(domain, cidr, namePrefix string) (SynthDomain, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return SynthDomain{}, err
+	}
+	if !prefix.Addr().Is4() {
+		return SynthDomain{}, fmt.Errorf("synth-domain is only supported for IPv4 ranges, not %s", cidr)
+	}
+	synth := SynthDomain{
+		Domain:     strings.TrimSuffix(domain, "."),
+		Prefix:     prefix.Masked(),
+		NamePrefix: namePrefix,
+	}
+	if err := ValidateHostname(synth.Name(synth.Prefix.Addr())); err != nil {
+		return SynthDomain{}, fmt.Errorf("invalid synth-domain: %v", err)
+	}
+	return synth, nil
+}
+
+// Name returns the name dnsmasq synthesizes for addr.
+func (s SynthDomain) Name(addr netip.Addr) string {
+	return fmt.Sprintf("%s%s.%s", s.NamePrefix, strings.ReplaceAll(addr.String(), ".", "-"), s.Domain)
+}
+
+// Directive returns the dnsmasq configuration line for the range.
+func (s SynthDomain) Directive() string {
+	return fmt.Sprintf("synth-domain=%s,%s,%s", s.Domain, s.Prefix, s.NamePrefix)
+}
+
+// Covers returns true if rec is already answered by the synth-domain, so no
+// explicit record is needed for it.
+func (s SynthDomain) Covers(rec record.Record) bool {
+	return s.Prefix.Contains(rec.Addr) && len(rec.Names) == 1 &&
+		strings.EqualFold(strings.TrimSuffix(rec.Name(), "."), s.Name(rec.Addr))
+}
+
+// covered returns true if rec is covered by any of synths.
+func covered(rec record.Record, synths []SynthDomain) bool {
+	for _, synth := range synths {
+		if synth.Covers(rec) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// DefaultTargetPath is the file written on a target server.
+	DefaultTargetPath = "/opt/ci-dns/additional-hosts"
+	// DefaultReloadCommand is run on a target server once its file is
+	// written.
+	DefaultReloadCommand = "sudo systemctl restart dnsmasq"
+)
+
+// Target is a DNS server the records are pushed to over SSH, or by its
+// Publisher.
+type Target struct {
+	Server   string
+	Renderer Renderer
+	// Path is the file written on the server.
+	Path string
+	// Reload makes the DNS server load the file.
+	Reload string
+	// Publisher delivers the records instead of SSH when set.
+	Publisher Publisher
+}
+
+// Publisher delivers the records to a DNS server by other means than a file
+// pushed over SSH.
+type Publisher interface {
+	// Format is the output format whose records and flags the publisher
+	// supports.
+	Format() OutputFormat
+	Publish(ctx context.Context, c client.Client, in RenderInput) error
+	String() string
+}
+
+// publishers creates the publisher of each target URL scheme.
+var publishers = map[string]func(u *url.URL, opts RendererOptions) (Publisher, error){
+	"coredns":  newCoreDNSPublisher,
+	"infoblox": newInfobloxPublisher,
+	"powerdns": newPowerDNSPublisher,
+	"rfc2136":  newRFC2136Publisher,
+}
+
+// ParseTarget parses a target given as server=format, optionally followed by
+// :path, e.g. 10.0.0.53=dnsmasq:/etc/dnsmasq.d/ci.conf. The reload of unbound
+// targets may follow the format, as in 10.0.0.53=unbound+local_datas. Targets
+// which are not reached over SSH are given as URLs, such as
+// coredns://namespace/name.
+func ParseTarget(value string, opts RendererOptions) (Target, error) {
+	if scheme, _, ok := strings.Cut(value, "://"); ok {
+		newPublisher, ok := publishers[scheme]
+		if !ok {
+			return Target{}, fmt.Errorf("invalid target %q: unknown scheme %q, expected one of %s", value, scheme, strings.Join(publisherSchemes(), ", "))
+		}
+		u, err := url.Parse(value)
+		if err != nil {
+			return Target{}, fmt.Errorf("invalid target %q: %v", value, err)
+		}
+		publisher, err := newPublisher(u, opts)
+		if err != nil {
+			return Target{}, fmt.Errorf("invalid target %q: %v", value, err)
+		}
+		return Target{Server: u.Host, Publisher: publisher}, nil
+	}
+	server, spec, ok := strings.Cut(value, "=")
+	if !ok || server == "" {
+		return Target{}, fmt.Errorf("invalid target %q: expected server=format[+reload][:path]", value)
+	}
+	name, path, _ := strings.Cut(spec, ":")
+	name, reload, hasReload := strings.Cut(name, "+")
+	format, err := ParseOutputFormat(name)
+	if err != nil {
+		return Target{}, fmt.Errorf("invalid target %q: %v", value, err)
+	}
+	if hasReload {
+		if format != OutputUnbound {
+			return Target{}, fmt.Errorf("invalid target %q: only unbound targets select their reload", value)
+		}
+		opts.Unbound.Reload = UnboundReload(reload)
+	}
+	target, err := NewTarget(server, format, path, opts)
+	if err != nil {
+		return Target{}, fmt.Errorf("invalid target %q: %v", value, err)
+	}
+	return target, nil
+}
+
+// NewTarget returns the target writing format to path on server, or to the
+// default path of the format if path is empty.
+func NewTarget(server string, format OutputFormat, path string, opts RendererOptions) (Target, error) {
+	renderer, err := NewRenderer(format, opts)
+	if err != nil {
+		return Target{}, err
+	}
+	target := Target{Server: server, Renderer: renderer, Path: path, Reload: DefaultReloadCommand}
+	defaults, ok := renderer.(targetDefaulter)
+	if target.Path == "" {
+		target.Path = DefaultTargetPath
+		if ok {
+			target.Path = defaults.defaultPath()
+		}
+	}
+	if ok {
+		target.Reload = defaults.reloadCommand(target.Path)
+	}
+	return target, nil
+}
+
+func publisherSchemes() []string {
+	schemes := make([]string, 0, len(publishers))
+	for scheme := range publishers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Format returns the output format of the target.
+func (t Target) Format() OutputFormat {
+	if t.Publisher != nil {
+		return t.Publisher.Format()
+	}
+	return t.Renderer.Format()
+}
+
+func (t Target) String() string {
+	if t.Publisher != nil {
+		return t.Publisher.String()
+	}
+	return fmt.Sprintf("%s=%s:%s", t.Server, t.Renderer.Format(), t.Path)
+}
@@ -0,0 +1,261 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+)
+
+const (
+	// DefaultUnboundPath is the file written on unbound targets, included
+	// by the stock unbound.conf.
+	DefaultUnboundPath = "/etc/unbound/unbound.conf.d/ci-dns.conf"
+	// unboundControl runs unbound-control on a target server.
+	unboundControl = "sudo unbound-control"
+)
+
+// UnboundReload selects how an unbound target loads the file.
+type UnboundReload string
+
+const (
+	// UnboundFullReload reloads unbound, flushing its cache.
+	UnboundFullReload UnboundReload = "reload"
+	// UnboundLocalDatas adds and removes the changed local-zones and
+	// local-data with unbound-control, reloading unbound only for the first
+	// push of the process. The file is still written, for the next restart.
+	UnboundLocalDatas UnboundReload = "local_datas"
+)
+
+// UnboundOptions controls the configuration written by the unbound renderer.
+type UnboundOptions struct {
+	// ZoneType is the local-zone type of the reverse zones: static answers
+	// NXDOMAIN for addresses without a record, transparent resolves them as
+	// usual.
+	ZoneType string
+	// IPv4Bits and IPv6Bits are the prefix lengths of the reverse zones.
+	IPv4Bits int
+	IPv6Bits int
+	Reload   UnboundReload
+}
+
+// DefaultUnboundOptions returns the defaults of every option.
+func DefaultUnboundOptions() UnboundOptions {
+	return UnboundOptions{ZoneType: "static", IPv4Bits: 24, IPv6Bits: 64, Reload: UnboundFullReload}
+}
+
+// Validate checks the zone type, boundaries and reload of the options.
+func (o UnboundOptions) Validate() error {
+	if o.ZoneType != "static" && o.ZoneType != "transparent" {
+		return fmt.Errorf("unbound zone type must be static or transparent, not %q", o.ZoneType)
+	}
+	if o.Reload != UnboundFullReload && o.Reload != UnboundLocalDatas {
+		return fmt.Errorf("unbound reload must be %s or %s, not %q", UnboundFullReload, UnboundLocalDatas, o.Reload)
+	}
+	return validateZoneBits(o.IPv4Bits, o.IPv6Bits)
+}
+
+// unboundRenderer writes an unbound server clause declaring a local-zone per
+// reverse zone, with a local-data-ptr per reverse record and a local-data per
+// name of each forward record. RFC 2317 delegations are ignored, as a
+// resolver answers the standard reverse name, and so is the dnsmasq
+// configuration.
+type unboundRenderer struct {
+	opts UnboundOptions
+
+	mu sync.Mutex
+	// loaded are the local-zones and local-data known to be loaded into the
+	// server, nil until the first push.
+	loaded *unboundData
+}
+
+func newUnboundRenderer(opts UnboundOptions) *unboundRenderer {
+	return &unboundRenderer{opts: opts}
+}
+
+func (r *unboundRenderer) Format() OutputFormat {
+	return OutputUnbound
+}
+
+func (r *unboundRenderer) defaultPath() string {
+	return DefaultUnboundPath
+}
+
+func (r *unboundRenderer) reloadCommand(path string) string {
+	return unboundControl + " reload"
+}
+
+// zones returns the reverse zones of the records, sorted.
+func (r *unboundRenderer) zones(it record.Iterator) ([]string, error) {
+	seen := map[string]bool{}
+	for rec, ok := it.Next(); ok; rec, ok = it.Next() {
+		if rec.Publish.Reverse() {
+			seen[reverseZone(rec, r.opts.IPv4Bits, r.opts.IPv6Bits)] = true
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	zones := make([]string, 0, len(seen))
+	for zone := range seen {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	return zones, nil
+}
+
+// Render reads the records twice, as the local-zones come first.
+func (r *unboundRenderer) Render(w io.Writer, in RenderInput) error {
+	zones, err := r.zones(in.Records())
+	if err != nil {
+		return err
+	}
+	if err := writeHeader(w, OutputUnbound, "#"); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "server:")
+	for _, zone := range zones {
+		fmt.Fprintf(bw, "\tlocal-zone: \"%s\" %s\n", zone, r.opts.ZoneType)
+	}
+	it := in.Records()
+	for rec, ok := it.Next(); ok; rec, ok = it.Next() {
+		if rec.Publish.Forward() {
+			for _, rr := range forwardData(rec) {
+				fmt.Fprintf(bw, "\tlocal-data: \"%s\"\n", rr)
+			}
+		}
+		if rec.Publish.Reverse() {
+			fmt.Fprintf(bw, "\tlocal-data-ptr: \"%s %s\"\n", rec.Addr, fqdn(rec.Name()))
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// forwardData returns the A or AAAA records of each name of rec.
+func forwardData(rec record.Record) []string {
+	rrType := "A"
+	if rec.Family == record.IPv6 {
+		rrType = "AAAA"
+	}
+	var rrs []string
+	for _, name := range rec.Names {
+		rrs = append(rrs, fmt.Sprintf("%s IN %s %s", fqdn(name), rrType, rec.Addr))
+	}
+	return rrs
+}
+
+// unboundData is the content of the file as unbound-control loads it.
+type unboundData struct {
+	zones map[string]bool
+	// rrs maps each resource record to its owner.
+	rrs map[string]string
+}
+
+func (r *unboundRenderer) data(in RenderInput) (*unboundData, error) {
+	zones, err := r.zones(in.Records())
+	if err != nil {
+		return nil, err
+	}
+	data := &unboundData{zones: map[string]bool{}, rrs: map[string]string{}}
+	for _, zone := range zones {
+		data.zones[zone] = true
+	}
+	it := in.buffered()
+	for rec, ok := it.Next(); ok; rec, ok = it.Next() {
+		if rec.Publish.Forward() {
+			for i, rr := range forwardData(rec) {
+				data.rrs[rr] = fqdn(rec.Names[i])
+			}
+		}
+		if rec.Publish.Reverse() {
+			data.rrs[fmt.Sprintf("%s IN PTR %s", rec.Reverse, fqdn(rec.Name()))] = rec.Reverse
+		}
+	}
+	return data, it.Err()
+}
+
+// changes diffs in against the loaded data when the target uses
+// UnboundLocalDatas. As local_datas_remove drops every record of a name,
+// the remaining records of the names it is given are added back.
+func (r *unboundRenderer) changes(in RenderInput) ([]reloadCommand, func(), error) {
+	if r.opts.Reload != UnboundLocalDatas {
+		return nil, nil, nil
+	}
+	data, err := r.data(in)
+	if err != nil {
+		return nil, nil, err
+	}
+	commit := func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.loaded = data
+	}
+	r.mu.Lock()
+	loaded := r.loaded
+	r.mu.Unlock()
+	if loaded == nil {
+		return nil, commit, nil
+	}
+
+	var addZones, removeZones, addRRs []string
+	removeNames := map[string]bool{}
+	for zone := range data.zones {
+		if !loaded.zones[zone] {
+			addZones = append(addZones, zone+" "+r.opts.ZoneType)
+		}
+	}
+	for zone := range loaded.zones {
+		if !data.zones[zone] {
+			removeZones = append(removeZones, zone)
+		}
+	}
+	for rr, owner := range loaded.rrs {
+		if _, ok := data.rrs[rr]; !ok {
+			removeNames[owner] = true
+		}
+	}
+	for rr, owner := range data.rrs {
+		if _, ok := loaded.rrs[rr]; !ok || removeNames[owner] {
+			addRRs = append(addRRs, rr)
+		}
+	}
+
+	// zones are added before their data, and removed after it
+	cmds := []reloadCommand{}
+	for _, step := range []struct {
+		command string
+		lines   []string
+	}{
+		{"local_zones", addZones},
+		{"local_datas_remove", sortedKeys(removeNames)},
+		{"local_datas", addRRs},
+		{"local_zones_remove", removeZones},
+	} {
+		if len(step.lines) == 0 {
+			continue
+		}
+		sort.Strings(step.lines)
+		var stdin bytes.Buffer
+		fmt.Fprintln(&stdin, strings.Join(step.lines, "\n"))
+		cmds = append(cmds, reloadCommand{command: unboundControl + " " + step.command, stdin: stdin.Bytes()})
+	}
+	return cmds, commit, nil
+}
+
+func sortedKeys[V any](set map[string]V) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
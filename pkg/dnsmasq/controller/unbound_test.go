@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+)
+
+func TestUnboundChanges(t *testing.T) {
+	opts := DefaultUnboundOptions()
+	opts.Reload = UnboundLocalDatas
+	renderer := newUnboundRenderer(opts)
+	input := func(hosts string) RenderInput {
+		records, err := parseHosts(hosts, record.Source{Kind: record.SourceFile})
+		if err != nil {
+			t.Fatalf("Error parsing hosts: %v", err)
+		}
+		for i := range records {
+			records[i].Publish = record.PublishBoth
+		}
+		return RenderInput{Records: func() record.Iterator { return record.FromSlice(records) }}
+	}
+
+	cmds, commit, err := renderer.changes(input("10.0.0.5 api.ci.example.\n10.0.0.6 bastion.ci.example.\n"))
+	if err != nil || cmds != nil {
+		t.Fatalf("Expected a full reload for the first push, got %v, %v", cmds, err)
+	}
+	commit()
+
+	cmds, commit, err = renderer.changes(input("10.0.0.5 api.ci.example.\n10.0.1.7 bastion.ci.example.\n"))
+	if err != nil {
+		t.Fatalf("Error diffing: %v", err)
+	}
+	expected := []reloadCommand{
+		{command: "sudo unbound-control local_zones", stdin: []byte("1.0.10.in-addr.arpa. static\n")},
+		{command: "sudo unbound-control local_datas_remove", stdin: []byte("6.0.0.10.in-addr.arpa.\nbastion.ci.example.\n")},
+		{command: "sudo unbound-control local_datas", stdin: []byte("7.1.0.10.in-addr.arpa. IN PTR bastion.ci.example.\nbastion.ci.example. IN A 10.0.1.7\n")},
+	}
+	if len(cmds) != len(expected) {
+		t.Fatalf("Expected %d commands, got %+v", len(expected), cmds)
+	}
+	for i, cmd := range cmds {
+		if cmd.command != expected[i].command || string(cmd.stdin) != string(expected[i].stdin) {
+			t.Errorf("Expected %s with\n%s\ngot %s with\n%s", expected[i].command, expected[i].stdin, cmd.command, cmd.stdin)
+		}
+	}
+
+	// nothing is recorded as loaded until the push succeeds
+	if again, _, _ := renderer.changes(input("10.0.0.5 api.ci.example.\n10.0.1.7 bastion.ci.example.\n")); len(again) != len(cmds) {
+		t.Errorf("Expected the changes to be repeated until committed, got %+v", again)
+	}
+	commit()
+	cmds, _, err = renderer.changes(input("10.0.0.5 api.ci.example.\n"))
+	if err != nil || len(cmds) != 2 || !strings.HasSuffix(cmds[1].command, "local_zones_remove") || string(cmds[1].stdin) != "1.0.10.in-addr.arpa.\n" {
+		t.Errorf("Expected the emptied zone to be removed after its data, got %+v, %v", cmds, err)
+	}
+
+	full := newUnboundRenderer(DefaultUnboundOptions())
+	if cmds, _, err := full.changes(input("10.0.0.5 api.ci.example.\n")); cmds != nil || err != nil {
+		t.Errorf("Expected targets reloading in full to never load changes, got %+v, %v", cmds, err)
+	}
+}
@@ -1,24 +1,44 @@
 package controller
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
+	"io"
+	"net/netip"
 	"os"
-	"strings"
 
 	scp "github.com/bramvdbogaerde/go-scp"
-	"github.com/miekg/dns"
+	"github.com/openshift-splat-team/vsphere-ci-dns/data"
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
-func provisionHosts(ctx context.Context, client client.Client, privateKeyPath, server, hosts string) error {
+// countingWriter discards everything written to it, counting the bytes.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// provisionHosts streams the output of render to path on the DNS server and
+// runs reloads in order. render is called twice, first to size the file as
+// scp needs to know it up front, so it must produce the same output each
+// time.
+func provisionHosts(ctx context.Context, client client.Client, privateKeyPath, server, path string, reloads []reloadCommand, render func(io.Writer) error) error {
 	logr := log.FromContext(ctx)
 
-	logr.Info("provisioning hosts file", "server", server)
+	var size countingWriter
+	if err := render(&size); err != nil {
+		return errors.Wrapf(err, "unable to render hosts file")
+	}
+	logr.Info("provisioning hosts file", "server", server, "bytes", size.n)
 
 	// Load your private key
 	key, err := os.ReadFile(privateKeyPath)
@@ -63,11 +83,35 @@ func provisionHosts(ctx context.Context, client client.Client, privateKeyPath, s
 	defer scpClient.Close()
 
 	logr.Info("copying hosts file")
-	err = scpClient.Copy(ctx, strings.NewReader(hosts), "/opt/ci-dns/additional-hosts", "0666", int64(len(hosts)))
+	reader, writer := io.Pipe()
+	defer reader.Close()
+	go func() {
+		writer.CloseWithError(render(writer))
+	}()
+	err = scpClient.Copy(ctx, reader, path, "0666", size.n)
 	if err != nil {
 		return errors.Wrapf(err, "unable to copy")
 	}
 
+	for _, reload := range reloads {
+		if err := reload.run(ctx, sshClient); err != nil {
+			return err
+		}
+	}
+
+	logr.Info("reloaded DNS server")
+
+	return nil
+}
+
+// reloadCommand is run on a target server once its file is written, fed
+// stdin.
+type reloadCommand struct {
+	command string
+	stdin   []byte
+}
+
+func (c reloadCommand) run(ctx context.Context, sshClient *ssh.Client) error {
 	// Create a session
 	session, err := sshClient.NewSession()
 	if err != nil {
@@ -75,63 +119,255 @@ func provisionHosts(ctx context.Context, client client.Client, privateKeyPath, s
 	}
 	defer session.Close()
 
-	logr.Info("restart dnsmasq")
-	err = session.Run("sudo systemctl restart dnsmasq")
+	log.FromContext(ctx).Info("reloading DNS server", "command", c.command, "stdin", len(c.stdin))
+	session.Stdin = bytes.NewReader(c.stdin)
+	if err := session.Run(c.command); err != nil {
+		return errors.Wrapf(err, "unable to reload DNS server")
+	}
+	return nil
+}
+
+// RecordOptions controls how reverse DNS records are generated.
+type RecordOptions struct {
+	// Namer renders the name each record points at.
+	Namer *Namer
+	// MaxIPv6Range bounds the number of addresses expanded from an IPv6 range.
+	MaxIPv6Range uint64
+	// MaxCIDRAddresses bounds the number of addresses expanded from a CIDR.
+	MaxCIDRAddresses uint64
+	// SkipNetworkBroadcast omits the network and broadcast addresses of IPv4
+	// subnets and CIDRs.
+	SkipNetworkBroadcast bool
+	// Reservations names, or suppresses, the gateway, VIF and DHCP pool
+	// addresses of subnets.json entries.
+	Reservations Reservations
+	// Classless places the PTR records of IPv4 subnets and CIDRs smaller than
+	// a /24 in RFC 2317 child zones.
+	Classless bool
+}
+
+// delegate places rec in the RFC 2317 child zone of prefix if opts.Classless
+// is set.
+func (opts RecordOptions) delegate(prefix netip.Prefix, rec record.Record) record.Record {
+	if !opts.Classless {
+		return rec
+	}
+	return rec.Delegate(prefix)
+}
+
+// formatRecord returns the record for addr, named by namer.
+func formatRecord(addr netip.Addr, data NameData, namer *Namer, source record.Source) (record.Record, error) {
+	data, err := data.withAddr(addr)
+	if err != nil {
+		return record.Record{}, err
+	}
+	name, err := namer.Name(data)
 	if err != nil {
-		return errors.Wrapf(err, "unable to restart dnsmasq")
+		return record.Record{}, err
 	}
+	return record.New(addr, source, name)
+}
 
-	logr.Info("restarted dnsmasq")
+// subnetsSource is the source of the records of an entry of subnets.json.
+func subnetsSource(datacenter, vlan string) record.Source {
+	return record.Source{Kind: record.SourceSubnets, Name: fmt.Sprintf("%s/%s", datacenter, vlan)}
+}
 
-	return nil
+// parseSubnets parses subnets.json content into records, attributing the
+// records of each entry to the source returned by sourceOf. Invalid subnet
+// entries, and IPv6 ranges larger than opts.MaxIPv6Range, are skipped and
+// reported as data.SubnetErrors along with the records of every valid entry.
+// Any other error, such as a name which fails validation, means no records
+// should be published.
+func parseSubnets(content string, opts RecordOptions, sourceOf func(datacenter, vlan string) record.Source) ([]record.Record, error) {
+	subnets, err := data.ParseSubnets([]byte(content))
+	return subnetRecords(subnets, err, opts, sourceOf)
 }
 
-// SubnetParse parses a json file and returns a list of reverse DNS records
-func SubnetParse(content string) ([]string, error) {
-	records := []string{}
-	var subnetsUntyped map[string]interface{}
-	if err := json.Unmarshal([]byte(content), &subnetsUntyped); err != nil {
+// subnetRecords returns the records of subnets, given the error they were
+// parsed with. Addresses named in the Hostnames of an entry keep that name
+// unless they are reserved; invalid hostnames are reported as
+// data.SubnetErrors and the address is named by opts.Namer instead.
+func subnetRecords(subnets data.Subnets, err error, opts RecordOptions, sourceOf func(datacenter, vlan string) record.Source) ([]record.Record, error) {
+	records := []record.Record{}
+	var subnetErrs data.SubnetErrors
+	if err != nil && !errors.As(err, &subnetErrs) {
 		return nil, errors.Wrapf(err, "unable to parse")
 	}
 
-	for _, vlans := range subnetsUntyped {
-		for _, subnetUntyped := range vlans.(map[string]interface{}) {
-			subnet := subnetUntyped.(map[string]interface{})
-			ipAddresses := subnet["ipAddresses"].([]interface{})
-			for _, ip := range ipAddresses {
-				arpa, err := dns.ReverseAddr(ip.(string))
-				if err != nil {
-					return nil, errors.Wrapf(err, "unable to reverse address")
+	var nameErr error
+	subnets.Walk(func(datacenter, vlan string, subnet data.Subnet) {
+		if nameErr != nil {
+			return
+		}
+		source := sourceOf(datacenter, vlan)
+		nameData := NameData{
+			Datacenter:    datacenter,
+			Vlan:          vlan,
+			Virtualcenter: subnet.Virtualcenter,
+		}
+		// addresses have already been validated by data.ParseSubnets
+		prefix, _ := subnet.Prefix()
+		nameData = nameData.withBase(prefix.Addr())
+		reserved := opts.Reservations.subnetAddresses(subnet)
+		named := map[netip.Addr]record.Record{}
+		for _, addr := range subnet.HostnameAddrs() {
+			if _, ok := reserved[addr]; ok {
+				continue
+			}
+			name := subnet.Hostnames[addr.String()]
+			if err := ValidateHostname(name); err != nil {
+				subnetErrs = append(subnetErrs, &data.SubnetError{Datacenter: datacenter, Vlan: vlan, Err: err})
+				continue
+			}
+			rec, err := record.New(addr, source, name)
+			if err != nil {
+				nameErr = errors.Wrapf(err, "%s", source.Name)
+				return
+			}
+			rec.Priority = subnet.Priority
+			named[addr] = opts.delegate(prefix, rec)
+		}
+		for _, ip := range subnet.IpAddresses {
+			addr := netip.MustParseAddr(ip)
+			if opts.SkipNetworkBroadcast && isNetworkOrBroadcast(prefix, addr) {
+				continue
+			}
+			if _, ok := reserved[addr]; ok {
+				continue
+			}
+			if _, ok := named[addr]; ok {
+				continue
+			}
+			rec, err := formatRecord(addr, nameData, opts.Namer, source)
+			if err != nil {
+				nameErr = errors.Wrapf(err, "%s", source.Name)
+				return
+			}
+			rec.Priority = subnet.Priority
+			records = append(records, opts.delegate(prefix, rec))
+		}
+		if start, stop, ok, _ := subnet.IPv6Range(); ok {
+			ipv6Records, err := processIPv6Range(start, stop, nameData.withBase(start), source, opts)
+			var rangeErr *ipv6RangeError
+			if errors.As(err, &rangeErr) {
+				subnetErrs = append(subnetErrs, &data.SubnetError{Datacenter: datacenter, Vlan: vlan, Err: err})
+			} else if err != nil {
+				nameErr = errors.Wrapf(err, "%s", source.Name)
+				return
+			}
+			for _, rec := range ipv6Records {
+				if _, ok := reserved[rec.Addr]; ok {
+					continue
+				}
+				if _, ok := named[rec.Addr]; ok {
+					continue
 				}
-				records = append(records, fmt.Sprintf("%s %s", ip.(string), arpa))
+				rec.Priority = subnet.Priority
+				records = append(records, rec)
 			}
 		}
+
+		for _, addr := range sortedAddrs(named) {
+			records = append(records, named[addr])
+		}
+
+		// reserved addresses are named by their reservation wherever they
+		// appear, and get a record even when they are outside ipAddresses
+		for _, addr := range sortedAddrs(reserved) {
+			rec, err := reserved[addr].reservedRecord(addr, nameData, source)
+			if err != nil {
+				nameErr = errors.Wrapf(err, "%s", source.Name)
+				return
+			}
+			rec.Priority = subnet.Priority
+			records = append(records, opts.delegate(prefix, rec))
+		}
+	})
+	if nameErr != nil {
+		return nil, nameErr
+	}
+	if len(subnetErrs) > 0 {
+		return records, subnetErrs
 	}
 	return records, nil
 }
 
-// ToHosts converts a list of records to a hosts file format
-func ToHosts(records []string) string {
-	var builder strings.Builder
+// ipamRecords returns the records of subnets imported from an IPAM export,
+// which only list the named and gateway addresses of their IPv4 networks. The
+// other addresses of the networks are generated as the output is rendered, as
+// for CIDRs, and the records subnetRecords returns for the network replace
+// the generated ones. Networks spanning more than opts.MaxCIDRAddresses
+// addresses are reported as data.SubnetErrors and only get those records.
+func ipamRecords(subnets data.Subnets, err error, opts RecordOptions, sourceOf func(datacenter, vlan string) record.Source) (SourceRecords, error) {
+	records, err := subnetRecords(subnets, err, opts, sourceOf)
+	var subnetErrs data.SubnetErrors
+	if err != nil && !errors.As(err, &subnetErrs) {
+		return SourceRecords{}, err
+	}
 
-	for _, record := range records {
-		builder.WriteString(fmt.Sprintf("ptr-record=%s\n", record))
+	var out SourceRecords
+	expansions := map[string]*cidrExpansion{}
+	subnets.Walk(func(datacenter, vlan string, subnet data.Subnet) {
+		prefix, _ := subnet.Prefix()
+		prefix = prefix.Masked()
+		if uint64(1)<<(32-prefix.Bits()) > opts.MaxCIDRAddresses {
+			subnetErrs = append(subnetErrs, &data.SubnetError{Datacenter: datacenter, Vlan: vlan,
+				Err: fmt.Errorf("network %s spans more than %d addresses; raise --max-cidr-addresses if this is intended", prefix, opts.MaxCIDRAddresses)})
+			return
+		}
+		expansion := &cidrExpansion{
+			prefix:               prefix,
+			r:                    record.RangeOf(prefix),
+			data:                 NameData{Datacenter: datacenter, Vlan: vlan, Virtualcenter: subnet.Virtualcenter}.withBase(prefix.Addr()),
+			source:               sourceOf(datacenter, vlan),
+			namer:                opts.Namer,
+			skipNetworkBroadcast: opts.SkipNetworkBroadcast,
+			classless:            opts.Classless,
+			fixed:                map[netip.Addr]record.Record{},
+		}
+		expansions[expansion.source.Name] = expansion
+		out.Streams = append(out.Streams, expansion.Records)
+	})
+	for _, rec := range records {
+		if expansion, ok := expansions[rec.Source.Name]; ok && expansion.prefix.Contains(rec.Addr) {
+			expansion.fixed[rec.Addr] = rec
+			continue
+		}
+		out.Records = append(out.Records, rec)
+	}
+	if len(subnetErrs) > 0 {
+		return out, subnetErrs
 	}
-	return builder.String()
+	return out, nil
 }
 
-func UpdateDNSHost(ctx context.Context, client client.Client, privateKeyPath, server, header string, records []string) error {
+// UpdateDNSHost renders in for target and pushes it to the target server, or
+// hands it to the publisher of the target.
+func UpdateDNSHost(ctx context.Context, client client.Client, privateKeyPath string, target Target, in RenderInput) error {
 	logr := log.FromContext(ctx)
-	logr.Info("updating DNS host")
-	logr.V(1).Info("records count", "records", len(records))
-	allKeys := make(map[string]bool)
-	list := []string{}
-	for _, item := range records {
-		if _, value := allKeys[item]; !value {
-			allKeys[item] = true
-			list = append(list, item)
+	logr.Info("updating DNS host", "target", target.String())
+	logr.V(1).Info("dnsmasq configuration", "synthDomains", len(in.Dnsmasq.Synths), "dhcpRanges", len(in.Dnsmasq.DHCP))
+	if target.Publisher != nil {
+		return target.Publisher.Publish(ctx, client, in)
+	}
+	reloads := []reloadCommand{{command: target.Reload}}
+	var commit func()
+	if incremental, ok := target.Renderer.(incrementalRenderer); ok {
+		changes, applied, err := incremental.changes(in)
+		if err != nil {
+			return err
+		}
+		if changes != nil {
+			reloads = changes
 		}
+		commit = applied
+	}
+	err := provisionHosts(ctx, client, privateKeyPath, target.Server, target.Path, reloads, func(w io.Writer) error {
+		return target.Renderer.Render(w, in)
+	})
+	if err == nil && commit != nil {
+		commit()
 	}
-	logr.V(1).Info("records after duplicate removal", "records", len(list))
-	return provisionHosts(ctx, client, privateKeyPath, server, strings.Join(list, "\n"))
+	return err
 }
@@ -0,0 +1,378 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+const (
+	// WebhookMediaType is the media type of version 1 of the external-dns
+	// webhook provider protocol.
+	WebhookMediaType = "application/external.dns.webhook+json;version=1"
+	// DefaultWebhookAddress is where external-dns looks for its webhook
+	// provider, running as a sidecar.
+	DefaultWebhookAddress = "localhost:8888"
+
+	// webhookEndpointsKey is the key of the ConfigMap holding the endpoints.
+	webhookEndpointsKey = "endpoints.json"
+	// webhookAttempts bounds the attempts to apply changes to a ConfigMap
+	// which others, e.g. another replica, keep changing.
+	webhookAttempts = 5
+)
+
+// Endpoint is an external-dns endpoint: the targets of a name, of one
+// record type.
+type Endpoint struct {
+	DNSName          string                     `json:"dnsName,omitempty"`
+	Targets          []string                   `json:"targets,omitempty"`
+	RecordType       string                     `json:"recordType,omitempty"`
+	SetIdentifier    string                     `json:"setIdentifier,omitempty"`
+	RecordTTL        int64                      `json:"recordTTL,omitempty"`
+	Labels           map[string]string          `json:"labels,omitempty"`
+	ProviderSpecific []ProviderSpecificProperty `json:"providerSpecific,omitempty"`
+}
+
+// ProviderSpecificProperty is a property of an Endpoint understood by some
+// providers only.
+type ProviderSpecificProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// EndpointChanges are the changes external-dns asks the provider to apply.
+type EndpointChanges struct {
+	Create    []*Endpoint `json:"Create"`
+	UpdateOld []*Endpoint `json:"UpdateOld"`
+	UpdateNew []*Endpoint `json:"UpdateNew"`
+	Delete    []*Endpoint `json:"Delete"`
+}
+
+// DomainFilter is the answer to the protocol negotiation, limiting the names
+// external-dns hands over.
+type DomainFilter struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// endpointKey identifies an endpoint in the state.
+type endpointKey struct {
+	name, recordType, setIdentifier string
+}
+
+func (e *Endpoint) key() endpointKey {
+	return endpointKey{name: strings.ToLower(strings.TrimSuffix(e.DNSName, ".")), recordType: e.RecordType, setIdentifier: e.SetIdentifier}
+}
+
+// WebhookProvider implements the external-dns webhook provider protocol by
+// keeping the endpoints it is given in a ConfigMap, which an EndpointsSource
+// reads so that they are published with the records of every other source.
+// A and AAAA endpoints are published as records of the names they hold, while
+// TXT endpoints are only kept so that the external-dns TXT registry can track
+// ownership. Other record types are refused when endpoints are adjusted.
+//
+// The ConfigMap is read on every call rather than cached, and changed with
+// the resourceVersion it was read at, so that several providers may share it.
+type WebhookProvider struct {
+	Client client.Client
+	// Domains are the domains external-dns may hand names over in; empty
+	// allows any.
+	Domains []string
+	// ConfigMap keeps the endpoints.
+	ConfigMap types.NamespacedName
+}
+
+// Handler returns the handler of the protocol endpoints.
+func (p *WebhookProvider) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		writeWebhookJSON(w, http.StatusOK, DomainFilter{Include: p.Domains})
+	})
+	mux.HandleFunc("GET /records", func(w http.ResponseWriter, r *http.Request) {
+		endpoints, err := p.Records(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeWebhookJSON(w, http.StatusOK, endpoints)
+	})
+	mux.HandleFunc("POST /records", func(w http.ResponseWriter, r *http.Request) {
+		changes := &EndpointChanges{}
+		if err := json.NewDecoder(r.Body).Decode(changes); err != nil {
+			http.Error(w, fmt.Sprintf("invalid changes: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := p.ApplyChanges(r.Context(), changes); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /adjustendpoints", func(w http.ResponseWriter, r *http.Request) {
+		var endpoints []*Endpoint
+		if err := json.NewDecoder(r.Body).Decode(&endpoints); err != nil {
+			http.Error(w, fmt.Sprintf("invalid endpoints: %v", err), http.StatusBadRequest)
+			return
+		}
+		writeWebhookJSON(w, http.StatusOK, p.AdjustEndpoints(r.Context(), endpoints))
+	})
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	return mux
+}
+
+func writeWebhookJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", WebhookMediaType)
+	w.Header().Set("Vary", "Content-Type")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// Records returns the endpoints kept in the ConfigMap, sorted by name.
+func (p *WebhookProvider) Records(ctx context.Context) ([]*Endpoint, error) {
+	_, kept, err := readEndpoints(ctx, p.Client, p.ConfigMap)
+	if err != nil {
+		return nil, err
+	}
+	return sortedEndpoints(endpointsByKey(kept)), nil
+}
+
+// AdjustEndpoints drops the endpoints the targets cannot publish: those of
+// other types than A, AAAA and TXT, outside Domains, or whose targets are not
+// addresses of their type.
+func (p *WebhookProvider) AdjustEndpoints(ctx context.Context, endpoints []*Endpoint) []*Endpoint {
+	logr := log.FromContext(ctx)
+	adjusted := []*Endpoint{}
+	for _, endpoint := range endpoints {
+		if err := p.supported(endpoint); err != nil {
+			logr.Info("endpoint not supported by the targets", "name", endpoint.DNSName, "type", endpoint.RecordType, "reason", err.Error())
+			continue
+		}
+		adjusted = append(adjusted, endpoint)
+	}
+	return adjusted
+}
+
+func (p *WebhookProvider) supported(endpoint *Endpoint) error {
+	name := dns.CanonicalName(endpoint.DNSName)
+	if len(p.Domains) > 0 && !p.inDomains(name) {
+		return fmt.Errorf("outside the domains %s", strings.Join(p.Domains, ", "))
+	}
+	switch endpoint.RecordType {
+	case "TXT":
+		return nil
+	case "A", "AAAA":
+	default:
+		return fmt.Errorf("only A, AAAA and TXT endpoints are published")
+	}
+	if err := ValidateHostname(strings.TrimSuffix(endpoint.DNSName, ".")); err != nil {
+		return err
+	}
+	for _, target := range endpoint.Targets {
+		addr, err := netip.ParseAddr(target)
+		if err != nil || addr.Unmap().Is4() != (endpoint.RecordType == "A") {
+			return fmt.Errorf("target %q is not an %s address", target, endpoint.RecordType)
+		}
+	}
+	return nil
+}
+
+func (p *WebhookProvider) inDomains(name string) bool {
+	for _, domain := range p.Domains {
+		if dns.IsSubDomain(dns.CanonicalName(domain), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyChanges keeps the endpoints as changed in the ConfigMap. Nothing is
+// kept unless every endpoint is supported, so that external-dns retries the
+// changes. The changes are applied again to the endpoints read back when the
+// ConfigMap changed since it was read.
+func (p *WebhookProvider) ApplyChanges(ctx context.Context, changes *EndpointChanges) error {
+	for _, endpoint := range slices.Concat(changes.Create, changes.UpdateNew) {
+		if err := p.supported(endpoint); err != nil {
+			return fmt.Errorf("unable to apply endpoint %s %s: %v", endpoint.DNSName, endpoint.RecordType, err)
+		}
+	}
+	var err error
+	for attempt := 0; attempt < webhookAttempts; attempt++ {
+		configMap, kept, readErr := readEndpoints(ctx, p.Client, p.ConfigMap)
+		if readErr != nil {
+			return readErr
+		}
+		endpoints := endpointsByKey(kept)
+		for _, endpoint := range slices.Concat(changes.Delete, changes.UpdateOld) {
+			delete(endpoints, endpoint.key())
+		}
+		for _, endpoint := range slices.Concat(changes.Create, changes.UpdateNew) {
+			endpoints[endpoint.key()] = endpoint
+		}
+		if err = p.save(ctx, configMap, endpoints); !apierrors.IsConflict(err) && !apierrors.IsAlreadyExists(err) {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("unable to keep endpoints in %s: %v", p.ConfigMap, err)
+	}
+	return nil
+}
+
+// endpointRecords returns the records of the A and AAAA endpoints, one per
+// address with the names pointing at it sorted.
+func endpointRecords(endpoints []*Endpoint) ([]record.Record, error) {
+	names := map[netip.Addr][]string{}
+	for _, endpoint := range endpoints {
+		if endpoint.RecordType != "A" && endpoint.RecordType != "AAAA" {
+			continue
+		}
+		name := dns.CanonicalName(endpoint.DNSName)
+		for _, target := range endpoint.Targets {
+			addr, err := netip.ParseAddr(target)
+			if err != nil {
+				return nil, fmt.Errorf("invalid target %q of %s: %v", target, endpoint.DNSName, err)
+			}
+			names[addr.Unmap()] = append(names[addr.Unmap()], name)
+		}
+	}
+	records := make([]record.Record, 0, len(names))
+	for addr, addrNames := range names {
+		sort.Strings(addrNames)
+		rec, err := record.New(addr, record.Source{Kind: record.SourceExternalDNS, Name: addrNames[0]}, slices.Compact(addrNames)...)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Addr.Less(records[j].Addr) })
+	return records, nil
+}
+
+// readEndpoints returns the ConfigMap of key and the endpoints kept in it,
+// none if it does not exist yet, in which case the ConfigMap has no
+// resourceVersion.
+func readEndpoints(ctx context.Context, c client.Client, key types.NamespacedName) (*corev1.ConfigMap, []*Endpoint, error) {
+	configMap := &corev1.ConfigMap{}
+	err := c.Get(ctx, key, configMap)
+	if apierrors.IsNotFound(err) {
+		configMap = &corev1.ConfigMap{}
+		configMap.Namespace, configMap.Name = key.Namespace, key.Name
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("unable to read endpoints from %s: %v", key, err)
+	}
+	var endpoints []*Endpoint
+	if data := configMap.Data[webhookEndpointsKey]; data != "" {
+		if err := json.Unmarshal([]byte(data), &endpoints); err != nil {
+			return nil, nil, fmt.Errorf("invalid endpoints in %s: %v", key, err)
+		}
+	}
+	return configMap, endpoints, nil
+}
+
+func endpointsByKey(endpoints []*Endpoint) map[endpointKey]*Endpoint {
+	byKey := make(map[endpointKey]*Endpoint, len(endpoints))
+	for _, endpoint := range endpoints {
+		byKey[endpoint.key()] = endpoint
+	}
+	return byKey
+}
+
+// save keeps endpoints in configMap, as read by readEndpoints. It fails with
+// a conflict if the ConfigMap changed since.
+func (p *WebhookProvider) save(ctx context.Context, configMap *corev1.ConfigMap, endpoints map[endpointKey]*Endpoint) error {
+	data, err := json.Marshal(sortedEndpoints(endpoints))
+	if err != nil {
+		return err
+	}
+	if configMap.Data == nil {
+		configMap.Data = map[string]string{}
+	}
+	configMap.Data[webhookEndpointsKey] = string(data)
+	if configMap.ResourceVersion == "" {
+		return p.Client.Create(ctx, configMap)
+	}
+	return p.Client.Update(ctx, configMap)
+}
+
+func sortedEndpoints(endpoints map[endpointKey]*Endpoint) []*Endpoint {
+	sorted := make([]*Endpoint, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		sorted = append(sorted, endpoint)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i].key(), sorted[j].key()
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		if a.recordType != b.recordType {
+			return a.recordType < b.recordType
+		}
+		return a.setIdentifier < b.setIdentifier
+	})
+	return sorted
+}
+
+// Serve answers external-dns on address until ctx is done.
+func (p *WebhookProvider) Serve(ctx context.Context, address string) error {
+	server := &http.Server{Addr: address, Handler: p.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdown)
+	}()
+	log.FromContext(ctx).Info("serving external-dns webhook", "address", address, "configmap", p.ConfigMap)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// EndpointsSource reads the endpoints a WebhookProvider keeps in its
+// ConfigMap, publishing the A and AAAA endpoints as records of the names they
+// hold.
+type EndpointsSource struct {
+	ConfigMap types.NamespacedName
+}
+
+func (s *EndpointsSource) Kind() record.SourceKind {
+	return record.SourceExternalDNS
+}
+
+func (s *EndpointsSource) Records(ctx context.Context, env SourceEnv) (SourceRecords, error) {
+	_, endpoints, err := readEndpoints(ctx, env.Client, s.ConfigMap)
+	if err != nil {
+		return SourceRecords{}, err
+	}
+	records, err := endpointRecords(endpoints)
+	if err != nil {
+		return SourceRecords{}, err
+	}
+	return SourceRecords{Records: records}, nil
+}
+
+func (s *EndpointsSource) watch(b *builder.Builder) *builder.Builder {
+	return b.Watches(&corev1.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(configSecret), builder.WithPredicates(predicate.NewPredicateFuncs(func(object client.Object) bool {
+		return client.ObjectKeyFromObject(object) == s.ConfigMap
+	})))
+}
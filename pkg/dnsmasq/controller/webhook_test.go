@@ -0,0 +1,192 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/openshift-splat-team/vsphere-ci-dns/pkg/record"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// webhookCall sends body as JSON to the handler and decodes the answer into
+// out, unless it is nil, returning the status.
+func webhookCall(t *testing.T, h http.Handler, method, path string, body, out interface{}) int {
+	t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &payload)
+	req.Header.Set("Accept", WebhookMediaType)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if out != nil && w.Code == http.StatusOK {
+		if w.Header().Get("Content-Type") != WebhookMediaType {
+			t.Errorf("Expected %s %s to answer %s, got %q", method, path, WebhookMediaType, w.Header().Get("Content-Type"))
+		}
+		if err := json.NewDecoder(w.Body).Decode(out); err != nil {
+			t.Fatalf("Error decoding %s %s: %v", method, path, err)
+		}
+	}
+	return w.Code
+}
+
+func TestWebhookProvider(t *testing.T) {
+	c := newObjectClient()
+	config := &corev1.Secret{}
+	config.Namespace, config.Name = "test-credentials", "vsphere-config"
+	if err := c.Create(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	endpointsKey := types.NamespacedName{Namespace: "dns", Name: "endpoints"}
+	newProvider := func() *WebhookProvider {
+		return &WebhookProvider{
+			Client:    c,
+			Domains:   []string{"apps.ci.example"},
+			ConfigMap: endpointsKey,
+		}
+	}
+	h := newProvider().Handler()
+
+	// the endpoints are published along with the records of the other
+	// sources
+	hosts, err := ParseTarget("coredns://dns/ci-hosts", DefaultRendererOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bastion, err := record.New(netip.MustParseAddr("10.0.0.2"), record.Source{Kind: record.SourceFile}, "bastion.apps.ci.example.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &SecretReconciler{
+		Client:  c,
+		Sources: []RecordSource{&testSource{records: []record.Record{bastion}}, &EndpointsSource{ConfigMap: endpointsKey}},
+		Targets: []Target{hosts},
+		Publish: PublishModes{record.SourceFile: record.PublishBoth, record.SourceExternalDNS: record.PublishBoth},
+	}
+	block := func() string {
+		if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(config)}); err != nil {
+			t.Fatalf("Error reconciling: %v", err)
+		}
+		return coreDNSData(c, "ci-hosts")["apps.ci.example.hosts"]
+	}
+
+	filter := DomainFilter{}
+	if code := webhookCall(t, h, http.MethodGet, "/", nil, &filter); code != http.StatusOK || len(filter.Include) != 1 || filter.Include[0] != "apps.ci.example" {
+		t.Errorf("Expected the domain filter on negotiation, got %d %v", code, filter)
+	}
+
+	var adjusted []*Endpoint
+	webhookCall(t, h, http.MethodPost, "/adjustendpoints", []*Endpoint{
+		{DNSName: "api.apps.ci.example", RecordType: "A", Targets: []string{"10.0.0.5"}},
+		{DNSName: "a-api.apps.ci.example", RecordType: "TXT", Targets: []string{`"heritage=external-dns"`}},
+		{DNSName: "www.apps.ci.example", RecordType: "CNAME", Targets: []string{"api.apps.ci.example"}},
+		{DNSName: "api.other.example", RecordType: "A", Targets: []string{"10.0.0.6"}},
+		{DNSName: "v6.apps.ci.example", RecordType: "AAAA", Targets: []string{"10.0.0.7"}},
+	}, &adjusted)
+	if len(adjusted) != 2 || adjusted[0].RecordType != "A" || adjusted[1].RecordType != "TXT" {
+		t.Errorf("Expected only the A and TXT endpoints in the domain to be kept, got %v", adjusted)
+	}
+
+	created := &EndpointChanges{Create: []*Endpoint{
+		{DNSName: "api.apps.ci.example", RecordType: "A", Targets: []string{"10.0.0.5"}},
+		{DNSName: "ingress.apps.ci.example", RecordType: "A", Targets: []string{"10.0.0.5", "10.0.0.9"}},
+		{DNSName: "v6.apps.ci.example", RecordType: "AAAA", Targets: []string{"fd00::7"}},
+		{DNSName: "a-api.apps.ci.example", RecordType: "TXT", Targets: []string{`"heritage=external-dns"`}},
+	}}
+	if code := webhookCall(t, h, http.MethodPost, "/records", created, nil); code != http.StatusNoContent {
+		t.Fatalf("Expected the changes to be applied, got %d", code)
+	}
+	for _, line := range []string{"10.0.0.2 bastion.apps.ci.example.\n", "10.0.0.5 api.apps.ci.example. ingress.apps.ci.example.\n", "10.0.0.9 ingress.apps.ci.example.\n", "fd00::7 v6.apps.ci.example.\n"} {
+		if !strings.Contains(block(), line) {
+			t.Errorf("Expected %q in the hosts block\n%s", line, block())
+		}
+	}
+	if strings.Contains(block(), "a-api") {
+		t.Errorf("Expected TXT endpoints not to be published\n%s", block())
+	}
+
+	// a restarted provider reads the endpoints back
+	var endpoints []*Endpoint
+	webhookCall(t, newProvider().Handler(), http.MethodGet, "/records", nil, &endpoints)
+	if len(endpoints) != 4 || endpoints[0].DNSName != "a-api.apps.ci.example" || endpoints[1].DNSName != "api.apps.ci.example" {
+		t.Errorf("Expected the endpoints to be kept, got %v", endpoints)
+	}
+
+	changed := &EndpointChanges{
+		UpdateOld: []*Endpoint{{DNSName: "ingress.apps.ci.example", RecordType: "A", Targets: []string{"10.0.0.5", "10.0.0.9"}}},
+		UpdateNew: []*Endpoint{{DNSName: "ingress.apps.ci.example", RecordType: "A", Targets: []string{"10.0.0.10"}}},
+		Delete:    []*Endpoint{{DNSName: "v6.apps.ci.example", RecordType: "AAAA", Targets: []string{"fd00::7"}}},
+	}
+	if code := webhookCall(t, h, http.MethodPost, "/records", changed, nil); code != http.StatusNoContent {
+		t.Fatalf("Expected the changes to be applied, got %d", code)
+	}
+	published := block()
+	if !strings.Contains(published, "10.0.0.2 bastion.apps.ci.example.\n10.0.0.5 api.apps.ci.example.\n10.0.0.10 ingress.apps.ci.example.\n") || strings.Contains(published, "10.0.0.9") || strings.Contains(published, "fd00::7") {
+		t.Errorf("Expected the updated and deleted endpoints to be republished\n%s", published)
+	}
+
+	// nothing is kept unless every endpoint is supported
+	unsupported := &EndpointChanges{Create: []*Endpoint{
+		{DNSName: "new.apps.ci.example", RecordType: "A", Targets: []string{"10.0.0.11"}},
+		{DNSName: "www.apps.ci.example", RecordType: "CNAME", Targets: []string{"api"}},
+	}}
+	if code := webhookCall(t, h, http.MethodPost, "/records", unsupported, nil); code != http.StatusInternalServerError {
+		t.Errorf("Expected an unsupported endpoint to be refused, got %d", code)
+	}
+	endpoints = nil
+	webhookCall(t, newProvider().Handler(), http.MethodGet, "/records", nil, &endpoints)
+	if len(endpoints) != 3 {
+		t.Errorf("Expected the refused changes not to be kept, got %v", endpoints)
+	}
+
+	// providers sharing the ConfigMap apply their changes on top of each
+	// other's, even when another one writes between their read and update
+	replica := newProvider()
+	replica.Client = &racingClient{objectClient: c, race: func() {
+		raced := &EndpointChanges{Create: []*Endpoint{{DNSName: "raced.apps.ci.example", RecordType: "A", Targets: []string{"10.0.0.12"}}}}
+		if err := newProvider().ApplyChanges(context.Background(), raced); err != nil {
+			t.Errorf("Error applying the racing changes: %v", err)
+		}
+	}}
+	mine := &EndpointChanges{Create: []*Endpoint{{DNSName: "replica.apps.ci.example", RecordType: "A", Targets: []string{"10.0.0.13"}}}}
+	if err := replica.ApplyChanges(context.Background(), mine); err != nil {
+		t.Fatalf("Error applying changes: %v", err)
+	}
+	endpoints = nil
+	webhookCall(t, h, http.MethodGet, "/records", nil, &endpoints)
+	if len(endpoints) != 5 {
+		t.Errorf("Expected the changes of every provider to be kept, got %v", endpoints)
+	}
+	for _, line := range []string{"10.0.0.12 raced.apps.ci.example.\n", "10.0.0.13 replica.apps.ci.example.\n"} {
+		if !strings.Contains(block(), line) {
+			t.Errorf("Expected %q in the hosts block\n%s", line, block())
+		}
+	}
+}
+
+// racingClient runs race once, before the first update, as another writer
+// would.
+type racingClient struct {
+	*objectClient
+	race func()
+}
+
+func (c *racingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if race := c.race; race != nil {
+		c.race = nil
+		race()
+	}
+	return c.objectClient.Update(ctx, obj, opts...)
+}
@@ -0,0 +1,39 @@
+package record
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// ClasslessZone returns the RFC 2317 child zone of an IPv4 prefix longer than
+// a /24, e.g. 128-25.74.177.10.in-addr.arpa. for 10.177.74.128/25, which lets
+// the reverse space of the prefix be delegated apart from the rest of its /24.
+// ok is false for any other prefix.
+func ClasslessZone(prefix netip.Prefix) (zone string, ok bool) {
+	if !prefix.IsValid() || !prefix.Addr().Is4() || prefix.Bits() <= 24 {
+		return "", false
+	}
+	octets := prefix.Masked().Addr().As4()
+	return fmt.Sprintf("%d-%d.%d.%d.%d.in-addr.arpa.", octets[3], prefix.Bits(), octets[2], octets[1], octets[0]), true
+}
+
+// Delegate returns the record with its PTR placed in the RFC 2317 child zone
+// of prefix, leaving Reverse as a CNAME to it. Records outside prefix, and
+// prefixes without a child zone, are returned unchanged.
+func (r Record) Delegate(prefix netip.Prefix) Record {
+	if zone, ok := ClasslessZone(prefix); ok && prefix.Contains(r.Addr) {
+		r.Delegation = zone
+	}
+	return r
+}
+
+// Owner returns the owner name of the PTR record of the address: Reverse, or
+// its name within the child zone when the record is delegated.
+func (r Record) Owner() string {
+	if r.Delegation == "" {
+		return r.Reverse
+	}
+	host, _, _ := strings.Cut(r.Reverse, ".")
+	return host + "." + r.Delegation
+}
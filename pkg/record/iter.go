@@ -0,0 +1,270 @@
+package record
+
+import (
+	"container/heap"
+	"fmt"
+	"net/netip"
+)
+
+// Iterator yields records in address order, IPv4 first.
+type Iterator interface {
+	// Next returns the next record, or false once the iterator is exhausted
+	// or has failed.
+	Next() (Record, bool)
+	// Err returns the error which stopped the iteration, if any.
+	Err() error
+}
+
+type sliceIterator struct {
+	records []Record
+}
+
+// FromSlice returns an iterator over records, which must already be sorted.
+func FromSlice(records []Record) Iterator {
+	return &sliceIterator{records: records}
+}
+
+func (it *sliceIterator) Next() (Record, bool) {
+	if len(it.records) == 0 {
+		return Record{}, false
+	}
+	record := it.records[0]
+	it.records = it.records[1:]
+	return record, true
+}
+
+func (it *sliceIterator) Err() error {
+	return nil
+}
+
+type rangeIterator struct {
+	r    Range
+	next netip.Addr
+	fn   func(netip.Addr) (Record, error)
+	err  error
+}
+
+// Expand returns an iterator calling fn for every address of prefix in turn.
+// Records are generated on demand, so memory use does not depend on the size
+// of prefix.
+func Expand(prefix netip.Prefix, fn func(netip.Addr) (Record, error)) Iterator {
+	return ExpandRange(RangeOf(prefix), fn)
+}
+
+// ExpandRange returns an iterator calling fn for every address of r in turn.
+func ExpandRange(r Range, fn func(netip.Addr) (Record, error)) Iterator {
+	return &rangeIterator{r: r, next: r.From, fn: fn}
+}
+
+func (it *rangeIterator) Next() (Record, bool) {
+	if it.err != nil || !it.next.IsValid() || !it.r.Contains(it.next) {
+		return Record{}, false
+	}
+	record, err := it.fn(it.next)
+	if err != nil {
+		it.err = err
+		return Record{}, false
+	}
+	it.next = it.next.Next()
+	return record, true
+}
+
+func (it *rangeIterator) Err() error {
+	return it.err
+}
+
+type filterIterator struct {
+	it   Iterator
+	keep func(Record) bool
+}
+
+// Filter returns an iterator over the records of it for which keep returns
+// true.
+func Filter(it Iterator, keep func(Record) bool) Iterator {
+	return &filterIterator{it: it, keep: keep}
+}
+
+// Published returns an iterator over the records of it which are not
+// suppressed.
+func Published(it Iterator) Iterator {
+	return Filter(it, func(record Record) bool {
+		return !record.Suppressed()
+	})
+}
+
+func (f *filterIterator) Next() (Record, bool) {
+	for record, ok := f.it.Next(); ok; record, ok = f.it.Next() {
+		if f.keep(record) {
+			return record, true
+		}
+	}
+	return Record{}, false
+}
+
+func (f *filterIterator) Err() error {
+	return f.it.Err()
+}
+
+type mapIterator struct {
+	it Iterator
+	fn func(Record) Record
+}
+
+// Map returns an iterator over the records of it as transformed by fn, which
+// must not change their address.
+func Map(it Iterator, fn func(Record) Record) Iterator {
+	return &mapIterator{it: it, fn: fn}
+}
+
+func (m *mapIterator) Next() (Record, bool) {
+	record, ok := m.it.Next()
+	if !ok {
+		return Record{}, false
+	}
+	return m.fn(record), true
+}
+
+func (m *mapIterator) Err() error {
+	return m.it.Err()
+}
+
+type limitIterator struct {
+	it    Iterator
+	max   uint64
+	count uint64
+	err   error
+}
+
+// Limit returns an iterator over the records of it which fails once it
+// yields more than max records, for consumers holding every record in
+// memory.
+func Limit(it Iterator, max uint64) Iterator {
+	return &limitIterator{it: it, max: max}
+}
+
+func (l *limitIterator) Next() (Record, bool) {
+	if l.err != nil {
+		return Record{}, false
+	}
+	record, ok := l.it.Next()
+	if !ok {
+		return Record{}, false
+	}
+	if l.count++; l.count > l.max {
+		l.err = fmt.Errorf("more than %d records", l.max)
+		return Record{}, false
+	}
+	return record, true
+}
+
+func (l *limitIterator) Err() error {
+	if l.err != nil {
+		return l.err
+	}
+	return l.it.Err()
+}
+
+// Count drains it and returns the number of records it yielded.
+func Count(it Iterator) (int, error) {
+	count := 0
+	for _, ok := it.Next(); ok; _, ok = it.Next() {
+		count++
+	}
+	return count, it.Err()
+}
+
+// Collect drains it into a slice.
+func Collect(it Iterator) ([]Record, error) {
+	var records []Record
+	for record, ok := it.Next(); ok; record, ok = it.Next() {
+		records = append(records, record)
+	}
+	return records, it.Err()
+}
+
+type mergeHead struct {
+	record Record
+	it     Iterator
+}
+
+type mergeHeap []mergeHead
+
+func (h mergeHeap) Len() int           { return len(h) }
+func (h mergeHeap) Less(i, j int) bool { return h[i].record.Addr.Less(h[j].record.Addr) }
+func (h mergeHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)        { *h = append(*h, x.(mergeHead)) }
+func (h *mergeHeap) Pop() any {
+	old := *h
+	head := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return head
+}
+
+type mergeIterator struct {
+	precedence Precedence
+	onConflict func(Conflict)
+	heads      mergeHeap
+	iters      []Iterator
+	started    bool
+	err        error
+}
+
+// Merge combines sorted iterators into one sorted iterator yielding a single
+// record per address. Records for the same address are resolved as by
+// Set.Add, and onConflict, if not nil, is called for every conflict. Only one
+// record per input is held at a time.
+func Merge(precedence Precedence, onConflict func(Conflict), iters ...Iterator) Iterator {
+	if precedence == nil {
+		precedence = DefaultPrecedence
+	}
+	return &mergeIterator{
+		precedence: precedence,
+		onConflict: onConflict,
+		iters:      iters,
+	}
+}
+
+// advance pulls the next record of it onto the heap.
+func (m *mergeIterator) advance(it Iterator) {
+	record, ok := it.Next()
+	if !ok {
+		if err := it.Err(); err != nil && m.err == nil {
+			m.err = err
+		}
+		return
+	}
+	heap.Push(&m.heads, mergeHead{record: record, it: it})
+}
+
+func (m *mergeIterator) Next() (Record, bool) {
+	if !m.started {
+		m.started = true
+		for _, it := range m.iters {
+			m.advance(it)
+		}
+	}
+	if m.err != nil || len(m.heads) == 0 {
+		return Record{}, false
+	}
+
+	head := heap.Pop(&m.heads).(mergeHead)
+	kept := head.record
+	m.advance(head.it)
+	for m.err == nil && len(m.heads) > 0 && m.heads[0].record.Addr == kept.Addr {
+		head := heap.Pop(&m.heads).(mergeHead)
+		var dropped Record
+		kept, dropped = m.precedence.resolve(kept, head.record)
+		if conflicts(kept, dropped) && m.onConflict != nil {
+			m.onConflict(Conflict{Kept: kept, Dropped: dropped})
+		}
+		m.advance(head.it)
+	}
+	if m.err != nil {
+		return Record{}, false
+	}
+	return kept, true
+}
+
+func (m *mergeIterator) Err() error {
+	return m.err
+}
@@ -0,0 +1,203 @@
+package record
+
+import (
+	"net/netip"
+	"sort"
+)
+
+// Range is an inclusive range of addresses of a single family.
+type Range struct {
+	From netip.Addr
+	To   netip.Addr
+}
+
+// RangeOf returns the range of addresses of prefix.
+func RangeOf(prefix netip.Prefix) Range {
+	prefix = prefix.Masked()
+	return Range{From: prefix.Addr(), To: lastAddr(prefix)}
+}
+
+// Contains returns true if addr is within the range.
+func (r Range) Contains(addr netip.Addr) bool {
+	return addr.BitLen() == r.From.BitLen() && !addr.Less(r.From) && !r.To.Less(addr)
+}
+
+// Prefixes returns the smallest list of prefixes exactly covering the range.
+func (r Range) Prefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for from := r.From; from.IsValid() && !r.To.Less(from); {
+		// the largest aligned prefix starting at from which ends within the range
+		prefix := netip.PrefixFrom(from, from.BitLen())
+		for bits := 0; bits <= from.BitLen(); bits++ {
+			candidate := netip.PrefixFrom(from, bits)
+			if candidate.Masked().Addr() == from && !r.To.Less(lastAddr(candidate)) {
+				prefix = candidate
+				break
+			}
+		}
+		prefixes = append(prefixes, prefix)
+		from = lastAddr(prefix).Next()
+	}
+	return prefixes
+}
+
+func (r Range) String() string {
+	return r.From.String() + "-" + r.To.String()
+}
+
+// lastAddr returns the last address of prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	prefix = prefix.Masked()
+	bytes := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(bytes)*8; bit++ {
+		bytes[bit/8] |= 0x80 >> (bit % 8)
+	}
+	addr, _ := netip.AddrFromSlice(bytes)
+	return addr
+}
+
+// Segment is a range owned by the same sources throughout.
+type Segment struct {
+	Range
+	// Owners are the sources whose prefixes cover the range, in the order
+	// they were added to the set.
+	Owners []Source
+}
+
+type prefixEntry struct {
+	prefix netip.Prefix
+	source Source
+}
+
+// PrefixSet is a set of prefixes contributed by one or more sources. The
+// prefixes of every source are merged, so that overlapping and adjacent
+// prefixes are treated as a single range, while the set still knows which
+// source owns which part of it.
+type PrefixSet struct {
+	entries []prefixEntry
+}
+
+// Add adds prefix, owned by source, to the set. IPv4-mapped IPv6 prefixes are
+// treated as IPv4.
+func (s *PrefixSet) Add(prefix netip.Prefix, source Source) {
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	s.entries = append(s.entries, prefixEntry{prefix: prefix.Masked(), source: source})
+}
+
+// Contains returns true if addr is within any prefix of the set.
+func (s *PrefixSet) Contains(addr netip.Addr) bool {
+	return len(s.Owners(addr)) > 0
+}
+
+// Owners returns the sources whose prefixes contain addr, in the order they
+// were added to the set.
+func (s *PrefixSet) Owners(addr netip.Addr) []Source {
+	addr = addr.Unmap()
+	var owners []Source
+	for _, entry := range s.entries {
+		if entry.prefix.Contains(addr) && !containsSource(owners, entry.source) {
+			owners = append(owners, entry.source)
+		}
+	}
+	return owners
+}
+
+func containsSource(sources []Source, source Source) bool {
+	for _, s := range sources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+// Segments splits the set into disjoint ranges, ordered by address with IPv4
+// first, each of which is owned by the same sources throughout. Adjacent
+// ranges with the same owners are merged.
+func (s *PrefixSet) Segments() []Segment {
+	// every owner change happens at the first address of a prefix or just
+	// after the last one
+	var bounds []netip.Addr
+	for _, entry := range s.entries {
+		r := RangeOf(entry.prefix)
+		bounds = append(bounds, r.From)
+		if next := r.To.Next(); next.IsValid() {
+			bounds = append(bounds, next)
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i].Less(bounds[j]) })
+
+	var segments []Segment
+	for i, from := range bounds {
+		if i > 0 && bounds[i-1] == from {
+			continue
+		}
+		owners := s.Owners(from)
+		if len(owners) == 0 {
+			continue
+		}
+		// the segment ends before the next bound, or with the prefixes
+		// covering it when there is no further bound of the same family
+		var to netip.Addr
+		for _, next := range bounds[i+1:] {
+			if next != from {
+				if next.BitLen() == from.BitLen() {
+					to = next.Prev()
+				}
+				break
+			}
+		}
+		if !to.IsValid() {
+			for _, entry := range s.entries {
+				if last := lastAddr(entry.prefix); entry.prefix.Contains(from) && (!to.IsValid() || last.Less(to)) {
+					to = last
+				}
+			}
+		}
+
+		if n := len(segments); n > 0 && segments[n-1].To.Next() == from && sameSources(segments[n-1].Owners, owners) {
+			segments[n-1].To = to
+			continue
+		}
+		segments = append(segments, Segment{Range: Range{From: from, To: to}, Owners: owners})
+	}
+	return segments
+}
+
+func sameSources(a, b []Source) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Ranges returns the merged ranges of the set, ordered by address with IPv4
+// first. Overlapping and adjacent prefixes are combined regardless of their
+// owners.
+func (s *PrefixSet) Ranges() []Range {
+	var ranges []Range
+	for _, segment := range s.Segments() {
+		if n := len(ranges); n > 0 && ranges[n-1].To.Next() == segment.From {
+			ranges[n-1].To = segment.To
+			continue
+		}
+		ranges = append(ranges, segment.Range)
+	}
+	return ranges
+}
+
+// Prefixes returns the smallest list of prefixes covering the set.
+func (s *PrefixSet) Prefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, r := range s.Ranges() {
+		prefixes = append(prefixes, r.Prefixes()...)
+	}
+	return prefixes
+}
@@ -0,0 +1,76 @@
+package record
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestPrefixSetMergesPrefixes(t *testing.T) {
+	mgmt := Source{Kind: SourceCIDR, Name: "mgmt"}
+	lab := Source{Kind: SourceCIDR, Name: "lab"}
+	var set PrefixSet
+	for _, cidr := range []string{"192.168.1.0/24", "192.168.0.0/24", "192.168.1.128/25", "fd65::/120"} {
+		set.Add(netip.MustParsePrefix(cidr), mgmt)
+	}
+	set.Add(netip.MustParsePrefix("192.168.1.64/26"), lab)
+	set.Add(netip.MustParsePrefix("10.0.0.0/30"), lab)
+	set.Add(netip.MustParsePrefix("10.0.0.4/31"), lab)
+
+	expected := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/30"),
+		netip.MustParsePrefix("10.0.0.4/31"),
+		netip.MustParsePrefix("192.168.0.0/23"),
+		netip.MustParsePrefix("fd65::/120"),
+	}
+	if prefixes := set.Prefixes(); !reflect.DeepEqual(prefixes, expected) {
+		t.Errorf("Expected %v, got %v", expected, prefixes)
+	}
+
+	segments := set.Segments()
+	var ranges []string
+	for _, segment := range segments {
+		ranges = append(ranges, segment.String())
+	}
+	expectedRanges := []string{
+		"10.0.0.0-10.0.0.5",
+		"192.168.0.0-192.168.1.63",
+		"192.168.1.64-192.168.1.127",
+		"192.168.1.128-192.168.1.255",
+		"fd65::-fd65::ff",
+	}
+	if !reflect.DeepEqual(ranges, expectedRanges) {
+		t.Errorf("Expected segments %v, got %v", expectedRanges, ranges)
+	}
+	if owners := segments[2].Owners; !reflect.DeepEqual(owners, []Source{mgmt, lab}) {
+		t.Errorf("Expected 192.168.1.64/26 to be owned by mgmt and lab, got %v", owners)
+	}
+	if owners := set.Owners(netip.MustParseAddr("192.168.1.200")); !reflect.DeepEqual(owners, []Source{mgmt}) {
+		t.Errorf("Expected 192.168.1.200 to be owned by mgmt, got %v", owners)
+	}
+	if set.Contains(netip.MustParseAddr("10.0.0.6")) {
+		t.Errorf("Expected 10.0.0.6 to be outside the set")
+	}
+}
+
+func TestExpandRange(t *testing.T) {
+	r := Range{From: netip.MustParseAddr("10.0.0.250"), To: netip.MustParseAddr("10.0.1.4")}
+	count, err := Count(ExpandRange(r, func(addr netip.Addr) (Record, error) {
+		return New(addr, Source{})
+	}))
+	if err != nil {
+		t.Fatalf("Error expanding range: %v", err)
+	}
+	if count != 11 {
+		t.Errorf("Expected 11 records, got %d", count)
+	}
+	expected := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.250/31"),
+		netip.MustParsePrefix("10.0.0.252/30"),
+		netip.MustParsePrefix("10.0.1.0/30"),
+		netip.MustParsePrefix("10.0.1.4/32"),
+	}
+	if prefixes := r.Prefixes(); !reflect.DeepEqual(prefixes, expected) {
+		t.Errorf("Expected %v, got %v", expected, prefixes)
+	}
+}
@@ -0,0 +1,305 @@
+package record
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Family is the address family of a record.
+type Family int
+
+const (
+	IPv4 Family = 4
+	IPv6 Family = 6
+)
+
+func (f Family) String() string {
+	switch f {
+	case IPv4:
+		return "IPv4"
+	case IPv6:
+		return "IPv6"
+	}
+	return fmt.Sprintf("Family(%d)", int(f))
+}
+
+// SourceKind identifies the kind of input a record was generated from.
+type SourceKind string
+
+const (
+	// SourceSubnets is the subnets.json key of the vsphere-config secret.
+	SourceSubnets SourceKind = "subnets"
+	// SourceCIDR is an additional CIDR configured on the command line.
+	SourceCIDR SourceKind = "cidr"
+	// SourceNetwork is a vsphere-capacity-manager Network.
+	SourceNetwork SourceKind = "network"
+	// SourceConfigMap is a key of a selected ConfigMap.
+	SourceConfigMap SourceKind = "configmap"
+	// SourceFile is a local file.
+	SourceFile SourceKind = "file"
+	// SourceExternalDNS is an endpoint handed over by external-dns to the
+	// webhook provider, and kept in its ConfigMap.
+	SourceExternalDNS SourceKind = "external-dns"
+	// SourceLease only ranks the records of a Network named after the Lease
+	// holding it, which otherwise keep SourceNetwork as their kind.
+	SourceLease SourceKind = "lease"
+)
+
+// Source describes where a record came from.
+type Source struct {
+	Kind SourceKind
+	// Name identifies the entry within the source, e.g. the
+	// datacenter/VLAN path of a subnet or the namespace/name of a Network.
+	Name string
+	// Lease is the Lease the record is named after, if any.
+	Lease string
+}
+
+func (s Source) String() string {
+	return fmt.Sprintf("%s:%s", s.Kind, s.Name)
+}
+
+// Publish selects the records published for an address.
+type Publish string
+
+const (
+	// PublishReverse publishes the PTR record of the address only. It is the
+	// default.
+	PublishReverse Publish = "reverse"
+	// PublishForward publishes A or AAAA records for the names only.
+	PublishForward Publish = "forward"
+	// PublishBoth publishes the PTR record and the A or AAAA records.
+	PublishBoth Publish = "both"
+)
+
+// ParsePublish validates a publish mode name.
+func ParsePublish(name string) (Publish, error) {
+	switch publish := Publish(name); publish {
+	case PublishReverse, PublishForward, PublishBoth:
+		return publish, nil
+	}
+	return "", fmt.Errorf("unknown publish mode %q: expected reverse, forward or both", name)
+}
+
+// Reverse returns true if the PTR record is published.
+func (p Publish) Reverse() bool {
+	return p != PublishForward
+}
+
+// Forward returns true if the A or AAAA records are published.
+func (p Publish) Forward() bool {
+	return p == PublishForward || p == PublishBoth
+}
+
+// Precedence ranks source kinds when they disagree on the name of an address.
+// The kind with the higher value wins.
+type Precedence map[SourceKind]int
+
+// DefaultPrecedence prefers records added by hand in ConfigMaps and files
+// over the names external-dns hands over, those over the names of leased
+// networks, those over the curated subnets.json inventory, that over VCM
+// Networks, and all of them over catch-all additional CIDRs.
+var DefaultPrecedence = Precedence{
+	SourceConfigMap:   40,
+	SourceFile:        40,
+	SourceExternalDNS: 38,
+	SourceLease:       35,
+	SourceSubnets:     30,
+	SourceNetwork:     20,
+	SourceCIDR:        10,
+}
+
+// Record is the reverse DNS data for a single address.
+type Record struct {
+	Addr netip.Addr
+	// Reverse is the fully qualified reverse lookup name of Addr.
+	Reverse string
+	// Delegation is the RFC 2317 child zone holding the PTR record of Addr,
+	// if any. Reverse is then a CNAME to Owner in the parent zone.
+	Delegation string
+	// Names are the names Addr resolves to, the first being the canonical one.
+	Names []string
+	// TTL is the time to live in seconds. Zero leaves it to the server default.
+	TTL    uint32
+	Family Family
+	Source Source
+	// Publish selects whether the PTR record, the forward records of Names,
+	// or both are published. The zero value publishes the PTR record.
+	Publish Publish
+	// Priority breaks ties between sources of equal precedence; the higher
+	// value wins. It is taken from data.Subnet.Priority.
+	Priority int
+}
+
+// New returns the record pointing addr at names. IPv4-mapped IPv6 addresses
+// are treated as IPv4 so that every address has a single canonical form.
+func New(addr netip.Addr, source Source, names ...string) (Record, error) {
+	if !addr.IsValid() {
+		return Record{}, fmt.Errorf("invalid address")
+	}
+	addr = addr.Unmap()
+	reverse, err := dns.ReverseAddr(addr.String())
+	if err != nil {
+		return Record{}, fmt.Errorf("unable to reverse address: %v", err)
+	}
+	family := IPv6
+	if addr.Is4() {
+		family = IPv4
+	}
+	return Record{
+		Addr:    addr,
+		Reverse: reverse,
+		Names:   names,
+		Family:  family,
+		Source:  source,
+	}, nil
+}
+
+// Name returns the canonical name of the record.
+func (r Record) Name() string {
+	if len(r.Names) == 0 {
+		return ""
+	}
+	return r.Names[0]
+}
+
+// Suppressed returns true if the record has no names. Such a record reserves
+// its address: nothing is published for it, and it shadows the records of
+// sources with a lower precedence.
+func (r Record) Suppressed() bool {
+	return len(r.Names) == 0
+}
+
+// conflicts returns true if kept and dropped disagree on the names of their
+// address. Suppressed records never conflict, as they are deliberate.
+func conflicts(kept, dropped Record) bool {
+	return !kept.Suppressed() && !dropped.Suppressed() && !sameNames(kept, dropped)
+}
+
+// Conflict describes two sources mapping the same address to different names.
+type Conflict struct {
+	Kept    Record
+	Dropped Record
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s: kept %s from %s, dropped %s from %s", c.Kept.Addr, c.Kept.Name(), c.Kept.Source, c.Dropped.Name(), c.Dropped.Source)
+}
+
+// Set is a collection of records holding at most one record per address.
+type Set struct {
+	records    map[netip.Addr]Record
+	precedence Precedence
+	conflicts  []Conflict
+}
+
+// NewSet returns an empty set resolving conflicts with precedence, or with
+// DefaultPrecedence when precedence is nil.
+func NewSet(precedence Precedence) *Set {
+	if precedence == nil {
+		precedence = DefaultPrecedence
+	}
+	return &Set{
+		records:    map[netip.Addr]Record{},
+		precedence: precedence,
+	}
+}
+
+// Add adds records to the set. When an address is already present the record
+// from the source with the higher precedence, then the higher priority, is
+// kept. Remaining ties go to the lexically smaller source so that the result
+// does not depend on the order records were added in. Records which disagree
+// on the names of an address are reported by Conflicts.
+func (s *Set) Add(records ...Record) {
+	for _, record := range records {
+		existing, exists := s.records[record.Addr]
+		if !exists {
+			s.records[record.Addr] = record
+			continue
+		}
+
+		kept, dropped := s.precedence.resolve(existing, record)
+		s.records[record.Addr] = kept
+		if conflicts(kept, dropped) {
+			s.conflicts = append(s.conflicts, Conflict{Kept: kept, Dropped: dropped})
+		}
+	}
+}
+
+// resolve returns which of two records for the same address is kept.
+func (p Precedence) resolve(a, b Record) (kept, dropped Record) {
+	if p.precedes(b, a) {
+		return b, a
+	}
+	return a, b
+}
+
+// precedes returns true if a should be kept over b.
+func (p Precedence) precedes(a, b Record) bool {
+	if pa, pb := p.of(a), p.of(b); pa != pb {
+		return pa > pb
+	}
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.Source.String() < b.Source.String()
+}
+
+// of returns the precedence of rec, that of SourceLease if it is named after
+// a Lease and the precedence sets one.
+func (p Precedence) of(rec Record) int {
+	if value, ok := p[SourceLease]; ok && rec.Source.Lease != "" {
+		return value
+	}
+	return p[rec.Source.Kind]
+}
+
+func sameNames(a, b Record) bool {
+	if len(a.Names) != len(b.Names) {
+		return false
+	}
+	for i := range a.Names {
+		if !strings.EqualFold(a.Names[i], b.Names[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Conflicts returns every conflict found while adding records, in the order
+// they were found.
+func (s *Set) Conflicts() []Conflict {
+	return s.conflicts
+}
+
+// Get returns the record for addr.
+func (s *Set) Get(addr netip.Addr) (Record, bool) {
+	record, ok := s.records[addr.Unmap()]
+	return record, ok
+}
+
+// Len returns the number of records in the set.
+func (s *Set) Len() int {
+	return len(s.records)
+}
+
+// Records returns the records of the set ordered by address, IPv4 first.
+func (s *Set) Records() []Record {
+	records := make([]Record, 0, len(s.records))
+	for _, record := range s.records {
+		records = append(records, record)
+	}
+	Sort(records)
+	return records
+}
+
+// Sort orders records by address, IPv4 first.
+func Sort(records []Record) {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Addr.Less(records[j].Addr)
+	})
+}
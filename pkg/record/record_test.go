@@ -0,0 +1,136 @@
+package record
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestSetDeduplicatesAddresses(t *testing.T) {
+	set := NewSet(nil)
+	for _, addr := range []string{"10.0.0.2", "::ffff:10.0.0.2", "fd00::1", "fd00:0:0::1", "10.0.0.1"} {
+		rec, err := New(netip.MustParseAddr(addr), Source{Kind: SourceCIDR, Name: addr}, "host.example.")
+		if err != nil {
+			t.Fatalf("Error creating record for %s: %v", addr, err)
+		}
+		set.Add(rec)
+	}
+
+	records := set.Records()
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records, got %d", len(records))
+	}
+	expected := []string{"1.0.0.10.in-addr.arpa.", "2.0.0.10.in-addr.arpa.", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa."}
+	for i, rec := range records {
+		if rec.Reverse != expected[i] {
+			t.Errorf("Expected %s at %d, got %s", expected[i], i, rec.Reverse)
+		}
+	}
+	if records[1].Source.Name != "10.0.0.2" || records[1].Family != IPv4 {
+		t.Errorf("Expected the first IPv4 source to be kept, got %s %s", records[1].Source, records[1].Family)
+	}
+}
+
+func TestSetResolvesConflicts(t *testing.T) {
+	addr := netip.MustParseAddr("10.177.74.130")
+	newRecord := func(kind SourceKind, name string, priority int, hostname string) Record {
+		rec, err := New(addr, Source{Kind: kind, Name: name}, hostname)
+		if err != nil {
+			t.Fatalf("Error creating record: %v", err)
+		}
+		rec.Priority = priority
+		return rec
+	}
+	cidr := newRecord(SourceCIDR, "10.0.0.0/8", 0, "ip-10-177-74-130.example.")
+	low := newRecord(SourceSubnets, "bcr01a.dal10/1153", 10, "low.example.")
+	high := newRecord(SourceSubnets, "bcr03a.dal10/1153", 254, "high.example.")
+	same := newRecord(SourceNetwork, "vsphere-infra-helpers/ci-vlan-1153", 0, "HIGH.example.")
+
+	for _, order := range [][]Record{{cidr, low, high, same}, {same, high, low, cidr}} {
+		set := NewSet(nil)
+		set.Add(order...)
+		kept, _ := set.Get(addr)
+		if kept.Name() != "high.example." {
+			t.Errorf("Expected high.example. to be kept, got %s", kept.Name())
+		}
+		// the network record agrees with the kept name and is not a conflict
+		if len(set.Conflicts()) != 2 {
+			t.Errorf("Expected 2 conflicts, got %v", set.Conflicts())
+		}
+	}
+
+	set := NewSet(Precedence{SourceCIDR: 100})
+	set.Add(high, cidr)
+	if kept, _ := set.Get(addr); kept.Source.Kind != SourceCIDR {
+		t.Errorf("Expected the cidr record to be kept, got %s", kept.Source)
+	}
+}
+
+func TestMergeIterators(t *testing.T) {
+	source := func(kind SourceKind) func(netip.Addr) (Record, error) {
+		return func(addr netip.Addr) (Record, error) {
+			return New(addr, Source{Kind: kind}, string(kind)+".example.")
+		}
+	}
+	explicit, err := New(netip.MustParseAddr("10.0.0.5"), Source{Kind: SourceSubnets}, "subnets.example.")
+	if err != nil {
+		t.Fatalf("Error creating record: %v", err)
+	}
+
+	var conflicts []Conflict
+	it := Merge(nil, func(conflict Conflict) { conflicts = append(conflicts, conflict) },
+		Expand(netip.MustParsePrefix("10.0.0.0/29"), source(SourceCIDR)),
+		FromSlice([]Record{explicit}),
+		Expand(netip.MustParsePrefix("10.0.0.4/30"), source(SourceNetwork)),
+	)
+	records, err := Collect(it)
+	if err != nil {
+		t.Fatalf("Error merging: %v", err)
+	}
+	if len(records) != 8 {
+		t.Fatalf("Expected 8 records, got %d", len(records))
+	}
+	expected := []string{"cidr", "cidr", "cidr", "cidr", "network", "subnets", "network", "network"}
+	for i, rec := range records {
+		if rec.Addr != netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}) {
+			t.Errorf("Expected 10.0.0.%d at %d, got %s", i, i, rec.Addr)
+		}
+		if rec.Name() != expected[i]+".example." {
+			t.Errorf("Expected %s at %d, got %s", expected[i], i, rec.Name())
+		}
+	}
+	// 10.0.0.5 conflicts twice, the others in 10.0.0.4/30 once
+	if len(conflicts) != 5 {
+		t.Errorf("Expected 5 conflicts, got %d", len(conflicts))
+	}
+
+	if _, err := Collect(Limit(Expand(netip.MustParsePrefix("10.0.0.0/29"), source(SourceCIDR)), 8)); err != nil {
+		t.Errorf("Expected 8 records to fit a limit of 8, got %v", err)
+	}
+	if _, err := Collect(Limit(Expand(netip.MustParsePrefix("10.0.0.0/29"), source(SourceCIDR)), 7)); err == nil {
+		t.Errorf("Expected 8 records to exceed a limit of 7")
+	}
+}
+
+func TestClasslessDelegation(t *testing.T) {
+	for cidr, expected := range map[string]string{
+		"10.177.74.128/25": "128-25.74.177.10.in-addr.arpa.",
+		"10.177.74.64/26":  "64-26.74.177.10.in-addr.arpa.",
+		"10.177.74.0/24":   "",
+		"fd65::/120":       "",
+	} {
+		if zone, _ := ClasslessZone(netip.MustParsePrefix(cidr)); zone != expected {
+			t.Errorf("Expected %q for %s, got %q", expected, cidr, zone)
+		}
+	}
+
+	rec, err := New(netip.MustParseAddr("10.177.74.130"), Source{}, "host.example.")
+	if err != nil {
+		t.Fatalf("Error creating record: %v", err)
+	}
+	if owner := rec.Delegate(netip.MustParsePrefix("10.177.74.0/25")).Owner(); owner != rec.Reverse {
+		t.Errorf("Expected a record outside the prefix to stay in the parent zone, got %s", owner)
+	}
+	if owner := rec.Delegate(netip.MustParsePrefix("10.177.74.128/25")).Owner(); owner != "130.128-25.74.177.10.in-addr.arpa." {
+		t.Errorf("Expected the record to move to the child zone, got %s", owner)
+	}
+}